@@ -0,0 +1,79 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"./vec3"
+)
+
+// adaptive sampling: pixels stop once their estimate is good enough and
+// keep sampling (up to MaxSamples) while it is not
+type AdaptiveSettings struct {
+	Threshold  float64 // relative standard error at which a pixel is done, zero turns adaptive sampling off
+	MaxSamples int     // zero for four times the samples per pixel
+	Heatmap    string  // image of the samples taken per pixel, if set
+}
+
+var ADAPTIVE = AdaptiveSettings{}
+
+// samples taken at least (before the variance means anything) and at most per pixel
+func (a AdaptiveSettings) sampleRange(ns int) (int, int) {
+	if a.Threshold <= 0 {
+		return ns, ns
+	}
+	max := a.MaxSamples
+	if max == 0 {
+		max = 4 * ns
+	}
+	return minInt(maxInt(ns/4, 8), max), max
+}
+
+// running mean and variance of the luminance of a pixel's samples (Welford)
+type pixelEstimate struct {
+	n       int
+	mean    float64
+	squares float64 // sum of squared differences from the mean
+}
+
+func (e *pixelEstimate) add(c vec3.Vec3) {
+	e.n++
+	l := luminance(c)
+	delta := l - e.mean
+	e.mean += delta / float64(e.n)
+	e.squares += delta * (l - e.mean)
+}
+
+// standard error of the mean relative to the mean, dark pixels are measured against 0.1
+// so they don't sample forever for errors too small to see
+func (e *pixelEstimate) converged(threshold float64) bool {
+	if e.n < 2 {
+		return false
+	}
+	variance := e.squares / float64(e.n-1)
+	return math.Sqrt(variance/float64(e.n)) <= threshold*math.Max(e.mean, 0.1)
+}
+
+
+// sample counts as colors, blue for the fewest through green to red for the most
+func heatmapImage(counts []int, nx, ny int) *image.RGBA {
+	lo, hi := counts[0], counts[0]
+	for _, c := range counts {
+		lo, hi = minInt(lo, c), maxInt(hi, c)
+	}
+	pixels := image.NewRGBA(image.Rect(0, 0, nx, ny))
+	for y := 0; y < ny; y++ {
+		for x := 0; x < nx; x++ {
+			t := 0.0
+			if hi > lo {
+				t = float64(counts[y*nx+x]-lo) / float64(hi-lo)
+			}
+			r := math.Max(0, 2*t-1)
+			g := 1 - math.Abs(2*t-1)
+			b := math.Max(0, 1-2*t)
+			pixels.SetRGBA(x, y, color.RGBA{uint8(255 * r), uint8(255 * g), uint8(255 * b), 255})
+		}
+	}
+	return pixels
+}
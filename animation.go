@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"./vec3"
+)
+
+// animation: scene files can give the camera, object transforms, lights and materials
+// keyframe tracks, every frame of a range is built from them and rendered on its own
+type AnimationSettings struct {
+	Frames string  // range to render, "first-last", empty for the scene file's
+	Output string  // name of the frames, with the frame number as a printf verb
+	Movie  string  // animated GIF (.gif) or APNG (.png) of all frames, written instead of the frames
+	FPS    float64 // of the movie
+	Dither bool    // the colors of GIF frames
+	Frame  int     // being rendered
+
+	movie []*image.RGBA // frames so far
+}
+
+var ANIMATION = AnimationSettings{Output: "frame_%04d.png", FPS: 24, Dither: true}
+
+// "animation" of a scene file
+type SceneAnimation struct {
+	Frames  [2]int  // first and last frame
+	Shutter float64 // fraction of a frame the shutter is open for, objects moving meanwhile are blurred
+}
+
+// keyframes of a value, scalars are stored in X
+//
+//	{"interpolation": "catmull-rom", "keys": [{"frame": 0, "value": [0, 1, 4]}, {"frame": 48, "value": [4, 1, 0]}]}
+//
+// interpolation is linear (the default), bezier or catmull-rom, bezier keys can have "in"
+// and "out" handles relative to their value (by default the curve is as smooth as catmull-rom)
+type Track struct {
+	Interpolation string
+	Keys          []TrackKey
+}
+
+type TrackKey struct {
+	Frame   float64
+	Value   trackValue
+	In, Out *trackValue
+}
+
+// a number or up to three of them in JSON
+type trackValue vec3.Vec3
+
+func (v *trackValue) UnmarshalJSON(data []byte) error {
+	var x float64
+	if json.Unmarshal(data, &x) == nil {
+		*v = trackValue{X: x}
+		return nil
+	}
+	var xs []float64
+	if err := json.Unmarshal(data, &xs); err != nil || len(xs) == 0 || len(xs) > 3 {
+		return fmt.Errorf("a track value is a number or a list of up to three")
+	}
+	xs = append(xs, 0, 0)
+	*v = trackValue{xs[0], xs[1], xs[2]}
+	return nil
+}
+
+func (t *Track) UnmarshalJSON(data []byte) error {
+	// the same fields without this method
+	type track Track
+	if err := json.Unmarshal(data, (*track)(t)); err != nil {
+		return err
+	}
+	switch t.Interpolation {
+	case "", "linear", "bezier", "catmull-rom":
+	default:
+		return fmt.Errorf("unknown interpolation `%s`", t.Interpolation)
+	}
+	if len(t.Keys) == 0 {
+		return fmt.Errorf("a track needs keys")
+	}
+	sort.SliceStable(t.Keys, func(i, j int) bool { return t.Keys[i].Frame < t.Keys[j].Frame })
+	return nil
+}
+
+// value at the frame, held before the first and after the last key
+func (t *Track) At(frame float64) vec3.Vec3 {
+	keys := t.Keys
+	if frame <= keys[0].Frame {
+		return vec3.Vec3(keys[0].Value)
+	}
+	last := len(keys) - 1
+	if frame >= keys[last].Frame {
+		return vec3.Vec3(keys[last].Value)
+	}
+	i := sort.Search(len(keys), func(i int) bool { return keys[i].Frame > frame }) - 1
+	a, b := vec3.Vec3(keys[i].Value), vec3.Vec3(keys[i+1].Value)
+	u := (frame - keys[i].Frame) / (keys[i+1].Frame - keys[i].Frame)
+
+	switch t.Interpolation {
+	case "catmull-rom":
+		// the ends are extended by mirroring their neighbours
+		p0 := vec3.Sub(vec3.Scale(a, 2), b)
+		if i > 0 {
+			p0 = vec3.Vec3(keys[i-1].Value)
+		}
+		p3 := vec3.Sub(vec3.Scale(b, 2), a)
+		if i+2 <= last {
+			p3 = vec3.Vec3(keys[i+2].Value)
+		}
+		u2, u3 := u*u, u*u*u
+		v := vec3.Scale(a, 2)
+		v = vec3.Add(v, vec3.Scale(vec3.Sub(b, p0), u))
+		v = vec3.Add(v, vec3.Scale(vec3.Add(vec3.Sub(vec3.Scale(p0, 2), vec3.Scale(a, 5)), vec3.Sub(vec3.Scale(b, 4), p3)), u2))
+		v = vec3.Add(v, vec3.Scale(vec3.Add(vec3.Sub(vec3.Scale(a, 3), p0), vec3.Sub(p3, vec3.Scale(b, 3))), u3))
+		return vec3.Scale(v, 0.5)
+	case "bezier":
+		out := vec3.Scale(t.tangent(i), 1.0/3)
+		if keys[i].Out != nil {
+			out = vec3.Vec3(*keys[i].Out)
+		}
+		in := vec3.Scale(t.tangent(i+1), -1.0/3)
+		if keys[i+1].In != nil {
+			in = vec3.Vec3(*keys[i+1].In)
+		}
+		p1, p2 := vec3.Add(a, out), vec3.Add(b, in)
+		s := 1 - u
+		v := vec3.Scale(a, s*s*s)
+		v = vec3.Add(v, vec3.Scale(p1, 3*s*s*u))
+		v = vec3.Add(v, vec3.Scale(p2, 3*s*u*u))
+		return vec3.Add(v, vec3.Scale(b, u*u*u))
+	}
+	return lerp(a, b, u)
+}
+
+// change of the value per key at key i (like catmull-rom, one sided at the ends)
+func (t *Track) tangent(i int) vec3.Vec3 {
+	keys := t.Keys
+	prev, next := maxInt(i-1, 0), minInt(i+1, len(keys)-1)
+	return vec3.Scale(vec3.Sub(vec3.Vec3(keys[next].Value), vec3.Vec3(keys[prev].Value)), 1/float64(next-prev))
+}
+
+// tracks of one part of a scene file, by the name of what they animate
+type Tracks map[string]*Track
+
+func (tracks Tracks) check(names ...string) error {
+	for name := range tracks {
+		found := false
+		for _, n := range names {
+			found = found || name == n
+		}
+		if !found {
+			return fmt.Errorf("no `%s` to animate (expected %s)", name, strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+// value of the named track at the frame, or static if there is no such track
+func (tracks Tracks) at(name string, frame float64, static vec3.Vec3) vec3.Vec3 {
+	if t, ok := tracks[name]; ok {
+		return t.At(frame)
+	}
+	return static
+}
+
+func (tracks Tracks) scalarAt(name string, frame float64, static float64) float64 {
+	return tracks.at(name, frame, vec3.Vec3{X: static}).X
+}
+
+
+// the scene file at a frame of its animation
+func (f *SceneFile) AtFrame(frame int) *SceneFile {
+	g := *f
+	g.frame = float64(frame)
+	return &g
+}
+
+// first and last frame, from "first-last" or else the scene file
+func (f *SceneFile) frameRange(frames string) (int, int, error) {
+	if frames == "" {
+		if f.Animation == nil {
+			return 0, 0, fmt.Errorf("no frames to render (the scene file has no animation, use -frames)")
+		}
+		return f.Animation.Frames[0], f.Animation.Frames[1], nil
+	}
+	return parseFrames(frames)
+}
+
+// "first-last" or a single frame
+func parseFrames(frames string) (int, int, error) {
+	parts := strings.SplitN(frames, "-", 2)
+	first, err := strconv.Atoi(parts[0])
+	last := first
+	if err == nil && len(parts) == 2 {
+		last, err = strconv.Atoi(parts[1])
+	}
+	if err != nil || last < first {
+		return 0, 0, fmt.Errorf("frames `%s` are not a range like 0-47", frames)
+	}
+	return first, last, nil
+}
+
+// object transform at a time given in frames
+func (o SceneObject) pose(frame float64) Keyframe {
+	k := Keyframe{Scale: vec3.New(1.0, 1.0, 1.0)}
+	if o.Transform != nil {
+		k.Translation, k.Rotation = o.Transform.Translation.vec(), o.Transform.Rotation.vec()
+		if o.Transform.Scale != nil {
+			k.Scale = o.Transform.Scale.vec()
+		}
+	}
+	k.Translation = o.Tracks.at("translation", frame, k.Translation)
+	k.Rotation = o.Tracks.at("rotation", frame, k.Rotation)
+	k.Scale = o.Tracks.at("scale", frame, k.Scale)
+	return k
+}
+
+// places the object with its transform, moving over the shutter interval (time 0 to 1)
+// if it is animated and the shutter is open for a while
+func (f *SceneFile) place(o SceneObject, object Hitable) (Hitable, error) {
+	if o.Transform == nil && len(o.Tracks) == 0 {
+		return object, nil
+	}
+	open := o.pose(f.frame)
+	if f.Animation != nil && f.Animation.Shutter > 0 && len(o.Tracks) > 0 {
+		open.Time = 0
+		close := o.pose(f.frame + f.Animation.Shutter)
+		close.Time = 1
+		return NewMovingInstance(object, []Keyframe{open, close})
+	}
+	return NewInstance(object, open.Matrix()), nil
+}
+
+// frames are saved (or collected for the movie) once each, by a single plain render
+func animationModes() error {
+	if PROGRESSIVE.Passes > 0 || PREVIEW.Enabled || BENCHMARK {
+		return fmt.Errorf("animations are not rendered with -passes, -preview or -benchmark")
+	}
+	return nil
+}
+
+// renders every frame of the scene file's animation
+func renderAnimation(f *SceneFile, nx, ny, ns int) error {
+	first, last, err := f.frameRange(ANIMATION.Frames)
+	if err != nil {
+		return err
+	}
+	return renderFrames(nx, ny, ns, first, last, func(frame int) (*Scene, vec3.Vec3, vec3.Vec3, float64, error) {
+		g := f.AtFrame(frame)
+		scene, err := g.Build(nil)
+		lookFrom, lookAt, vfov := g.View()
+		CAMERA = g.viewSettings(f.Camera.CameraSettings, vfov)
+		return scene, lookFrom, lookAt, vfov, err
+	})
+}
+
+// renders a turn of the camera around lookAt, ending just before it is back at the start
+// so the movie loops smoothly
+func renderTurntable(nx, ny, ns int, world HitableList, lights []Light, background, lookFrom, lookAt vec3.Vec3, vfov float64) error {
+	first, last := 0, 35
+	if ANIMATION.Frames != "" {
+		var err error
+		if first, last, err = parseFrames(ANIMATION.Frames); err != nil {
+			return err
+		}
+	}
+	offset := vec3.Sub(lookFrom, lookAt)
+	return renderFrames(nx, ny, ns, first, last, func(frame int) (*Scene, vec3.Vec3, vec3.Vec3, float64, error) {
+		angle := 2 * math.Pi * float64(frame-first) / float64(last-first+1)
+		sin, cos := math.Sin(angle), math.Cos(angle)
+		from := vec3.Add(lookAt, vec3.New(cos*offset.X+sin*offset.Z, offset.Y, cos*offset.Z-sin*offset.X))
+		// every frame builds its own hierarchy
+		scene := &Scene{World: append(HitableList(nil), world...), Lights: lights, Background: background}
+		return scene, from, lookAt, vfov, nil
+	})
+}
+
+// renders the frames to numbered images, or collects them for the movie and writes it at the end
+func renderFrames(nx, ny, ns, first, last int, frameScene func(frame int) (*Scene, vec3.Vec3, vec3.Vec3, float64, error)) error {
+	if ANIMATION.Movie != "" {
+		ANIMATION.movie = []*image.RGBA{}
+	}
+	// the passes are named after OUTPUT, the heatmap gets the frame number too
+	heatmap := ADAPTIVE.Heatmap
+	defer func() { ADAPTIVE.Heatmap = heatmap }()
+	for frame := first; frame <= last; frame++ {
+		scene, lookFrom, lookAt, vfov, err := frameScene(frame)
+		if err != nil {
+			return fmt.Errorf("frame %d: %v", frame, err)
+		}
+		ANIMATION.Frame = frame
+		OUTPUT = fmt.Sprintf(ANIMATION.Output, frame)
+		if heatmap != "" {
+			ext := filepath.Ext(heatmap)
+			ADAPTIVE.Heatmap = fmt.Sprintf("%s_%04d%s", strings.TrimSuffix(heatmap, ext), frame, ext)
+		}
+		fmt.Printf("Frame %d of %d-%d\n", frame, first, last)
+		setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, scene)
+	}
+	if ANIMATION.Movie == "" {
+		return nil
+	}
+	fmt.Printf("Writing %d frames to %s\n", len(ANIMATION.movie), ANIMATION.Movie)
+	return saveMovie(ANIMATION.Movie, ANIMATION.movie, ANIMATION.FPS, ANIMATION.Dither)
+}
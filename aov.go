@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"./vec3"
+)
+
+// arbitrary output variables: auxiliary passes rendered alongside the image
+const (
+	aovDepth = iota
+	aovNormal
+	aovAlbedo
+	aovPosition
+	aovMotion
+	aovObject
+	aovMaterial
+	aovDiffuseDirect
+	aovDiffuseIndirect
+	aovSpecularDirect
+	aovSpecularIndirect
+	aovCount
+)
+
+var aovNames = [aovCount]string{
+	"depth", "normal", "albedo", "position", "motion", "object", "material",
+	"diffuse-direct", "diffuse-indirect", "specular-direct", "specular-indirect",
+}
+
+// EXR channels of each pass (its components X, Y, Z in order)
+var aovChannels = [aovCount][]string{
+	{"Z"}, {"X", "Y", "Z"}, {"R", "G", "B"}, {"X", "Y", "Z"}, {"X", "Y"}, {"id"}, {"id"},
+	{"R", "G", "B"}, {"R", "G", "B"}, {"R", "G", "B"}, {"R", "G", "B"},
+}
+
+// which passes are written and how
+type AOVSettings struct {
+	Enabled [aovCount]bool
+	Format  string // png (one image per pass) or exr (layers of output.exr)
+}
+
+var AOVS = AOVSettings{Format: "png"}
+
+func (s *AOVSettings) Any() bool {
+	for _, enabled := range s.Enabled {
+		if enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the film keeps the passes, also when only the denoiser needs them
+func renderAOVs() bool {
+	return AOVS.Any() || DENOISE.Enabled
+}
+
+// enables the passes in a comma separated list, `all` for every one
+func (s *AOVSettings) Parse(list string) error {
+	if s.Format != "png" && s.Format != "exr" {
+		return fmt.Errorf("unknown pass format `%s` (expected png or exr)", s.Format)
+	}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for k := range aovNames {
+			if name == "all" || name == aovNames[k] {
+				s.Enabled[k] = true
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown pass `%s` (expected %s or all)", name, strings.Join(aovNames[:], ", "))
+		}
+	}
+	return nil
+}
+
+// the passes of one sample, every one stored as a vector
+// (depth in X, IDs in X as exact integers)
+type AOVSample [aovCount]vec3.Vec3
+
+
+// top-level object of the scene, numbered from 1 so hits can be told apart in the ID pass
+type taggedObject struct {
+	Hitable
+	ID int
+}
+
+func (t taggedObject) Hit(ray Ray, tMin, tMax float64, record *HitRecord) bool {
+	if t.Hitable.Hit(ray, tMin, tMax, record) {
+		record.Object = t.ID
+		return true
+	}
+	return false
+}
+
+// numbers the objects of the world, has to happen before the BVH is built
+func tagObjects(scene *Scene) {
+	scene.Objects = append([]Hitable(nil), scene.World...)
+	for i, object := range scene.World {
+		scene.World[i] = taggedObject{object, i + 1}
+	}
+}
+
+// objects whose points move during the shutter interval
+type Mover interface {
+	// where point p of the object at time `from` is at time `to`
+	PositionAt(p vec3.Vec3, from, to float64) vec3.Vec3
+}
+
+
+// materials are numbered in the order they are first seen
+var materialIDs = struct {
+	sync.Mutex
+	ids map[Material]int
+}{ids: map[Material]int{}}
+
+func materialID(m Material) int {
+	if m == nil {
+		return 0
+	}
+	if e, ok := m.(EmissiveMedium); ok {
+		// the key has to be comparable, the emission does not change what the material is
+		m = e.HenyeyGreenstein
+	}
+	materialIDs.Lock()
+	defer materialIDs.Unlock()
+	id, ok := materialIDs.ids[m]
+	if !ok {
+		id = len(materialIDs.ids) + 1
+		materialIDs.ids[m] = id
+	}
+	return id
+}
+
+
+// albedo and normal of the first diffuse surface seen through perfect mirrors and
+// glass, so reflections keep their edges when these guide the denoiser
+func seenSurface(ray Ray, record HitRecord, scene *Scene) (vec3.Vec3, vec3.Vec3) {
+	tint := vec3.New(1.0, 1.0, 1.0)
+	for bounce := 0; bounce < 4; bounce++ {
+		direction := vec3.Norm(ray.Direction())
+		if m, ok := record.Material.(Metal); ok && m.Fuzz == 0 {
+			tint = vec3.Mul(tint, m.Albedo)
+			ray = Ray{record.P, reflect(direction, record.Normal), ray.Time}
+		} else if m, ok := record.Material.(Dielectric); ok {
+			// straight through where possible, the reflection is usually the fainter part
+			normal, niOverNt := record.Normal, 1/m.RefractiveIndex
+			if vec3.Dot(direction, record.Normal) > 0 {
+				normal, niOverNt = vec3.Scale(record.Normal, -1), m.RefractiveIndex
+			}
+			var refracted vec3.Vec3
+			if !refract(direction, normal, niOverNt, &refracted) {
+				refracted = reflect(direction, record.Normal)
+			}
+			ray = Ray{record.P, refracted, ray.Time}
+		} else {
+			break
+		}
+		record = HitRecord{}
+		if !intersect(ray, scene, &record) {
+			return vec3.Vec3{}, vec3.Vec3{}
+		}
+	}
+	return vec3.Mul(tint, materialAlbedo(record)), record.Normal
+}
+
+// renders a camera ray like pixel, also returning the passes at its first hit
+// (nx and ny are the film size, motion vectors are in pixels)
+// the light is split into its passes by path tracing only, other integrators leave them black
+func pixelAOV(ray Ray, scene *Scene, sampler Sampler, camera Camera, nx, ny int, splat func(u, v float64, c vec3.Vec3)) (vec3.Vec3, AOVSample) {
+	var aov AOVSample
+	var col, direct, indirect vec3.Vec3
+	_, pathTracing := scene.integrator().(PathTracer)
+	if !pathTracing {
+		// even when the camera ray misses, light may be traced to the camera
+		col = scene.integrator().Radiance(ray, scene, sampler, camera, splat)
+	}
+	record := HitRecord{}
+	if !intersect(ray, scene, &record) {
+		aov[aovDepth].X = math.Inf(1)
+		if pathTracing {
+			col = background(ray, scene, false)
+		}
+		return col, aov
+	}
+	if pathTracing {
+		var emitted vec3.Vec3
+		emitted, direct, indirect = shade(ray, record, scene, sampler, 0)
+		col = vec3.Add(emitted, vec3.Add(direct, indirect))
+	}
+
+	p := record.P
+	aov[aovDepth].X = record.T * vec3.Len(ray.Direction())
+	aov[aovAlbedo], aov[aovNormal] = seenSurface(ray, record, scene)
+	aov[aovPosition] = p
+	aov[aovObject].X = float64(record.Object)
+	aov[aovMaterial].X = float64(materialID(record.Material))
+	if diffuse(record.Material) {
+		aov[aovDiffuseDirect] = direct
+		aov[aovDiffuseIndirect] = indirect
+	} else {
+		aov[aovSpecularDirect] = direct
+		aov[aovSpecularIndirect] = indirect
+	}
+
+	// screen space movement of the hit point over the shutter interval
+	if projector, ok := camera.(Projector); ok && record.Object > 0 {
+		open, close := projector.Shutter()
+		from, to := p, p
+		if mover, ok := scene.Objects[record.Object-1].(Mover); ok {
+			from = mover.PositionAt(p, ray.Time, open)
+			to = mover.PositionAt(p, ray.Time, close)
+		}
+		u0, v0, ok0 := projector.Project(from)
+		u1, v1, ok1 := projector.Project(to)
+		if ok0 && ok1 {
+			aov[aovMotion] = vec3.New((u1-u0)*float64(nx), (v1-v0)*float64(ny), 0)
+		}
+	}
+	return col, aov
+}
+
+
+// passes are averaged over the samples inside each pixel rather than filtered,
+// the IDs are those of the pixel's first sample
+func (f *Film) EnableAOVs() {
+	f.aov = make([]AOVSample, f.Width*f.Height)
+	f.aovCount = make([]int, f.Width*f.Height)
+}
+
+func (ft *FilmTile) AddAOV(i, j int, aov AOVSample) {
+	k := ft.index(i, j)
+	if ft.aovCount[k] == 0 {
+		ft.aov[k] = aov
+	} else {
+		for n := range aov {
+			if n != aovObject && n != aovMaterial {
+				ft.aov[k][n] = vec3.Add(ft.aov[k][n], aov[n])
+			}
+		}
+	}
+	ft.aovCount[k]++
+}
+
+// merging a tile's pixel k into the film's pixel p (called with the film locked)
+func (f *Film) mergeAOV(ft *FilmTile, k, p int) {
+	if ft.aovCount[k] == 0 {
+		return
+	}
+	if f.aovCount[p] == 0 {
+		f.aov[p] = ft.aov[k]
+	} else {
+		for n := range f.aov[p] {
+			if n != aovObject && n != aovMaterial {
+				f.aov[p][n] = vec3.Add(f.aov[p][n], ft.aov[k][n])
+			}
+		}
+	}
+	f.aovCount[p] += ft.aovCount[k]
+}
+
+// average of pass n for every pixel, top row first
+func (f *Film) AOV(n int) []vec3.Vec3 {
+	values := make([]vec3.Vec3, f.Width*f.Height)
+	for p := range values {
+		if f.aovCount[p] == 0 {
+			continue
+		}
+		values[p] = f.aov[p][n]
+		if n != aovObject && n != aovMaterial {
+			values[p] = vec3.Scale(values[p], 1/float64(f.aovCount[p]))
+		}
+	}
+	return values
+}
+
+
+// writes the enabled passes, either as output_<pass>.png next to output.png or
+// together with the image as the layers of output.exr (named after OUTPUT)
+func saveAOVs(film *Film, exposure float64) error {
+	if film.aov == nil {
+		return nil
+	}
+	base := strings.TrimSuffix(OUTPUT, filepath.Ext(OUTPUT))
+	if AOVS.Format == "exr" {
+		return saveEXR(base+".exr", film, exposure)
+	}
+	for n, name := range aovNames {
+		if AOVS.Enabled[n] {
+			img := aovImage(n, film.AOV(n), film.Width, film.Height, exposure)
+			if err := savePNG(base+"_"+name+".png", img); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func saveEXR(filename string, film *Film, exposure float64) error {
+	nx, ny := film.Width, film.Height
+	var channels []EXRChannel
+	addChannels := func(layer string, names []string, values []vec3.Vec3, scale float64) {
+		for c, name := range names {
+			if layer != "" {
+				name = layer + "." + name
+			}
+			channel := EXRChannel{name, make([]float32, nx*ny)}
+			for p, v := range values {
+				channel.Values[p] = float32([3]float64{v.X, v.Y, v.Z}[c] * scale)
+			}
+			channels = append(channels, channel)
+		}
+	}
+	addChannels("", []string{"R", "G", "B"}, film.Buffer(), exposure)
+	for n, name := range aovNames {
+		if AOVS.Enabled[n] {
+			scale := 1.0
+			if n >= aovDiffuseDirect {
+				scale = exposure
+			}
+			addChannels(name, aovChannels[n], film.AOV(n), scale)
+		}
+	}
+	return writeEXR(filename, nx, ny, channels)
+}
+
+// a pass as an image people can look at
+func aovImage(n int, values []vec3.Vec3, nx, ny int, exposure float64) *image.RGBA {
+	switch n {
+	case aovDepth:
+		// near is bright, nothing hit is black
+		far := 0.0
+		for _, v := range values {
+			if !math.IsInf(v.X, 1) {
+				far = math.Max(far, v.X)
+			}
+		}
+		return mapImage(values, nx, ny, func(v vec3.Vec3) vec3.Vec3 {
+			if math.IsInf(v.X, 1) || far == 0 {
+				return vec3.Vec3{}
+			}
+			d := 1 - v.X/far
+			return vec3.New(d, d, d)
+		})
+	case aovNormal:
+		return mapImage(values, nx, ny, func(v vec3.Vec3) vec3.Vec3 {
+			if v == (vec3.Vec3{}) {
+				return v
+			}
+			return vec3.Scale(vec3.Add(vec3.Norm(v), vec3.New(1.0, 1.0, 1.0)), 0.5)
+		})
+	case aovAlbedo:
+		return toImage(values, nx, ny, 1)
+	case aovPosition:
+		// the bounds of what is visible map to the unit cube
+		lo := vec3.New(math.Inf(1), math.Inf(1), math.Inf(1))
+		hi := vec3.New(math.Inf(-1), math.Inf(-1), math.Inf(-1))
+		for _, v := range values {
+			lo = vec3.New(math.Min(lo.X, v.X), math.Min(lo.Y, v.Y), math.Min(lo.Z, v.Z))
+			hi = vec3.New(math.Max(hi.X, v.X), math.Max(hi.Y, v.Y), math.Max(hi.Z, v.Z))
+		}
+		size := vec3.Sub(hi, lo)
+		return mapImage(values, nx, ny, func(v vec3.Vec3) vec3.Vec3 {
+			d := vec3.Sub(v, lo)
+			return vec3.New(safeDiv(d.X, size.X), safeDiv(d.Y, size.Y), safeDiv(d.Z, size.Z))
+		})
+	case aovMotion:
+		// gray is still, red and green the horizontal and vertical movement
+		most := 0.0
+		for _, v := range values {
+			most = math.Max(most, math.Max(math.Abs(v.X), math.Abs(v.Y)))
+		}
+		return mapImage(values, nx, ny, func(v vec3.Vec3) vec3.Vec3 {
+			return vec3.New(0.5+safeDiv(v.X, 2*most), 0.5+safeDiv(v.Y, 2*most), 0.5)
+		})
+	case aovObject, aovMaterial:
+		return mapImage(values, nx, ny, idColor)
+	}
+	return toImage(values, nx, ny, exposure)
+}
+
+// applies f to every pixel, whose result is already in [0, 1]
+func mapImage(values []vec3.Vec3, nx, ny int, f func(vec3.Vec3) vec3.Vec3) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, nx, ny))
+	for p, v := range values {
+		c := f(v)
+		img.SetRGBA(p%nx, p/nx, color.RGBA{
+			uint8(255 * math.Max(0, math.Min(c.X, 1))),
+			uint8(255 * math.Max(0, math.Min(c.Y, 1))),
+			uint8(255 * math.Max(0, math.Min(c.Z, 1))),
+			255,
+		})
+	}
+	return img
+}
+
+// a distinct color for every ID, black for none
+func idColor(v vec3.Vec3) vec3.Vec3 {
+	if v.X == 0 {
+		return vec3.Vec3{}
+	}
+	x := hash(uint32(v.X))
+	return vec3.New(float64(x&0xff)/255, float64(x>>8&0xff)/255, float64(x>>16&0xff)/255)
+}
+
+func safeDiv(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+)
+
+// shape of a lens opening, out of focus highlights (bokeh) take on this shape
+type Aperture interface {
+	// point on the opening within the unit disk, for a point in [0, 1)^2
+	Sample(u, v float64) (float64, float64)
+}
+
+
+// regular polygon, like the diaphragm of a lens with straight blades
+type PolygonalAperture struct {
+	Blades   int
+	Rotation float64 // degrees
+}
+
+func (a PolygonalAperture) Sample(u, v float64) (float64, float64) {
+	if a.Blades < 3 {
+		return sampleDisk(u, v)
+	}
+	// the polygon is made of equal triangles around the center, u picks one and a point in it
+	step := 2 * math.Pi / float64(a.Blades)
+	k := minInt(int(u*float64(a.Blades)), a.Blades-1)
+	u = u*float64(a.Blades) - float64(k)
+	angle := a.Rotation*math.Pi/180 + float64(k)*step
+	r := math.Sqrt(u)
+	x := r * ((1-v)*math.Cos(angle) + v*math.Cos(angle+step))
+	y := r * ((1-v)*math.Sin(angle) + v*math.Sin(angle+step))
+	return x, y
+}
+
+
+// opening given by an image (white is open), for custom bokeh like stars or hearts
+// the image is stretched over the square around the unit disk
+type TexturedAperture struct {
+	Texture *ImageTexture
+	rows    *distribution1D
+	columns []*distribution1D
+}
+
+func NewTexturedAperture(texture *ImageTexture) *TexturedAperture {
+	a := &TexturedAperture{Texture: texture, columns: make([]*distribution1D, texture.Height)}
+	rowWeights := make([]float64, texture.Height)
+	for y := 0; y < texture.Height; y++ {
+		weights := make([]float64, texture.Width)
+		for x := 0; x < texture.Width; x++ {
+			weights[x] = luminance(texture.Pixels[y*texture.Width+x])
+		}
+		a.columns[y] = newDistribution1D(weights)
+		rowWeights[y] = a.columns[y].integral
+	}
+	a.rows = newDistribution1D(rowWeights)
+	return a
+}
+
+func loadTexturedAperture(filename string) (*TexturedAperture, error) {
+	texture, err := loadImageTexture(filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewTexturedAperture(texture), nil
+}
+
+func (a *TexturedAperture) Sample(u, v float64) (float64, float64) {
+	v, _, y := a.rows.sample(v)
+	u, _, _ = a.columns[y].sample(u)
+	// images are stored top to bottom
+	return 2*u - 1, 1 - 2*v
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"math"
+
+	"./vec3"
+)
+
+// bidirectional path tracing: a path from the camera and one from a light are connected at
+// every pair of their vertices, each connection weighted (balance heuristic) by how likely
+// every other way of building the same path would have been
+// light paths start at the lights at a point, reaching the camera through them splats the
+// light onto the film (pinhole cameras only), directional lights and the environment are
+// sampled from the camera path like the path tracer does
+// the path tracer's clamping of the lights (and their highlights on metal) is not reproduced,
+// lights at a point give off pi times their intensity (what a surface facing them at unit
+// distance reflects before its albedo) and still fade linearly with the distance
+type BidirectionalPathTracer struct {
+	depth       int
+	emitters    []*photonEmitter // lights at a point
+	directional []Light
+}
+
+func newBidirectionalPathTracer(scene *Scene, depth int) *BidirectionalPathTracer {
+	b := &BidirectionalPathTracer{depth: depth}
+	for _, light := range scene.Lights {
+		emitter := newPhotonEmitter(light, scene, vec3.Vec3{}, 0)
+		if emitter.positioned {
+			b.emitters = append(b.emitters, emitter)
+		} else {
+			b.directional = append(b.directional, light)
+		}
+	}
+	return b
+}
+
+// light subpaths take their random numbers after those the camera subpath can use
+func (b *BidirectionalPathTracer) lightDimension(depth int) int {
+	return scatterDimension(b.depth+2) + 4*depth
+}
+
+func (b *BidirectionalPathTracer) Radiance(ray Ray, scene *Scene, sampler Sampler, camera Camera, splat func(u, v float64, c vec3.Vec3)) vec3.Vec3 {
+	importance, pinhole := newCameraImportance(camera)
+	start := bdptVertex{kind: bdptCamera, p: ray.Origin(), beta: vec3.New(1.0, 1.0, 1.0), delta: !pinhole}
+	direction := vec3.Norm(ray.Direction())
+	pdf := 1.0
+	if pinhole {
+		start.camera = &importance
+		pdf = importance.pdf(direction)
+	}
+	cameraPath, L := b.walk([]bdptVertex{start}, Ray{ray.Origin(), direction, ray.Time}, start.beta, pdf, b.depth+2, scene, sampler, true)
+	lightPath := b.lightPath(ray.Time, scene, sampler)
+
+	for t := 1; t <= len(cameraPath); t++ {
+		// s = 1: every light seen from the camera vertex
+		if t >= 2 && t-1 <= b.depth && !cameraPath[t-1].delta {
+			for _, emitter := range b.emitters {
+				L = vec3.Add(L, b.connectLight(cameraPath, t, emitter, scene, ray.Time))
+			}
+		}
+		for s := 2; s <= len(lightPath) && s+t-2 <= b.depth; s++ {
+			if t == 1 {
+				if pinhole {
+					b.connectCamera(lightPath, cameraPath, s, scene, ray.Time, splat)
+				}
+				continue
+			}
+			L = vec3.Add(L, b.connect(lightPath, cameraPath, s, t, scene, ray.Time))
+		}
+	}
+	return L
+}
+
+
+// path vertices: the camera, a light, a surface or a scattering event in a medium
+const (
+	bdptCamera = iota
+	bdptLight
+	bdptSurface
+	bdptMedium
+)
+
+type bdptVertex struct {
+	kind    int
+	p, n    vec3.Vec3 // the normal of surfaces
+	record  HitRecord
+	beta    vec3.Vec3 // throughput of the subpath up to here, divided by its density
+	delta   bool      // mirrors and glass (and cameras other than pinholes) cannot be connected to
+	pdfFwd  float64   // area density of sampling this vertex from the previous one
+	pdfRev  float64   // from the next one, as if the path had been built the other way
+	camera  *cameraImportance
+	emitter *photonEmitter
+}
+
+// converts the density of the direction towards next into the density of its area
+func (v *bdptVertex) convert(pdf float64, next *bdptVertex) float64 {
+	d := vec3.Sub(next.p, v.p)
+	d2 := vec3.LenSq(d)
+	if d2 == 0 {
+		return 0
+	}
+	if next.kind == bdptSurface {
+		pdf *= math.Abs(vec3.Dot(next.n, d)) / math.Sqrt(d2)
+	}
+	return pdf / d2
+}
+
+// cosine of the angle between the direction and the surface, light enters media from anywhere
+func (v *bdptVertex) cosine(direction vec3.Vec3) float64 {
+	if v.kind == bdptSurface {
+		return math.Abs(vec3.Dot(v.n, direction))
+	}
+	return 1
+}
+
+// light scattered at the vertex from (or towards) prev to next, like a BRDF
+func (v *bdptVertex) f(prev, next *bdptVertex) vec3.Vec3 {
+	if v.delta {
+		return vec3.Vec3{}
+	}
+	wi := vec3.Norm(vec3.Sub(prev.p, v.p))
+	wo := vec3.Norm(vec3.Sub(next.p, v.p))
+	switch v.kind {
+	case bdptSurface:
+		if vec3.Dot(wi, v.n)*vec3.Dot(wo, v.n) <= 0 {
+			return vec3.Vec3{}
+		}
+		return vec3.Scale(materialAlbedo(v.record), 1/math.Pi)
+	case bdptMedium:
+		phase := v.record.Material.(PhaseFunction).Phase(-vec3.Dot(wi, wo))
+		return vec3.Scale(materialAlbedo(v.record), phase)
+	}
+	return vec3.Vec3{}
+}
+
+// area density of the vertex sampling next (coming from prev, unless it starts the path)
+func (v *bdptVertex) pdf(prev, next *bdptVertex) float64 {
+	wo := vec3.Norm(vec3.Sub(next.p, v.p))
+	var pdf float64
+	switch v.kind {
+	case bdptCamera:
+		if v.camera == nil {
+			return 0
+		}
+		pdf = v.camera.pdf(wo)
+	case bdptLight:
+		pdf = emissionPdf(v.emitter, wo)
+	case bdptSurface:
+		if v.delta {
+			return 0
+		}
+		wi := vec3.Norm(vec3.Sub(prev.p, v.p))
+		if vec3.Dot(wi, v.n)*vec3.Dot(wo, v.n) <= 0 {
+			return 0
+		}
+		pdf = math.Abs(vec3.Dot(wo, v.n)) / math.Pi
+	case bdptMedium:
+		wi := vec3.Norm(vec3.Sub(v.p, prev.p))
+		pdf = v.record.Material.(PhaseFunction).Phase(vec3.Dot(wi, wo))
+	}
+	return v.convert(pdf, next)
+}
+
+// density of the direction a light at a point emits in
+func emissionPdf(e *photonEmitter, direction vec3.Vec3) float64 {
+	if e.cone != -1 && vec3.Dot(direction, e.direction) < e.cone {
+		return 0
+	}
+	return 1 / (2 * math.Pi * (1 - e.cone))
+}
+
+
+// extends the subpath along the ray until it has n vertices, the camera's also gathers the
+// light it sees leaving the scene or given off by media, and from directional lights and the
+// environment at every vertex
+func (b *BidirectionalPathTracer) walk(path []bdptVertex, ray Ray, beta vec3.Vec3, pdf float64, n int, scene *Scene, sampler Sampler, fromCamera bool) ([]bdptVertex, vec3.Vec3) {
+	var L vec3.Vec3
+	skipEnvironment := false
+	for len(path) < n {
+		record := HitRecord{}
+		if !intersect(ray, scene, &record) {
+			if fromCamera {
+				L = vec3.Add(L, vec3.Mul(beta, background(ray, scene, skipEnvironment)))
+			}
+			break
+		}
+		prev := &path[len(path)-1]
+		v := bdptVertex{kind: bdptSurface, p: record.P, n: record.Normal, record: record}
+		phase, inMedium := record.Material.(PhaseFunction)
+		if inMedium {
+			v.kind, v.n = bdptMedium, vec3.Vec3{}
+		}
+		if emitter, ok := record.Material.(Emitter); ok && fromCamera {
+			L = vec3.Add(L, vec3.Mul(beta, emitter.Emitted(record)))
+		}
+		if !fromCamera && len(path) == 1 {
+			// lights at a point fade linearly
+			beta = vec3.Scale(beta, vec3.Len(vec3.Sub(v.p, prev.p)))
+		}
+		v.beta = beta
+		v.pdfFwd = prev.convert(pdf, &v)
+		v.delta = !diffuse(record.Material)
+		if fromCamera && !v.delta {
+			sampler.SetDimension(lightDimension(len(path) - 1))
+			L = vec3.Add(L, vec3.Mul(beta, b.directLight(ray, &v, prev, scene, sampler)))
+			skipEnvironment = scene.Environment != nil
+		} else {
+			skipEnvironment = false
+		}
+		path = append(path, v)
+		if len(path) == n {
+			break
+		}
+
+		depth := len(path) - 2
+		if fromCamera {
+			sampler.SetDimension(scatterDimension(depth))
+		} else {
+			sampler.SetDimension(b.lightDimension(depth + 1))
+		}
+		vertex := &path[len(path)-1]
+		wi := vec3.Scale(ray.Direction(), -1)
+		var pdfRev float64
+		rayOut := Ray{Time: ray.Time}
+		switch {
+		case vertex.kind == bdptSurface && !vertex.delta:
+			// cosine weighted on the side the path arrived from
+			normal := vertex.n
+			if vec3.Dot(normal, wi) < 0 {
+				normal = vec3.Scale(normal, -1)
+			}
+			direction := vec3.Norm(vec3.Add(normal, sampleSphere(sampler.Get2D())))
+			pdf = vec3.Dot(direction, normal) / math.Pi
+			if pdf <= 0 {
+				return path, L
+			}
+			pdfRev = vec3.Dot(wi, normal) / math.Pi
+			beta = vec3.Mul(beta, materialAlbedo(record))
+			rayOut.A, rayOut.B = record.P, direction
+		default:
+			attenuation := vec3.New(0.0, 0.0, 0.0)
+			if !record.Material.Scatter(ray, record, &attenuation, &rayOut, sampler) {
+				return path, L
+			}
+			rayOut.B = vec3.Norm(rayOut.B)
+			beta = vec3.Mul(beta, attenuation)
+			pdf, pdfRev = 0, 0
+			if inMedium {
+				// the phase function is sampled exactly
+				pdf = phase.Phase(vec3.Dot(vec3.Norm(ray.Direction()), rayOut.B))
+				pdfRev = pdf
+			}
+		}
+		if beta == (vec3.Vec3{}) {
+			return path, L
+		}
+		prev = &path[len(path)-2]
+		prev.pdfRev = vertex.convert(pdfRev, prev)
+		ray = rayOut
+	}
+	return path, L
+}
+
+// light from the directional lights and the environment arriving at a camera vertex and
+// scattered back along the ray
+func (b *BidirectionalPathTracer) directLight(ray Ray, v, prev *bdptVertex, scene *Scene, sampler Sampler) vec3.Vec3 {
+	// light arriving from the direction, divided by its density
+	arriving := func(direction vec3.Vec3, distance float64, radiance vec3.Vec3) vec3.Vec3 {
+		towards := bdptVertex{p: vec3.Add(v.p, direction)}
+		f := v.f(prev, &towards)
+		if f == (vec3.Vec3{}) {
+			return f
+		}
+		d := v.cosine(direction) * visibility(scene, v.p, direction, distance, ray.Time)
+		return vec3.Scale(vec3.Mul(f, radiance), d)
+	}
+	var L vec3.Vec3
+	for _, light := range b.directional {
+		direction, distance, intensity := light.Illuminate(v.p)
+		L = vec3.Add(L, arriving(direction, distance, vec3.Scale(intensity, math.Pi)))
+	}
+	if scene.Environment != nil {
+		direction, radiance, pdf := scene.Environment.Sample(sampler.Get2D())
+		if pdf > 0 {
+			L = vec3.Add(L, arriving(direction, MAXFLOAT, vec3.Scale(radiance, 1/pdf)))
+		}
+	}
+	return L
+}
+
+
+// a path from one of the lights at a point, chosen at random
+func (b *BidirectionalPathTracer) lightPath(time float64, scene *Scene, sampler Sampler) []bdptVertex {
+	if len(b.emitters) == 0 {
+		return nil
+	}
+	sampler.SetDimension(b.lightDimension(0))
+	n := len(b.emitters)
+	e := b.emitters[minInt(int(sampler.Get1D()*float64(n)), n-1)]
+	var direction vec3.Vec3
+	if e.cone == -1 {
+		direction = sampleSphere(sampler.Get2D())
+	} else {
+		direction = sampleCone(e.direction, e.cone, sampler)
+	}
+	pdf := emissionPdf(e, direction)
+	start := bdptVertex{kind: bdptLight, p: e.position, beta: vec3.New(1.0, 1.0, 1.0), emitter: e}
+	intensity := vec3.Scale(e.intensity(direction), math.Pi)
+	if pdf == 0 || intensity == (vec3.Vec3{}) {
+		return []bdptVertex{start}
+	}
+	beta := vec3.Scale(intensity, float64(n)/pdf)
+	path, _ := b.walk([]bdptVertex{start}, Ray{e.position, direction, time}, beta, pdf, b.depth+1, scene, sampler, false)
+	return path
+}
+
+
+// s = 1: the light arriving at camera vertex t-1 straight from a light
+func (b *BidirectionalPathTracer) connectLight(cameraPath []bdptVertex, t int, e *photonEmitter, scene *Scene, time float64) vec3.Vec3 {
+	pt := &cameraPath[t-1]
+	direction, distance, intensity := e.light.Illuminate(pt.p)
+	if intensity == (vec3.Vec3{}) {
+		return intensity
+	}
+	light := bdptVertex{kind: bdptLight, p: e.position, emitter: e}
+	f := pt.f(&cameraPath[t-2], &light)
+	if f == (vec3.Vec3{}) {
+		return f
+	}
+	d := pt.cosine(direction) * visibility(scene, pt.p, direction, distance-0.001, time)
+	if d == 0 {
+		return vec3.Vec3{}
+	}
+	L := vec3.Scale(vec3.Mul(vec3.Mul(pt.beta, f), intensity), math.Pi*d)
+	return vec3.Scale(L, misWeight(nil, cameraPath, &light, pt, 1, t))
+}
+
+// t = 1: the light of light vertex s-1 reaching a pinhole camera, splatted where it lands
+func (b *BidirectionalPathTracer) connectCamera(lightPath, cameraPath []bdptVertex, s int, scene *Scene, time float64, splat func(u, v float64, c vec3.Vec3)) {
+	qs, camera := &lightPath[s-1], &cameraPath[0]
+	if qs.delta {
+		return
+	}
+	u, v, ok := camera.camera.camera.Project(qs.p)
+	if !ok || u < 0 || u >= 1 || v < 0 || v >= 1 {
+		return
+	}
+	f := qs.f(&lightPath[s-2], camera)
+	if f == (vec3.Vec3{}) {
+		return
+	}
+	to := vec3.Sub(camera.p, qs.p)
+	distance := vec3.Len(to)
+	direction := vec3.Scale(to, 1/distance)
+	// importance of the camera, over the area at the camera's end, the pdf of its rays
+	// happens to be the same
+	d := qs.cosine(direction) * camera.camera.pdf(vec3.Scale(direction, -1)) / (distance * distance)
+	if d == 0 {
+		return
+	}
+	d *= visibility(scene, qs.p, direction, distance-0.001, time)
+	if d == 0 {
+		return
+	}
+	L := vec3.Scale(vec3.Mul(qs.beta, f), d)
+	splat(u, v, vec3.Scale(L, misWeight(lightPath, cameraPath, qs, camera, s, 1)))
+}
+
+// s, t >= 2: light vertex s-1 connected to camera vertex t-1
+func (b *BidirectionalPathTracer) connect(lightPath, cameraPath []bdptVertex, s, t int, scene *Scene, time float64) vec3.Vec3 {
+	qs, pt := &lightPath[s-1], &cameraPath[t-1]
+	if qs.delta || pt.delta {
+		return vec3.Vec3{}
+	}
+	f := vec3.Mul(qs.f(&lightPath[s-2], pt), pt.f(&cameraPath[t-2], qs))
+	if f == (vec3.Vec3{}) {
+		return f
+	}
+	to := vec3.Sub(pt.p, qs.p)
+	distance := vec3.Len(to)
+	if distance == 0 {
+		return vec3.Vec3{}
+	}
+	direction := vec3.Scale(to, 1/distance)
+	g := qs.cosine(direction) * pt.cosine(direction) / (distance * distance)
+	g *= visibility(scene, qs.p, direction, distance-0.001, time)
+	if g == 0 {
+		return vec3.Vec3{}
+	}
+	L := vec3.Scale(vec3.Mul(vec3.Mul(qs.beta, f), pt.beta), g)
+	return vec3.Scale(L, misWeight(lightPath, cameraPath, qs, pt, s, t))
+}
+
+// balance heuristic weight of the connection of qs (light vertex s-1) and pt (camera vertex
+// t-1): every other s and t that build the same path, relative to this one, from the
+// densities of sampling its vertices from either side
+func misWeight(lightPath, cameraPath []bdptVertex, qs, pt *bdptVertex, s, t int) float64 {
+	if s+t == 2 {
+		return 1
+	}
+	light := func(i int) *bdptVertex {
+		if i == s-1 {
+			return qs
+		}
+		return &lightPath[i]
+	}
+	var qsMinus, ptMinus *bdptVertex
+	if s > 1 {
+		qsMinus = light(s - 2)
+	}
+	if t > 1 {
+		ptMinus = &cameraPath[t-2]
+	}
+	// the reverse densities around the connection change with it
+	ptRev, qsRev := qs.pdf(qsMinus, pt), pt.pdf(ptMinus, qs)
+	var ptMinusRev, qsMinusRev float64
+	if ptMinus != nil {
+		ptMinusRev = pt.pdf(qs, ptMinus)
+	}
+	if qsMinus != nil {
+		qsMinusRev = qs.pdf(pt, qsMinus)
+	}
+	remap := func(pdf float64) float64 {
+		if pdf == 0 {
+			// delta distributions cancel out
+			return 1
+		}
+		return pdf
+	}
+
+	sum, r := 0.0, 1.0
+	for i := t - 1; i > 0; i-- {
+		rev := cameraPath[i].pdfRev
+		if i == t-1 {
+			rev = ptRev
+		} else if i == t-2 {
+			rev = ptMinusRev
+		}
+		r *= remap(rev) / remap(cameraPath[i].pdfFwd)
+		// vertices being connected need to be connectible (the connection itself always is)
+		if (i == t-1 || !cameraPath[i].delta) && !cameraPath[i-1].delta {
+			sum += r
+		}
+	}
+	r = 1.0
+	for i := s - 1; i >= 0; i-- {
+		rev := light(i).pdfRev
+		if i == s-1 {
+			rev = qsRev
+		} else if i == s-2 {
+			rev = qsMinusRev
+		}
+		r *= remap(rev) / remap(light(i).pdfFwd)
+		// lights at a point cannot be hit
+		if i > 0 && (i == s-1 || !light(i).delta) && !light(i-1).delta {
+			sum += r
+		}
+	}
+	return 1 / (1 + sum)
+}
+
+
+// how a pinhole camera sees: its rays leave through the image plane (at unit distance,
+// with the given area there) with the density 1/(area cos^3), which is also the camera's
+// importance over the area at its other end
+type cameraImportance struct {
+	camera  PinholeCamera
+	forward vec3.Vec3
+	area    float64
+}
+
+func newCameraImportance(camera Camera) (cameraImportance, bool) {
+	c, ok := camera.(PinholeCamera)
+	if !ok {
+		return cameraImportance{}, false
+	}
+	back := vec3.Norm(vec3.Cross(c.Horizontal, c.Vertical))
+	distance := -vec3.Dot(vec3.Sub(c.LowerLeftCorner, c.Origin), back)
+	area := vec3.Len(c.Horizontal) * vec3.Len(c.Vertical) / (distance * distance)
+	return cameraImportance{c, vec3.Scale(back, -1), area}, true
+}
+
+func (c *cameraImportance) pdf(direction vec3.Vec3) float64 {
+	cosine := vec3.Dot(direction, c.forward)
+	if cosine <= 0 {
+		return 0
+	}
+	u, v, ok := c.camera.Project(vec3.Add(c.camera.Origin, direction))
+	if !ok || u < 0 || u > 1 || v < 0 || v > 1 {
+		return 0
+	}
+	return 1 / (c.area * cosine * cosine * cosine)
+}
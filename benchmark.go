@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"./vec3"
+)
+
+// root mean square error of the samplers against a reference rendered with many more samples,
+// for 1, 2, 4, ... up to ns samples per pixel
+func benchmarkSamplers(nx, ny, ns int, camera Camera, scene *Scene) {
+	start := time.Now()
+	reference, _ := render(nx, ny, 16*ns, camera, scene, "independent", 1000)
+	fmt.Printf("reference: %d samples per pixel in %v\n", 16*ns, time.Since(start))
+
+	fmt.Printf("%-8s", "samples")
+	for _, kind := range samplerKinds {
+		fmt.Printf(" %12s", kind)
+	}
+	fmt.Println()
+	for n := 1; n <= ns; n *= 2 {
+		fmt.Printf("%-8d", n)
+		for _, kind := range samplerKinds {
+			image, _ := render(nx, ny, n, camera, scene, kind, int64(n))
+			fmt.Printf(" %12.6f", rmse(image, reference))
+		}
+		fmt.Println()
+	}
+}
+
+func rmse(image, reference []vec3.Vec3) float64 {
+	sum := 0.0
+	for i := range image {
+		d := vec3.Sub(image[i], reference[i])
+		sum += vec3.Dot(d, d) / 3
+	}
+	return math.Sqrt(sum / float64(len(image)))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"./vec3"
+)
+
+// axis-aligned bounding box
+type AABB struct {
+	Min, Max vec3.Vec3
+}
+
+// clips the ray against an axis-aligned box, per slab
+func clipSlab(origin, direction, lo, hi float64, t0, t1 *float64) bool {
+	if math.Abs(direction) < 1e-12 {
+		return lo <= origin && origin <= hi
+	}
+	ta := (lo - origin) / direction
+	tb := (hi - origin) / direction
+	if ta > tb {
+		ta, tb = tb, ta
+	}
+	*t0 = math.Max(*t0, ta)
+	*t1 = math.Min(*t1, tb)
+	return *t0 <= *t1
+}
+
+func (box AABB) Hit(ray Ray, tMin, tMax float64) bool {
+	o, d := ray.Origin(), ray.Direction()
+	return clipSlab(o.X, d.X, box.Min.X, box.Max.X, &tMin, &tMax) &&
+		clipSlab(o.Y, d.Y, box.Min.Y, box.Max.Y, &tMin, &tMax) &&
+		clipSlab(o.Z, d.Z, box.Min.Z, box.Max.Z, &tMin, &tMax)
+}
+
+func (box AABB) Center() vec3.Vec3 {
+	return vec3.Scale(vec3.Add(box.Min, box.Max), 0.5)
+}
+
+func surroundingBox(a, b AABB) AABB {
+	return AABB{
+		vec3.New(math.Min(a.Min.X, b.Min.X), math.Min(a.Min.Y, b.Min.Y), math.Min(a.Min.Z, b.Min.Z)),
+		vec3.New(math.Max(a.Max.X, b.Max.X), math.Max(a.Max.Y, b.Max.Y), math.Max(a.Max.Z, b.Max.Z)),
+	}
+}
+
+func axis(v vec3.Vec3, i int) float64 {
+	switch i {
+	case 0:
+		return v.X
+	case 1:
+		return v.Y
+	}
+	return v.Z
+}
+
+
+// bounding volume hierarchy
+type BVHNode struct {
+	Left, Right Hitable
+	Box         AABB
+}
+
+// builds a hierarchy over all bounded objects, the ones without a bounding box
+// (e.g. infinite planes) are returned next to the root node
+// t0 and t1 is the time interval in which the hierarchy will be queried
+func buildBVH(list HitableList, t0, t1 float64) HitableList {
+	var bounded []Hitable
+	var boxes []AABB
+	var result HitableList
+	for _, hitable := range list {
+		var box AABB
+		if hitable.BoundingBox(t0, t1, &box) {
+			bounded = append(bounded, hitable)
+			boxes = append(boxes, box)
+		} else {
+			result = append(result, hitable)
+		}
+	}
+	if len(bounded) > 0 {
+		result = append(result, newBVHNode(bounded, boxes))
+	}
+	return result
+}
+
+func newBVHNode(list []Hitable, boxes []AABB) Hitable {
+	if len(list) == 1 {
+		return list[0]
+	}
+
+	// split at the median along the axis in which the centers are spread the most
+	lo := boxes[0].Center()
+	hi := lo
+	for _, box := range boxes[1:] {
+		c := box.Center()
+		lo = vec3.New(math.Min(lo.X, c.X), math.Min(lo.Y, c.Y), math.Min(lo.Z, c.Z))
+		hi = vec3.New(math.Max(hi.X, c.X), math.Max(hi.Y, c.Y), math.Max(hi.Z, c.Z))
+	}
+	extent := vec3.Sub(hi, lo)
+	a := 0
+	if extent.Y > extent.X {
+		a = 1
+	}
+	if extent.Z > axis(extent, a) {
+		a = 2
+	}
+	sort.Sort(byCenter{list, boxes, a})
+
+	mid := len(list) / 2
+	left := newBVHNode(list[:mid], boxes[:mid])
+	right := newBVHNode(list[mid:], boxes[mid:])
+
+	box := boxes[0]
+	for _, b := range boxes[1:] {
+		box = surroundingBox(box, b)
+	}
+	return &BVHNode{left, right, box}
+}
+
+type byCenter struct {
+	list  []Hitable
+	boxes []AABB
+	axis  int
+}
+
+func (s byCenter) Len() int {
+	return len(s.list)
+}
+
+func (s byCenter) Less(i, j int) bool {
+	return axis(s.boxes[i].Center(), s.axis) < axis(s.boxes[j].Center(), s.axis)
+}
+
+func (s byCenter) Swap(i, j int) {
+	s.list[i], s.list[j] = s.list[j], s.list[i]
+	s.boxes[i], s.boxes[j] = s.boxes[j], s.boxes[i]
+}
+
+func (n *BVHNode) Hit(ray Ray, tMin, tMax float64, record *HitRecord) bool {
+	if !n.Box.Hit(ray, tMin, tMax) {
+		return false
+	}
+	hitLeft := n.Left.Hit(ray, tMin, tMax, record)
+	if hitLeft {
+		tMax = record.T
+	}
+	hitRight := n.Right.Hit(ray, tMin, tMax, record)
+	return hitLeft || hitRight
+}
+
+func (n *BVHNode) BoundingBox(t0, t1 float64, box *AABB) bool {
+	*box = n.Box
+	return true
+}
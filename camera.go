@@ -2,7 +2,6 @@ package main
 
 import (
 	"math"
-	"math/rand"
 
     "./vec3"
 )
@@ -11,17 +10,17 @@ type Camera interface {
 	GetRay(u, v float64) Ray
 }
 
-func randomInUnitDisk() vec3.Vec3 {
-	p := vec3.New(0.0, 0.0, 0.0)
-	for {
-		p.X = rand.Float64()*2 - 1
-		p.Y = rand.Float64()*2 - 1
-		p.Z = 0
-		if vec3.LenSq(p) < 1.0 {
-			break
-		}
-	}
-	return p
+// cameras with a lens, the point (lensU, lensV) in [0, 1)^2 picks where the ray passes through it
+type ApertureCamera interface {
+	Camera
+	GetLensRay(u, v, lensU, lensV float64) Ray
+}
+
+// cameras whose shutter stays open for a while: their rays leave when it opens, the
+// raytracer moves them to a moment in [open, close) from a sampler dimension
+type ShutterCamera interface {
+	Camera
+	Shutter() (float64, float64)
 }
 
 
@@ -31,6 +30,7 @@ type PinholeCamera struct {
     Horizontal vec3.Vec3
     Vertical vec3.Vec3
     Origin vec3.Vec3
+    ShutterOpen, ShutterClose float64
 }
 
 /*
@@ -75,7 +75,7 @@ func (c PinholeCamera) GetRay(u, v float64) Ray {
 	direction = vec3.Add(direction, dx)
 	direction = vec3.Add(direction, dy)
 	direction = vec3.Sub(direction, c.Origin)
-	return Ray{c.Origin, direction}
+	return Ray{c.Origin, direction, c.ShutterOpen}
 }
 
 
@@ -87,6 +87,7 @@ type LensCamera struct {
 	Origin vec3.Vec3
 	U, V, W vec3.Vec3
 	LensRadius float64
+	ShutterOpen, ShutterClose float64
 }
 
 func NewLensCamera(lookFrom, lookAt, vup vec3.Vec3, vfov, aspect, aperture, focusDist float64) LensCamera {
@@ -116,8 +117,13 @@ func NewLensCamera(lookFrom, lookAt, vup vec3.Vec3, vfov, aspect, aperture, focu
 }
 
 func (c LensCamera) GetRay(s, t float64) Ray {
-	rd := vec3.Scale(randomInUnitDisk(), c.LensRadius)
-	offset := vec3.Add(vec3.Scale(c.U, rd.X), vec3.Scale(c.V, rd.Y))
+	// through the center of the lens, the raytracer samples the lens itself
+	return c.GetLensRay(s, t, 0.5, 0.5)
+}
+
+func (c LensCamera) GetLensRay(s, t, lensU, lensV float64) Ray {
+	x, y := sampleDisk(lensU, lensV)
+	offset := vec3.Add(vec3.Scale(c.U, x*c.LensRadius), vec3.Scale(c.V, y*c.LensRadius))
 
 	dx := vec3.Scale(c.Horizontal, s)
 	dy := vec3.Scale(c.Vertical, t)
@@ -125,5 +131,319 @@ func (c LensCamera) GetRay(s, t float64) Ray {
 	direction = vec3.Add(direction, dx)
 	direction = vec3.Add(direction, dy)
 	direction = vec3.Sub(direction, c.Origin)
-	return Ray{vec3.Add(c.Origin, offset), vec3.Sub(direction, offset)}
+	return Ray{vec3.Add(c.Origin, offset), vec3.Sub(direction, offset), c.ShutterOpen}
+}
+
+
+// orthographic camera (parallel rays, no perspective), height is the size of the view in world units
+type OrthographicCamera struct {
+	LowerLeftCorner vec3.Vec3
+	Horizontal vec3.Vec3
+	Vertical vec3.Vec3
+	Direction vec3.Vec3
+	ShutterOpen, ShutterClose float64
+}
+
+func NewOrthographicCamera(lookFrom, lookAt, vup vec3.Vec3, height, aspect float64) OrthographicCamera {
+	w := vec3.Norm(vec3.Sub(lookFrom, lookAt))
+	u := vec3.Norm(vec3.Cross(vup, w))
+	v := vec3.Cross(w, u)
+
+	llc := lookFrom
+	llc = vec3.Sub(llc, vec3.Scale(u, height*aspect/2))
+	llc = vec3.Sub(llc, vec3.Scale(v, height/2))
+
+	return OrthographicCamera{
+		LowerLeftCorner: llc,
+		Horizontal: vec3.Scale(u, height*aspect),
+		Vertical: vec3.Scale(v, height),
+		Direction: vec3.Scale(w, -1),
+	}
+}
+
+func (c OrthographicCamera) GetRay(u, v float64) Ray {
+	origin := c.LowerLeftCorner
+	origin = vec3.Add(origin, vec3.Scale(c.Horizontal, u))
+	origin = vec3.Add(origin, vec3.Scale(c.Vertical, v))
+	return Ray{origin, c.Direction, c.ShutterOpen}
+}
+
+
+// equidistant fisheye camera, the angle from the view direction grows linearly
+// with the distance from the image center; fov spans the smaller image side
+// (a circular image), outside of fov there is no ray
+type FisheyeCamera struct {
+	Origin vec3.Vec3
+	U, V, W vec3.Vec3
+	FOV float64  // radians
+	Aspect float64
+	ShutterOpen, ShutterClose float64
+}
+
+func NewFisheyeCamera(lookFrom, lookAt, vup vec3.Vec3, fov, aspect float64) FisheyeCamera {
+	w := vec3.Norm(vec3.Sub(lookFrom, lookAt))
+	u := vec3.Norm(vec3.Cross(vup, w))
+	v := vec3.Cross(w, u)
+	return FisheyeCamera{
+		Origin: lookFrom,
+		U: u,
+		V: v,
+		W: w,
+		FOV: fov * math.Pi / 180,
+		Aspect: aspect,
+	}
+}
+
+func (c FisheyeCamera) GetRay(u, v float64) Ray {
+	x := 2*u - 1
+	y := 2*v - 1
+	if c.Aspect > 1 {
+		x *= c.Aspect
+	} else {
+		y /= c.Aspect
+	}
+	r := math.Sqrt(x*x + y*y)
+	theta := r * c.FOV / 2
+	if r > 1 || theta > math.Pi {
+		return Ray{c.Origin, vec3.Vec3{}, 0}
+	}
+	phi := math.Atan2(y, x)
+	direction := vec3.Scale(c.W, -math.Cos(theta))
+	direction = vec3.Add(direction, vec3.Scale(c.U, math.Sin(theta)*math.Cos(phi)))
+	direction = vec3.Add(direction, vec3.Scale(c.V, math.Sin(theta)*math.Sin(phi)))
+	return Ray{c.Origin, direction, c.ShutterOpen}
+}
+
+
+// full 360 by 180 degree panorama (latitude-longitude), the image center looks at lookAt
+type EquirectangularCamera struct {
+	Origin vec3.Vec3
+	U, V, W vec3.Vec3
+	ShutterOpen, ShutterClose float64
+}
+
+func NewEquirectangularCamera(lookFrom, lookAt, vup vec3.Vec3) EquirectangularCamera {
+	w := vec3.Norm(vec3.Sub(lookFrom, lookAt))
+	u := vec3.Norm(vec3.Cross(vup, w))
+	v := vec3.Cross(w, u)
+	return EquirectangularCamera{Origin: lookFrom, U: u, V: v, W: w}
+}
+
+// direction for a point of the panorama, relative to the camera's orientation
+func panoramaDirection(u, v, w vec3.Vec3, s, t float64) vec3.Vec3 {
+	phi := (s - 0.5) * 2 * math.Pi
+	theta := (1 - t) * math.Pi
+	direction := vec3.Scale(w, -math.Sin(theta)*math.Cos(phi))
+	direction = vec3.Add(direction, vec3.Scale(u, math.Sin(theta)*math.Sin(phi)))
+	return vec3.Add(direction, vec3.Scale(v, math.Cos(theta)))
+}
+
+func (c EquirectangularCamera) GetRay(u, v float64) Ray {
+	direction := panoramaDirection(c.U, c.V, c.W, u, v)
+	return Ray{c.Origin, direction, c.ShutterOpen}
+}
+
+
+// the six faces of a cube around the camera position, next to each other in the order
+// +x, -x, +y, -y, +z, -z (world axes), so the image should be six times as wide as high
+type CubeMapCamera struct {
+	Origin vec3.Vec3
+	ShutterOpen, ShutterClose float64
+}
+
+var cubeFaces = [6][2]vec3.Vec3{
+	// forward, up
+	{vec3.New(1, 0, 0), vec3.New(0, 1, 0)},
+	{vec3.New(-1, 0, 0), vec3.New(0, 1, 0)},
+	{vec3.New(0, 1, 0), vec3.New(0, 0, 1)},
+	{vec3.New(0, -1, 0), vec3.New(0, 0, -1)},
+	{vec3.New(0, 0, 1), vec3.New(0, 1, 0)},
+	{vec3.New(0, 0, -1), vec3.New(0, 1, 0)},
+}
+
+func NewCubeMapCamera(lookFrom vec3.Vec3) CubeMapCamera {
+	return CubeMapCamera{Origin: lookFrom}
+}
+
+func (c CubeMapCamera) GetRay(u, v float64) Ray {
+	face := minInt(int(u*6), 5)
+	x := 2*(u*6-float64(face)) - 1
+	y := 2*v - 1
+	forward, up := cubeFaces[face][0], cubeFaces[face][1]
+	right := vec3.Cross(forward, up)
+	direction := vec3.Add(forward, vec3.Add(vec3.Scale(right, x), vec3.Scale(up, y)))
+	return Ray{c.Origin, direction, c.ShutterOpen}
+}
+
+
+// cameras that scale the radiance reaching the image (e.g. by shutter speed and f-number)
+type ExposureCamera interface {
+	Camera
+	Exposure() float64
+}
+
+
+// physical camera: a thin lens in front of a sensor, specified like a real camera
+// scene units are meters, the lens and the sensor are measured in millimeters
+type PhysicalCamera struct {
+	Origin vec3.Vec3
+	U, V, W vec3.Vec3
+	FocalLength float64 // mm
+	SensorWidth, SensorHeight float64 // mm
+	FNumber float64
+	ShutterSpeed float64 // seconds
+	ISO float64
+	FocusDistance float64 // along the view direction, in scene units
+	Aperture Aperture // shape of the opening (bokeh), a disk if nil
+	ShutterOpen float64
+}
+
+func NewPhysicalCamera(lookFrom, lookAt, vup vec3.Vec3, focalLength, sensorWidth, sensorHeight, fNumber, shutterSpeed, iso float64) *PhysicalCamera {
+	w := vec3.Norm(vec3.Sub(lookFrom, lookAt))
+	u := vec3.Norm(vec3.Cross(vup, w))
+	v := vec3.Cross(w, u)
+	return &PhysicalCamera{
+		Origin: lookFrom,
+		U: u,
+		V: v,
+		W: w,
+		FocalLength: focalLength,
+		SensorWidth: sensorWidth,
+		SensorHeight: sensorHeight,
+		FNumber: fNumber,
+		ShutterSpeed: shutterSpeed,
+		ISO: iso,
+		FocusDistance: vec3.Len(vec3.Sub(lookAt, lookFrom)),
+	}
+}
+
+// focal length giving the same vertical field of view (degrees) as a pinhole camera
+func focalLengthForFOV(vfov, sensorHeight float64) float64 {
+	return sensorHeight / (2 * math.Tan(vfov*math.Pi/360))
+}
+
+// scene radiance of one is a white surface in sunlight, so the "sunny 16" rule
+// (f/16 at 1/ISO seconds) gives an exposure of one
+func (c *PhysicalCamera) Exposure() float64 {
+	return 256 * c.ShutterSpeed * c.ISO / (c.FNumber * c.FNumber)
+}
+
+// focuses on a point, only its distance along the view direction matters
+func (c *PhysicalCamera) FocusOn(p vec3.Vec3) {
+	c.FocusDistance = math.Max(-vec3.Dot(vec3.Sub(p, c.Origin), c.W), 0.001)
+}
+
+// focuses on the center of an object's bounds, false if it has none
+func (c *PhysicalCamera) FocusOnObject(object Hitable) bool {
+	box := AABB{}
+	if !object.BoundingBox(c.ShutterOpen, c.ShutterOpen+c.ShutterSpeed, &box) {
+		return false
+	}
+	c.FocusOn(box.Center())
+	return true
+}
+
+// focuses on whatever is seen at the image position (u, v), like the focus point of a real camera
+func (c *PhysicalCamera) Autofocus(world Hitable, u, v float64) bool {
+	ray := Ray{c.Origin, c.sensorDirection(u, v), c.ShutterOpen}
+	record := HitRecord{}
+	if !world.Hit(ray, 0.001, MAXFLOAT, &record) {
+		return false
+	}
+	c.FocusOn(record.P)
+	return true
+}
+
+// direction through the center of the lens, with unit length along the view direction
+func (c *PhysicalCamera) sensorDirection(u, v float64) vec3.Vec3 {
+	x := (u - 0.5) * c.SensorWidth / c.FocalLength
+	y := (v - 0.5) * c.SensorHeight / c.FocalLength
+	direction := vec3.Scale(c.W, -1)
+	direction = vec3.Add(direction, vec3.Scale(c.U, x))
+	return vec3.Add(direction, vec3.Scale(c.V, y))
+}
+
+func (c *PhysicalCamera) GetRay(u, v float64) Ray {
+	// through the center of the lens, the raytracer samples the lens itself
+	return c.GetLensRay(u, v, 0.5, 0.5)
+}
+
+func (c *PhysicalCamera) GetLensRay(u, v, lensU, lensV float64) Ray {
+	// everything at the focus distance is sharp: rays from all over the lens meet there
+	focus := vec3.Add(c.Origin, vec3.Scale(c.sensorDirection(u, v), c.FocusDistance))
+
+	radius := c.FocalLength / c.FNumber / 2 / 1000
+	var x, y float64
+	if c.Aperture != nil {
+		x, y = c.Aperture.Sample(lensU, lensV)
+	} else {
+		x, y = sampleDisk(lensU, lensV)
+	}
+	origin := vec3.Add(c.Origin, vec3.Scale(c.U, x*radius))
+	origin = vec3.Add(origin, vec3.Scale(c.V, y*radius))
+	time := c.ShutterOpen
+	return Ray{origin, vec3.Sub(focus, origin), time}
+}
+
+
+// cameras that can tell where a point appears in the image (for motion vectors)
+type Projector interface {
+	ShutterCamera
+	// image position (u, v) of a point, false if it is behind the camera
+	Project(p vec3.Vec3) (float64, float64, bool)
+}
+
+func (c PinholeCamera) Project(p vec3.Vec3) (float64, float64, bool) {
+	toCorner := vec3.Sub(c.LowerLeftCorner, c.Origin)
+	forward := vec3.Norm(vec3.Cross(c.Horizontal, c.Vertical))
+	distance := -vec3.Dot(toCorner, forward)
+	d := vec3.Sub(p, c.Origin)
+	z := -vec3.Dot(d, forward)
+	if z <= 0 {
+		return 0, 0, false
+	}
+	// onto the image plane, relative to its lower left corner
+	q := vec3.Sub(vec3.Scale(d, distance/z), toCorner)
+	u := vec3.Dot(q, c.Horizontal) / vec3.LenSq(c.Horizontal)
+	v := vec3.Dot(q, c.Vertical) / vec3.LenSq(c.Vertical)
+	return u, v, true
+}
+
+func (c PinholeCamera) Shutter() (float64, float64) {
+	return c.ShutterOpen, c.ShutterClose
+}
+
+func (c *PhysicalCamera) Project(p vec3.Vec3) (float64, float64, bool) {
+	d := vec3.Sub(p, c.Origin)
+	z := -vec3.Dot(d, c.W)
+	if z <= 0 {
+		return 0, 0, false
+	}
+	u := vec3.Dot(d, c.U)/z*c.FocalLength/c.SensorWidth + 0.5
+	v := vec3.Dot(d, c.V)/z*c.FocalLength/c.SensorHeight + 0.5
+	return u, v, true
+}
+
+func (c *PhysicalCamera) Shutter() (float64, float64) {
+	return c.ShutterOpen, c.ShutterOpen + c.ShutterSpeed
+}
+
+func (c LensCamera) Shutter() (float64, float64) {
+	return c.ShutterOpen, c.ShutterClose
+}
+
+func (c OrthographicCamera) Shutter() (float64, float64) {
+	return c.ShutterOpen, c.ShutterClose
+}
+
+func (c FisheyeCamera) Shutter() (float64, float64) {
+	return c.ShutterOpen, c.ShutterClose
+}
+
+func (c EquirectangularCamera) Shutter() (float64, float64) {
+	return c.ShutterOpen, c.ShutterClose
+}
+
+func (c CubeMapCamera) Shutter() (float64, float64) {
+	return c.ShutterOpen, c.ShutterClose
 }
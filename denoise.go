@@ -0,0 +1,252 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strings"
+
+	"./vec3"
+)
+
+// edge-avoiding À-Trous wavelet denoiser (Dammertz et al. 2010): a 5x5 B3 spline kernel is
+// applied with growing gaps between its taps, and every tap is weighted by how similar
+// its color, normal and depth are to the center pixel, so the blur stops at edges
+type DenoiseSettings struct {
+	Enabled     bool
+	Iterations  int     // the kernel reaches 2^(Iterations+1) pixels
+	ColorSigma  float64 // color difference (of the gamma corrected image) that still blurs
+	NormalSigma float64 // exponent of the cosine between normals, higher keeps more edges
+	DepthSigma  float64 // relative depth difference that still blurs
+}
+
+var DENOISE = DenoiseSettings{Iterations: 5, ColorSigma: 0.6, NormalSigma: 64, DepthSigma: 0.05}
+
+func (s *DenoiseSettings) AddFlags(flags *flag.FlagSet) {
+	flags.IntVar(&s.Iterations, "denoise-iterations", s.Iterations, "denoiser: filter passes, each doubling the reach")
+	flags.Float64Var(&s.ColorSigma, "denoise-color", s.ColorSigma, "denoiser: color difference still blurred over")
+	flags.Float64Var(&s.NormalSigma, "denoise-normal", s.NormalSigma, "denoiser: normal sharpness, higher keeps more edges")
+	flags.Float64Var(&s.DepthSigma, "denoise-depth", s.DepthSigma, "denoiser: relative depth difference still blurred over")
+}
+
+// guide buffers of the denoiser, rows from the top like the image
+// any of them may be nil, which turns off the weight it would give
+type DenoiseGuides struct {
+	Albedo []vec3.Vec3
+	Normal []vec3.Vec3
+	Depth  []float64 // infinite where nothing was hit
+}
+
+var atrousKernel = [5]float64{1.0 / 16, 1.0 / 4, 3.0 / 8, 1.0 / 4, 1.0 / 16}
+
+// filtered copy of a linear image
+func denoise(buffer []vec3.Vec3, nx, ny int, guides DenoiseGuides, settings DenoiseSettings) []vec3.Vec3 {
+	n := nx * ny
+	// the textures are divided out and multiplied back at the end, so they stay sharp
+	// and only the lighting is blurred
+	current := make([]vec3.Vec3, n)
+	for p := range current {
+		current[p] = buffer[p]
+		if guides.Albedo != nil {
+			current[p] = demodulate(buffer[p], guides.Albedo[p])
+		}
+	}
+	normals := make([]vec3.Vec3, n)
+	if guides.Normal != nil {
+		for p, v := range guides.Normal {
+			if v != (vec3.Vec3{}) {
+				normals[p] = vec3.Norm(v)
+			}
+		}
+	}
+
+	next := make([]vec3.Vec3, n)
+	sigma := settings.ColorSigma
+	for it, step := 0, 1; it < settings.Iterations; it, step = it+1, step*2 {
+		for y := 0; y < ny; y++ {
+			for x := 0; x < nx; x++ {
+				p := y*nx + x
+				center := compress(current[p])
+				var sum vec3.Vec3
+				weights := 0.0
+				for dy := -2; dy <= 2; dy++ {
+					qy := y + dy*step
+					if qy < 0 || qy >= ny {
+						continue
+					}
+					for dx := -2; dx <= 2; dx++ {
+						qx := x + dx*step
+						if qx < 0 || qx >= nx {
+							continue
+						}
+						q := qy*nx + qx
+						w := atrousKernel[dx+2] * atrousKernel[dy+2]
+						d := vec3.Sub(compress(current[q]), center)
+						w *= math.Exp(-vec3.LenSq(d) / (sigma * sigma))
+						if guides.Normal != nil {
+							w *= normalWeight(normals[p], normals[q], settings.NormalSigma)
+						}
+						if guides.Depth != nil {
+							w *= depthWeight(guides.Depth[p], guides.Depth[q], settings.DepthSigma*float64(step))
+						}
+						sum = vec3.Add(sum, vec3.Scale(current[q], w))
+						weights += w
+					}
+				}
+				// the center tap always counts, so weights is never zero
+				next[p] = vec3.Scale(sum, 1/weights)
+			}
+		}
+		current, next = next, current
+		// later passes average over more pixels, so less noise is left to tell apart from edges
+		sigma /= 2
+	}
+
+	if guides.Albedo != nil {
+		for p := range current {
+			current[p] = remodulate(current[p], guides.Albedo[p])
+		}
+	}
+	return current
+}
+
+// the lighting arriving at a pixel: its color without the surface's own
+func demodulate(c, albedo vec3.Vec3) vec3.Vec3 {
+	return vec3.New(safeDiv(c.X, albedoGuide(albedo.X)), safeDiv(c.Y, albedoGuide(albedo.Y)), safeDiv(c.Z, albedoGuide(albedo.Z)))
+}
+
+func remodulate(c, albedo vec3.Vec3) vec3.Vec3 {
+	return vec3.New(c.X*albedoGuide(albedo.X), c.Y*albedoGuide(albedo.Y), c.Z*albedoGuide(albedo.Z))
+}
+
+// black surfaces and the background (no albedo) are filtered as they are
+func albedoGuide(a float64) float64 {
+	if a < 0.01 {
+		return 1
+	}
+	return a
+}
+
+// gamma corrected like the output image, with high dynamic range values squashed, so
+// color differences mean about the same everywhere
+func compress(c vec3.Vec3) vec3.Vec3 {
+	f := func(x float64) float64 {
+		x = math.Sqrt(math.Max(x, 0))
+		return x / (1 + x)
+	}
+	return vec3.New(f(c.X), f(c.Y), f(c.Z))
+}
+
+func normalWeight(a, b vec3.Vec3, sigma float64) float64 {
+	zero := vec3.Vec3{}
+	if a == zero || b == zero {
+		if a == b {
+			return 1
+		}
+		return 0
+	}
+	return math.Pow(math.Max(0, vec3.Dot(a, b)), sigma)
+}
+
+// sigma grows with the gap between taps, as farther pixels on the same surface differ more
+func depthWeight(a, b, sigma float64) float64 {
+	if math.IsInf(a, 1) || math.IsInf(b, 1) {
+		if a == b {
+			return 1
+		}
+		return 0
+	}
+	d := math.Abs(a-b) / math.Max(math.Min(a, b), 1e-6)
+	return math.Exp(-d / sigma)
+}
+
+// guides from a rendered film's passes
+func filmGuides(film *Film) DenoiseGuides {
+	depth := make([]float64, film.Width*film.Height)
+	for p, v := range film.AOV(aovDepth) {
+		depth[p] = v.X
+	}
+	return DenoiseGuides{film.AOV(aovAlbedo), film.AOV(aovNormal), depth}
+}
+
+
+// `denoise` command: filters the image in an EXR written with -aov-format exr
+// (using its albedo, normal and depth layers where present)
+func denoiseCommand(args []string) error {
+	flags := flag.NewFlagSet("denoise", flag.ExitOnError)
+	output := flags.String("output", "denoised.png", "denoised image, .png or .exr")
+	settings := DENOISE
+	settings.AddFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: denoise [flags] image.exr")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one input image")
+	}
+
+	nx, ny, channels, err := readEXR(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	byName := map[string][]float32{}
+	for _, c := range channels {
+		byName[c.Name] = c.Values
+	}
+	vectors := func(names ...string) []vec3.Vec3 {
+		for _, name := range names {
+			if byName[name] == nil {
+				return nil
+			}
+		}
+		values := make([]vec3.Vec3, nx*ny)
+		for p := range values {
+			values[p] = vec3.New(float64(byName[names[0]][p]), float64(byName[names[1]][p]), float64(byName[names[2]][p]))
+		}
+		return values
+	}
+
+	buffer := vectors("R", "G", "B")
+	if buffer == nil {
+		return fmt.Errorf("%s: no R, G and B channels", flags.Arg(0))
+	}
+	guides := DenoiseGuides{
+		Albedo: vectors("albedo.R", "albedo.G", "albedo.B"),
+		Normal: vectors("normal.X", "normal.Y", "normal.Z"),
+	}
+	if z := byName["depth.Z"]; z != nil {
+		guides.Depth = make([]float64, nx*ny)
+		for p, v := range z {
+			guides.Depth[p] = float64(v)
+		}
+	}
+	var missing []string
+	if guides.Albedo == nil {
+		missing = append(missing, "albedo")
+	}
+	if guides.Normal == nil {
+		missing = append(missing, "normal")
+	}
+	if guides.Depth == nil {
+		missing = append(missing, "depth")
+	}
+	if len(missing) > 0 {
+		fmt.Printf("No %s guide, edges may blur (render with -aovs albedo,normal,depth)\n", strings.Join(missing, " or "))
+	}
+
+	denoised := denoise(buffer, nx, ny, guides, settings)
+	if strings.HasSuffix(*output, ".exr") {
+		rgb := make([]EXRChannel, 3)
+		for c, name := range []string{"R", "G", "B"} {
+			rgb[c] = EXRChannel{name, make([]float32, nx*ny)}
+			for p, v := range denoised {
+				rgb[c].Values[p] = float32([3]float64{v.X, v.Y, v.Z}[c])
+			}
+		}
+		return writeEXR(*output, nx, ny, rgb)
+	}
+	// the exposure is already applied to the EXR's image
+	return savePNG(*output, toImage(denoised, nx, ny, 1))
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"./vec3"
+)
+
+// distributed rendering: `worker` processes render single tiles of a scene file for a
+// coordinator (a render of a -scene with -workers), which hands the tiles out, merges
+// what comes back and gives the tiles of any worker it loses to the others
+type DistributedSettings struct {
+	Workers []string      // addresses of the workers, host:port
+	Timeout time.Duration // for a tile, after which its worker counts as lost
+	Scene   []byte        // scene file sent to the workers
+}
+
+var DISTRIBUTED = DistributedSettings{Timeout: 5 * time.Minute}
+
+// what a worker renders, the film's tiles are numbered like Film.Tiles
+type TileRequest struct {
+	Scene                []byte
+	Camera               CameraSettings
+	Integrator           IntegratorSettings
+	Width, Height        int // of the film
+	Samples, FirstSample int
+	Sampler, Filter      string
+	Seed                 int64
+	Frame                int // of an animated scene file
+	Tile                 int
+}
+
+// a rendered tile: the filtered sums of all pixels it reached (including its margin)
+type TileResult struct {
+	X0, Y0, X1, Y1 int
+	Sum            []vec3.Vec3
+	Weight         []float64
+	Counts         []int
+	Splats         []Splat // anywhere on the film
+}
+
+// what a worker tells about itself
+type WorkerInfo struct {
+	CPUs int `json:"cpus"` // tiles it renders at the same time
+}
+
+func (ft *FilmTile) result() TileResult {
+	return TileResult{ft.x0, ft.y0, ft.x1, ft.y1, ft.sum, ft.weight, ft.counts, ft.splats}
+}
+
+// merges a tile rendered elsewhere, the same as if it had been rendered here
+func (f *Film) MergeResult(r TileResult) error {
+	n := (r.X1 - r.X0) * (r.Y1 - r.Y0)
+	if r.X0 < 0 || r.Y0 < 0 || r.X1 > f.Width || r.Y1 > f.Height || r.X1 <= r.X0 || r.Y1 <= r.Y0 ||
+		len(r.Sum) != n || len(r.Weight) != n || len(r.Counts) != n {
+		return fmt.Errorf("tile %d,%d-%d,%d does not fit the film", r.X0, r.Y0, r.X1, r.Y1)
+	}
+	for _, s := range r.Splats {
+		if s.Pixel < 0 || s.Pixel >= f.Width*f.Height {
+			return fmt.Errorf("tile %d,%d-%d,%d splats outside of the film", r.X0, r.Y0, r.X1, r.Y1)
+		}
+	}
+	f.Merge(&FilmTile{film: f, x0: r.X0, y0: r.Y0, x1: r.X1, y1: r.Y1, sum: r.Sum, weight: r.Weight, counts: r.Counts, splats: r.Splats})
+	return nil
+}
+
+
+// `worker` command: renders tiles for coordinators until it is killed
+func workerCommand(args []string) error {
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	address := flags.String("address", "localhost:9000", "address to listen on")
+	root := flags.String("root", ".", "directory the models, textures and other files of scene files are taken from")
+	flags.Parse(args)
+
+	w := &Worker{open: insideOf(*root), scenes: map[uint64]*workerScene{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info", func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, WorkerInfo{runtime.NumCPU()})
+	})
+	mux.HandleFunc("/tile", w.tile)
+	fmt.Printf("Worker listening on %s\n", *address)
+	return http.ListenAndServe(*address, mux)
+}
+
+type Worker struct {
+	open func(string) (string, error)
+
+	// the scenes of the last frames, built once for all of their tiles
+	mutex  sync.Mutex
+	scenes map[uint64]*workerScene
+}
+
+type workerScene struct {
+	scene  *Scene
+	camera Camera
+	err    error
+}
+
+const workerScenes = 4
+
+func (w *Worker) prepare(req *TileRequest) (*workerScene, error) {
+	key := hashBytes([]byte(fmt.Sprint(hashBytes(req.Scene), req.Frame, req.Camera, req.Integrator, req.Width, req.Height)))
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if s, ok := w.scenes[key]; ok {
+		return s, s.err
+	}
+	if len(w.scenes) >= workerScenes {
+		w.scenes = map[uint64]*workerScene{}
+	}
+	s := &workerScene{}
+	w.scenes[key] = s
+	f, err := parseSceneFile(req.Scene)
+	if err == nil {
+		f = f.AtFrame(req.Frame)
+		s.scene, err = f.Build(w.open)
+	}
+	if err != nil {
+		s.err = err
+		return s, err
+	}
+	// the camera's files are the worker's, like the scene's
+	settings, err := req.Camera.files(w.open)
+	if err != nil {
+		s.err = err
+		return s, err
+	}
+	lookFrom, lookAt, vfov := f.View()
+	s.camera = prepareScene(s.scene, f.viewSettings(settings, vfov), lookFrom, lookAt, vfov, req.Width, req.Height)
+	if s.scene.Integrator, err = newIntegrator(req.Integrator, s.scene); err != nil {
+		s.err = err
+		return s, err
+	}
+	return s, nil
+}
+
+func (w *Worker) tile(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req TileRequest
+	if err := gob.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s, err := w.prepare(&req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter, err := newFilter(req.Filter)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := newSampler(req.Sampler, req.Samples, req.Seed, 0); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// only the tile is kept, the film just gives its size and filter
+	film := &Film{Width: req.Width, Height: req.Height, Filter: filter}
+	tiles := film.Tiles(tileSize)
+	if req.Tile < 0 || req.Tile >= len(tiles) {
+		http.Error(rw, "no such tile", http.StatusBadRequest)
+		return
+	}
+	ft := renderTile(film, tiles, req.Tile, req.Samples, req.FirstSample, s.camera, s.scene, req.Sampler, req.Seed)
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	gob.NewEncoder(rw).Encode(ft.result())
+}
+
+
+// renders the scene file in DISTRIBUTED.Scene on the workers
+func renderDistributed(nx, ny, ns int, samplerKind string, seed int64) (*Film, error) {
+	filter, err := newFilter(FILTER)
+	if err != nil {
+		return nil, err
+	}
+	film := NewFilm(nx, ny, filter)
+	tiles := film.Tiles(tileSize)
+	request := TileRequest{
+		Scene:      DISTRIBUTED.Scene,
+		Camera:     CAMERA,
+		Integrator: INTEGRATOR,
+		Width:      nx,
+		Height:     ny,
+		Samples:    ns,
+		Sampler:    samplerKind,
+		Filter:     FILTER,
+		Seed:       seed,
+		Frame:      ANIMATION.Frame,
+	}
+
+	// lost workers put their tile back, so there is always room for it
+	queue := make(chan int, len(tiles))
+	for t := range tiles {
+		queue <- t
+	}
+	done := make(chan struct{})
+	var mutex sync.Mutex
+	remaining := len(tiles)
+	var lastErr error
+	rendered := map[string]int{}
+
+	client := &http.Client{Timeout: DISTRIBUTED.Timeout}
+	wg := new(sync.WaitGroup)
+	for _, address := range DISTRIBUTED.Workers {
+		info, err := workerInfo(client, address)
+		if err != nil {
+			fmt.Printf("Worker %s is not available: %v\n", address, err)
+			lastErr = err
+			continue
+		}
+		lost := make(chan struct{})
+		var once sync.Once
+		loseWorker := func(err error) {
+			once.Do(func() {
+				fmt.Printf("Lost worker %s (%v), its tiles go to the others\n", address, err)
+				close(lost)
+			})
+		}
+		for i := 0; i < maxInt(info.CPUs, 1); i++ {
+			wg.Add(1)
+			go func(address string) {
+				defer wg.Done()
+				for {
+					select {
+					case <-lost:
+						return
+					case <-done:
+						return
+					case t := <-queue:
+						req := request
+						req.Tile = t
+						result, err := requestTile(client, address, &req)
+						if err == nil {
+							err = film.MergeResult(result)
+						}
+						mutex.Lock()
+						if err != nil {
+							lastErr = err
+							mutex.Unlock()
+							queue <- t
+							loseWorker(err)
+							return
+						}
+						rendered[address]++
+						remaining--
+						if remaining == 0 {
+							close(done)
+						}
+						mutex.Unlock()
+					}
+				}
+			}(address)
+		}
+	}
+	wg.Wait()
+
+	if remaining > 0 {
+		return nil, fmt.Errorf("no workers left with %d of %d tiles to render (%v)", remaining, len(tiles), lastErr)
+	}
+	for _, address := range DISTRIBUTED.Workers {
+		fmt.Printf("Worker %s: %d tiles\n", address, rendered[address])
+	}
+	return film, nil
+}
+
+func workerInfo(client *http.Client, address string) (WorkerInfo, error) {
+	var info WorkerInfo
+	resp, err := client.Get("http://" + address + "/info")
+	if err != nil {
+		return info, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return info, fmt.Errorf("%s", resp.Status)
+	}
+	return info, json.NewDecoder(resp.Body).Decode(&info)
+}
+
+func requestTile(client *http.Client, address string, req *TileRequest) (TileResult, error) {
+	var result TileResult
+	body := new(bytes.Buffer)
+	if err := gob.NewEncoder(body).Encode(req); err != nil {
+		return result, err
+	}
+	resp, err := client.Post("http://"+address+"/tile", "application/octet-stream", body)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message := new(bytes.Buffer)
+		message.ReadFrom(resp.Body)
+		return result, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(message.Bytes()))
+	}
+	return result, gob.NewDecoder(resp.Body).Decode(&result)
+}
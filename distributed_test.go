@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+	"./vec3"
+)
+
+// renders a few samples and splats into every tile of the film
+func renderTestTiles(film *Film) []*FilmTile {
+	var tiles []*FilmTile
+	for n, t := range film.Tiles(3) {
+		ft := film.NewTile(t)
+		for j := t.Y0; j < t.Y1; j++ {
+			for i := t.X0; i < t.X1; i++ {
+				c := vec3.New(float64(i), float64(j), float64(n))
+				ft.AddSample(float64(i)+0.25, float64(j)+0.75, c)
+				ft.AddSample(float64(i)+0.5, float64(j)+0.5, vec3.Scale(c, 0.5))
+				ft.SetCount(i, j, 2)
+			}
+		}
+		ft.AddSplat(float64(t.X0)+0.5, float64(t.Y0)+0.5, vec3.New(1, 2, 3))
+		tiles = append(tiles, ft)
+	}
+	return tiles
+}
+
+func TestMergeResult(t *testing.T) {
+	filter, err := newFilter("gaussian")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, remote := NewFilm(7, 5, filter), NewFilm(7, 5, filter)
+	for _, ft := range renderTestTiles(local) {
+		local.Merge(ft)
+	}
+	for _, ft := range renderTestTiles(remote) {
+		if err := remote.MergeResult(ft.result()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, got := local.Buffer(), remote.Buffer()
+	for p := range want {
+		if got[p] != want[p] || remote.Counts[p] != local.Counts[p] {
+			t.Errorf("pixel %d is %v (%d samples), want %v (%d samples)", p, got[p], remote.Counts[p], want[p], local.Counts[p])
+		}
+	}
+}
+
+func TestMergeResultRejectsBadTiles(t *testing.T) {
+	filter, err := newFilter("box")
+	if err != nil {
+		t.Fatal(err)
+	}
+	film := NewFilm(4, 4, filter)
+	tile := func(x0, y0, x1, y1, n int) TileResult {
+		return TileResult{x0, y0, x1, y1, make([]vec3.Vec3, n), make([]float64, n), make([]int, n), nil}
+	}
+	bad := map[string]TileResult{
+		"empty":          tile(1, 1, 1, 1, 0),
+		"inverted":       tile(2, 2, 0, 0, 4),
+		"negative":       tile(-1, 0, 1, 1, 2),
+		"outside":        tile(2, 2, 5, 4, 6),
+		"short sums":     tile(0, 0, 2, 2, 3),
+		"long sums":      tile(0, 0, 2, 2, 5),
+		"missing counts": {0, 0, 2, 2, make([]vec3.Vec3, 4), make([]float64, 4), nil, nil},
+	}
+	splat := tile(0, 0, 2, 2, 4)
+	splat.Splats = []Splat{{16, vec3.New(1, 1, 1)}}
+	bad["splat outside"] = splat
+	for name, r := range bad {
+		if err := film.MergeResult(r); err == nil {
+			t.Errorf("%s: merged without an error", name)
+		}
+	}
+	for p, c := range film.Counts {
+		if c != 0 {
+			t.Fatalf("pixel %d was changed by a rejected tile", p)
+		}
+	}
+}
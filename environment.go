@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"./vec3"
+)
+
+// light arriving from infinitely far away
+type Environment interface {
+	Radiance(direction vec3.Vec3) vec3.Vec3
+	// picks a direction for a point in [0, 1)^2, returns it together with its radiance and density (per solid angle)
+	Sample(u, v float64) (vec3.Vec3, vec3.Vec3, float64)
+	// density with which Sample picks the given direction
+	Pdf(direction vec3.Vec3) float64
+}
+
+// piecewise constant distribution over [0, 1), for importance sampling
+type distribution1D struct {
+	function []float64
+	cdf      []float64
+	integral float64
+}
+
+func newDistribution1D(function []float64) *distribution1D {
+	n := len(function)
+	d := &distribution1D{function: function, cdf: make([]float64, n+1)}
+	for i := 0; i < n; i++ {
+		d.cdf[i+1] = d.cdf[i] + function[i]/float64(n)
+	}
+	d.integral = d.cdf[n]
+	for i := 1; i <= n; i++ {
+		if d.integral > 0 {
+			d.cdf[i] /= d.integral
+		} else {
+			d.cdf[i] = float64(i) / float64(n)
+		}
+	}
+	return d
+}
+
+// returns the sampled position, its density and the index of the piece it is in
+func (d *distribution1D) sample(u float64) (float64, float64, int) {
+	n := len(d.function)
+	i := sort.SearchFloat64s(d.cdf, u) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i > n-1 {
+		i = n - 1
+	}
+	du := u - d.cdf[i]
+	if width := d.cdf[i+1] - d.cdf[i]; width > 0 {
+		du /= width
+	}
+	pdf := 1.0
+	if d.integral > 0 {
+		pdf = d.function[i] / d.integral
+	}
+	return (float64(i) + du) / float64(n), pdf, i
+}
+
+
+// infinitely far away light given by an equirectangular (latitude-longitude) image
+// the top row of the image is straight up (+y), the center column looks along -z
+type EnvironmentLight struct {
+	Width, Height int
+	Pixels        []vec3.Vec3
+	Rotation      float64 // degrees around the y axis
+	Intensity     float64
+
+	rows    *distribution1D   // marginal, over the rows
+	columns []*distribution1D // conditional, per row
+}
+
+func NewEnvironmentLight(width, height int, pixels []vec3.Vec3, rotation, intensity float64) *EnvironmentLight {
+	e := &EnvironmentLight{Width: width, Height: height, Pixels: pixels, Rotation: rotation, Intensity: intensity}
+
+	// luminance weighted by the solid angle of the pixels (rows near the poles are smaller)
+	rowWeights := make([]float64, height)
+	e.columns = make([]*distribution1D, height)
+	for y := 0; y < height; y++ {
+		sinTheta := math.Sin(math.Pi * (float64(y) + 0.5) / float64(height))
+		weights := make([]float64, width)
+		for x := 0; x < width; x++ {
+			weights[x] = luminance(pixels[y*width+x]) * sinTheta
+		}
+		e.columns[y] = newDistribution1D(weights)
+		rowWeights[y] = e.columns[y].integral
+	}
+	e.rows = newDistribution1D(rowWeights)
+	return e
+}
+
+// loads a Radiance .hdr or a .pfm image
+func loadEnvironmentLight(filename string, rotation, intensity float64) (*EnvironmentLight, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var width, height int
+	var pixels []vec3.Vec3
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".hdr":
+		width, height, pixels, err = decodeHDR(contents)
+	case ".pfm":
+		width, height, pixels, err = decodePFM(contents)
+	default:
+		err = fmt.Errorf("unknown environment map format `%s`", filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Loaded environment map `%s` (%dx%d)\n", filename, width, height)
+	return NewEnvironmentLight(width, height, pixels, rotation, intensity), nil
+}
+
+func luminance(c vec3.Vec3) float64 {
+	return 0.2126*c.X + 0.7152*c.Y + 0.0722*c.Z
+}
+
+// image coordinates in [0, 1) of a direction
+func (e *EnvironmentLight) uv(direction vec3.Vec3) (float64, float64) {
+	d := vec3.Norm(direction)
+	phi := math.Atan2(d.X, -d.Z) - e.Rotation*math.Pi/180
+	u := phi/(2*math.Pi) + 0.5
+	u -= math.Floor(u)
+	v := math.Acos(math.Max(-1, math.Min(1, d.Y))) / math.Pi
+	return u, v
+}
+
+func (e *EnvironmentLight) direction(u, v float64) vec3.Vec3 {
+	phi := (u-0.5)*2*math.Pi + e.Rotation*math.Pi/180
+	theta := v * math.Pi
+	sinTheta := math.Sin(theta)
+	return vec3.New(sinTheta*math.Sin(phi), math.Cos(theta), -sinTheta*math.Cos(phi))
+}
+
+// radiance arriving from the given direction
+func (e *EnvironmentLight) Radiance(direction vec3.Vec3) vec3.Vec3 {
+	u, v := e.uv(direction)
+	x := minInt(int(u*float64(e.Width)), e.Width-1)
+	y := minInt(int(v*float64(e.Height)), e.Height-1)
+	return vec3.Scale(e.Pixels[y*e.Width+x], e.Intensity)
+}
+
+// picks a direction proportional to the brightness of the map
+func (e *EnvironmentLight) Sample(u, v float64) (vec3.Vec3, vec3.Vec3, float64) {
+	v, pdfRow, y := e.rows.sample(v)
+	u, pdfColumn, _ := e.columns[y].sample(u)
+	sinTheta := math.Sin(v * math.Pi)
+	if sinTheta == 0 {
+		return vec3.New(0, 1, 0), vec3.New(0, 0, 0), 0
+	}
+	direction := e.direction(u, v)
+	pdf := pdfRow * pdfColumn / (2 * math.Pi * math.Pi * sinTheta)
+	return direction, e.Radiance(direction), pdf
+}
+
+func (e *EnvironmentLight) Pdf(direction vec3.Vec3) float64 {
+	u, v := e.uv(direction)
+	sinTheta := math.Sin(v * math.Pi)
+	if sinTheta == 0 || e.rows.integral == 0 {
+		return 0
+	}
+	x := minInt(int(u*float64(e.Width)), e.Width-1)
+	y := minInt(int(v*float64(e.Height)), e.Height-1)
+	return e.columns[y].function[x] / e.rows.integral / (2 * math.Pi * math.Pi * sinTheta)
+}
+
+
+// Radiance RGBE image (both flat and run-length encoded scanlines)
+func decodeHDR(contents []byte) (int, int, []vec3.Vec3, error) {
+	r := bufio.NewReader(bytes.NewReader(contents))
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "#?") {
+		return 0, 0, nil, fmt.Errorf("not a Radiance HDR image")
+	}
+	for {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("truncated HDR header")
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "FORMAT=") && line != "FORMAT=32-bit_rle_rgbe" {
+			return 0, 0, nil, fmt.Errorf("unsupported HDR format `%s`", line[7:])
+		}
+	}
+	line, err = r.ReadString('\n')
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("missing HDR resolution")
+	}
+	var width, height int
+	if _, err := fmt.Sscanf(line, "-Y %d +X %d", &height, &width); err != nil {
+		return 0, 0, nil, fmt.Errorf("unsupported HDR orientation `%s`", strings.TrimSpace(line))
+	}
+	// a scanline takes at least a byte per 16 pixels (runs of 127 in each of the four channels)
+	n := len(contents)
+	if width <= 0 || height <= 0 || width > 16*n || height > n || width*height > 16*n {
+		return 0, 0, nil, fmt.Errorf("bad HDR resolution %dx%d", width, height)
+	}
+
+	pixels := make([]vec3.Vec3, width*height)
+	scanline := make([]byte, 4*width)
+	for y := 0; y < height; y++ {
+		if err := readHDRScanline(r, scanline, width); err != nil {
+			return 0, 0, nil, err
+		}
+		for x := 0; x < width; x++ {
+			rgbe := scanline[4*x : 4*x+4]
+			if rgbe[3] == 0 {
+				continue
+			}
+			f := math.Ldexp(1, int(rgbe[3])-(128+8))
+			pixels[y*width+x] = vec3.New(
+				(float64(rgbe[0])+0.5)*f,
+				(float64(rgbe[1])+0.5)*f,
+				(float64(rgbe[2])+0.5)*f,
+			)
+		}
+	}
+	return width, height, pixels, nil
+}
+
+func readHDRScanline(r *bufio.Reader, scanline []byte, width int) error {
+	header, err := r.Peek(4)
+	if err != nil {
+		return fmt.Errorf("truncated HDR image")
+	}
+	rle := width >= 8 && width < 32768 && header[0] == 2 && header[1] == 2 && header[2]&0x80 == 0
+	if !rle {
+		if _, err := io.ReadFull(r, scanline); err != nil {
+			return fmt.Errorf("truncated HDR image")
+		}
+		return nil
+	}
+	if int(header[2])<<8|int(header[3]) != width {
+		return fmt.Errorf("bad HDR scanline width")
+	}
+	r.Discard(4)
+
+	// the four channels are stored one after the other
+	for c := 0; c < 4; c++ {
+		for x := 0; x < width; {
+			count, err := r.ReadByte()
+			if err != nil {
+				return fmt.Errorf("truncated HDR image")
+			}
+			if count > 128 {
+				n := int(count) - 128
+				value, err := r.ReadByte()
+				if err != nil || x+n > width {
+					return fmt.Errorf("bad HDR run")
+				}
+				for ; n > 0; n-- {
+					scanline[4*x+c] = value
+					x++
+				}
+			} else {
+				n := int(count)
+				if n == 0 || x+n > width {
+					return fmt.Errorf("bad HDR run")
+				}
+				for ; n > 0; n-- {
+					value, err := r.ReadByte()
+					if err != nil {
+						return fmt.Errorf("truncated HDR image")
+					}
+					scanline[4*x+c] = value
+					x++
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// portable float map, color (PF) or grayscale (Pf), rows stored bottom to top
+func decodePFM(contents []byte) (int, int, []vec3.Vec3, error) {
+	r := bufio.NewReader(bytes.NewReader(contents))
+	var kind string
+	var width, height int
+	var scale float64
+	if _, err := fmt.Fscan(r, &kind, &width, &height, &scale); err != nil {
+		return 0, 0, nil, fmt.Errorf("bad PFM header")
+	}
+	r.ReadByte() // single whitespace before the data
+	channels := 3
+	switch kind {
+	case "PF":
+	case "Pf":
+		channels = 1
+	default:
+		return 0, 0, nil, fmt.Errorf("not a PFM image")
+	}
+	n := len(contents)
+	if width <= 0 || height <= 0 || width > n || height > n || 4*width*height*channels > n {
+		return 0, 0, nil, fmt.Errorf("bad PFM size %dx%d", width, height)
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if scale < 0 {
+		order = binary.LittleEndian
+	}
+
+	data := make([]float32, width*height*channels)
+	if err := binary.Read(r, order, data); err != nil {
+		return 0, 0, nil, fmt.Errorf("truncated PFM image")
+	}
+	pixels := make([]vec3.Vec3, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := ((height-1-y)*width + x) * channels
+			if channels == 1 {
+				g := float64(data[i])
+				pixels[y*width+x] = vec3.New(g, g, g)
+			} else {
+				pixels[y*width+x] = vec3.New(float64(data[i]), float64(data[i+1]), float64(data[i+2]))
+			}
+		}
+	}
+	return width, height, pixels, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"./vec3"
+)
+
+const hdrHeader = "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n"
+
+func TestDecodeHDR(t *testing.T) {
+	// one flat scanline of two pixels, then one run-length encoded scanline of eight
+	flat := hdrHeader + "-Y 1 +X 2\n" + string([]byte{128, 64, 0, 129, 0, 0, 0, 0})
+	rle := hdrHeader + "-Y 1 +X 8\n" + string([]byte{2, 2, 0, 8, 128 + 8, 128, 128 + 8, 64, 128 + 8, 0, 128 + 8, 129})
+	want := vec3.New(128.5/128, 64.5/128, 0.5/128)
+	for name, contents := range map[string]string{"flat": flat, "rle": rle} {
+		width, height, pixels, err := decodeHDR([]byte(contents))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if height != 1 || len(pixels) != width*height {
+			t.Fatalf("%s: %dx%d image with %d pixels", name, width, height, len(pixels))
+		}
+		if !closeTo(pixels[0], want) {
+			t.Errorf("%s: first pixel is %v, want %v", name, pixels[0], want)
+		}
+	}
+}
+
+func TestDecodeHDRRejectsBadInput(t *testing.T) {
+	bad := map[string]string{
+		"empty":              "",
+		"not hdr":            "P6\n1 1\n255\n",
+		"truncated header":   "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n",
+		"other format":       "#?RADIANCE\nFORMAT=32-bit_rle_xyze\n\n-Y 1 +X 1\n\x80\x80\x80\x80",
+		"missing resolution": hdrHeader,
+		"orientation":        hdrHeader + "+Y 1 +X 1\n\x80\x80\x80\x80",
+		"negative size":      hdrHeader + "-Y -1 +X 1\n",
+		"truncated flat":     hdrHeader + "-Y 2 +X 1\n\x80\x80\x80\x80",
+		"rle width":          hdrHeader + "-Y 1 +X 8\n\x02\x02\x00\x09",
+		"empty run":          hdrHeader + "-Y 1 +X 8\n\x02\x02\x00\x08\x00",
+		"long run":           hdrHeader + "-Y 1 +X 8\n\x02\x02\x00\x08\x89\x80",
+		"truncated rle":      hdrHeader + "-Y 1 +X 8\n\x02\x02\x00\x08\x88\x80\x88",
+	}
+	for name, contents := range bad {
+		if _, _, _, err := decodeHDR([]byte(contents)); err == nil {
+			t.Errorf("%s: decoded without an error", name)
+		}
+	}
+}
+
+func TestDecodePFM(t *testing.T) {
+	// little endian color, rows stored bottom to top
+	var color bytes.Buffer
+	color.WriteString("PF\n1 2\n-1.0\n")
+	binary.Write(&color, binary.LittleEndian, []float32{1, 2, 3, 4, 5, 6})
+	width, height, pixels, err := decodePFM(color.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width != 1 || height != 2 || !closeTo(pixels[0], vec3.New(4, 5, 6)) || !closeTo(pixels[1], vec3.New(1, 2, 3)) {
+		t.Errorf("color: %dx%d image %v", width, height, pixels)
+	}
+
+	// big endian grayscale
+	var gray bytes.Buffer
+	gray.WriteString("Pf\n2 1\n1.0\n")
+	binary.Write(&gray, binary.BigEndian, []float32{0.5, 8})
+	width, height, pixels, err = decodePFM(gray.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width != 2 || height != 1 || !closeTo(pixels[1], vec3.New(8, 8, 8)) {
+		t.Errorf("grayscale: %dx%d image %v", width, height, pixels)
+	}
+}
+
+func TestDecodePFMRejectsBadInput(t *testing.T) {
+	bad := map[string]string{
+		"empty":         "",
+		"not pfm":       "P6\n1 1\n255\n\x00\x00\x00",
+		"bad header":    "PF\n1 x\n-1.0\n",
+		"negative size": "PF\n-1 2\n-1.0\n",
+		"huge size":     "PF\n100000 100000\n-1.0\n",
+		"truncated":     "PF\n2 2\n-1.0\n\x00\x00\x80\x3f",
+	}
+	for name, contents := range bad {
+		if _, _, _, err := decodePFM([]byte(contents)); err == nil {
+			t.Errorf("%s: decoded without an error", name)
+		}
+	}
+}
+
+func closeTo(a, b vec3.Vec3) bool {
+	return math.Abs(a.X-b.X) < 1e-9 && math.Abs(a.Y-b.Y) < 1e-9 && math.Abs(a.Z-b.Z) < 1e-9
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+)
+
+// one channel of an OpenEXR image, values row by row from the top
+type EXRChannel struct {
+	Name   string // e.g. "R" or "normal.X", layers are separated by dots
+	Values []float32
+}
+
+// writes an uncompressed scanline OpenEXR image with 32 bit float channels
+func writeEXR(filename string, width, height int, channels []EXRChannel) error {
+	channels = append([]EXRChannel(nil), channels...)
+	// the format wants the channels sorted by name
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	le := binary.LittleEndian
+	put := func(v interface{}) { binary.Write(w, le, v) }
+	attribute := func(name, kind string, size int) {
+		w.WriteString(name + "\x00" + kind + "\x00")
+		put(int32(size))
+	}
+
+	put(uint32(20000630)) // magic number
+	put(uint32(2))        // version 2, single part scanline image
+
+	size := 1
+	for _, c := range channels {
+		size += len(c.Name) + 1 + 16
+	}
+	attribute("channels", "chlist", size)
+	for _, c := range channels {
+		w.WriteString(c.Name + "\x00")
+		put(int32(2))       // FLOAT
+		put([4]uint8{})     // pLinear and reserved
+		put([2]int32{1, 1}) // x and y sampling
+	}
+	w.WriteByte(0)
+	attribute("compression", "compression", 1)
+	w.WriteByte(0) // none
+	window := [4]int32{0, 0, int32(width - 1), int32(height - 1)}
+	attribute("dataWindow", "box2i", 16)
+	put(window)
+	attribute("displayWindow", "box2i", 16)
+	put(window)
+	attribute("lineOrder", "lineOrder", 1)
+	w.WriteByte(0) // increasing y
+	attribute("pixelAspectRatio", "float", 4)
+	put(float32(1))
+	attribute("screenWindowCenter", "v2f", 8)
+	put([2]float32{0, 0})
+	attribute("screenWindowWidth", "float", 4)
+	put(float32(1))
+	w.WriteByte(0) // end of the header
+
+	// offset table, one scanline per chunk
+	headerSize := 8 + 1
+	headerSize += len("channels") + len("chlist") + 2 + 4 + size
+	headerSize += len("compression")*2 + 2 + 4 + 1
+	headerSize += len("dataWindow") + len("box2i") + 2 + 4 + 16
+	headerSize += len("displayWindow") + len("box2i") + 2 + 4 + 16
+	headerSize += len("lineOrder")*2 + 2 + 4 + 1
+	headerSize += len("pixelAspectRatio") + len("float") + 2 + 4 + 4
+	headerSize += len("screenWindowCenter") + len("v2f") + 2 + 4 + 8
+	headerSize += len("screenWindowWidth") + len("float") + 2 + 4 + 4
+	lineSize := 4 * width * len(channels)
+	offset := uint64(headerSize + 8*height)
+	for y := 0; y < height; y++ {
+		put(offset)
+		offset += uint64(8 + lineSize)
+	}
+
+	for y := 0; y < height; y++ {
+		put(int32(y))
+		put(int32(lineSize))
+		for _, c := range channels {
+			put(c.Values[y*width : (y+1)*width])
+		}
+	}
+	return w.Flush()
+}
+
+// reads the float and half channels of an uncompressed scanline OpenEXR image
+// (as written by writeEXR, other compressions are not supported)
+func readEXR(filename string) (int, int, []EXRChannel, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	fail := func(reason string) (int, int, []EXRChannel, error) {
+		return 0, 0, nil, &exrError{filename, reason}
+	}
+	le := binary.LittleEndian
+	if len(contents) < 8 || le.Uint32(contents) != 20000630 {
+		return fail("not an OpenEXR image")
+	}
+	if le.Uint32(contents[4:])&0x200 != 0 {
+		return fail("tiled images are not supported")
+	}
+
+	type channelInfo struct {
+		name      string
+		pixelType int32
+	}
+	var infos []channelInfo
+	var window [4]int32
+	compression := byte(255)
+	pos := 8
+	cstring := func() string {
+		start := pos
+		for pos < len(contents) && contents[pos] != 0 {
+			pos++
+		}
+		s := string(contents[start:pos])
+		pos++
+		return s
+	}
+	for {
+		if pos >= len(contents) {
+			return fail("truncated header")
+		}
+		name := cstring()
+		if name == "" {
+			break
+		}
+		kind := cstring()
+		if pos+4 > len(contents) {
+			return fail("truncated header")
+		}
+		size := int(int32(le.Uint32(contents[pos:])))
+		pos += 4
+		if size < 0 || pos+size > len(contents) {
+			return fail("truncated header")
+		}
+		value := contents[pos : pos+size]
+		switch {
+		case name == "channels" && kind == "chlist":
+			for i := 0; i < len(value) && value[i] != 0; {
+				end := i
+				for end < len(value) && value[end] != 0 {
+					end++
+				}
+				if end+17 > len(value) {
+					return fail("bad channel list")
+				}
+				infos = append(infos, channelInfo{string(value[i:end]), int32(le.Uint32(value[end+1:]))})
+				i = end + 17
+			}
+		case name == "compression" && size == 1:
+			compression = value[0]
+		case name == "dataWindow" && size == 16:
+			for i := range window {
+				window[i] = int32(le.Uint32(value[4*i:]))
+			}
+		}
+		pos += size
+	}
+	if compression != 0 {
+		return fail("only uncompressed images are supported")
+	}
+	if len(infos) == 0 {
+		return fail("empty image")
+	}
+	pixelSize := 0
+	for _, info := range infos {
+		switch info.pixelType {
+		case 1:
+			pixelSize += 2
+		case 2:
+			pixelSize += 4
+		default:
+			return fail("only half and float channels are supported")
+		}
+	}
+	// the offset table and every scanline (with its y and size) have to fit in the file
+	w, h := int64(window[2])-int64(window[0])+1, int64(window[3])-int64(window[1])+1
+	n := int64(len(contents) - pos)
+	if w <= 0 || h <= 0 || w > n || h > n || h*(16+w*int64(pixelSize)) > n {
+		return fail("bad data window")
+	}
+	width, height := int(w), int(h)
+
+	channels := make([]EXRChannel, len(infos))
+	for i, info := range infos {
+		channels[i] = EXRChannel{info.name, make([]float32, width*height)}
+	}
+	table := pos
+	for line := 0; line < height; line++ {
+		offset := le.Uint64(contents[table+8*line:])
+		if offset < uint64(table+8*height) || offset > uint64(len(contents)-8) {
+			return fail("bad offset table")
+		}
+		pos = int(offset)
+		y := int(int32(le.Uint32(contents[pos:]))) - int(window[1])
+		pos += 8
+		if y < 0 || y >= height {
+			return fail("bad scanline")
+		}
+		if pos+width*pixelSize > len(contents) {
+			return fail("truncated image")
+		}
+		for i, info := range infos {
+			for x := 0; x < width; x++ {
+				var v float32
+				if info.pixelType == 2 {
+					v = math.Float32frombits(le.Uint32(contents[pos:]))
+					pos += 4
+				} else {
+					v = halfToFloat(le.Uint16(contents[pos:]))
+					pos += 2
+				}
+				channels[i].Values[y*width+x] = v
+			}
+		}
+	}
+	return width, height, channels, nil
+}
+
+type exrError struct {
+	filename, reason string
+}
+
+func (e *exrError) Error() string {
+	return e.filename + ": " + e.reason
+}
+
+func halfToFloat(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exponent := int(h>>10) & 0x1f
+	mantissa := uint32(h & 0x3ff)
+	switch {
+	case exponent == 0:
+		// zero or subnormal
+		v := float32(mantissa) / 1024 / (1 << 14)
+		if sign != 0 {
+			v = -v
+		}
+		return v
+	case exponent == 31:
+		return math.Float32frombits(sign | 0x7f800000 | mantissa<<13)
+	}
+	return math.Float32frombits(sign | uint32(exponent-15+127)<<23 | mantissa<<13)
+}
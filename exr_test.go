@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestEXRRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "image.exr")
+
+	width, height := 3, 2
+	channels := []EXRChannel{
+		{"R", []float32{0, 0.5, 1, 2, 100, -1}},
+		{"G", []float32{1, 2, 3, 4, 5, 6}},
+		{"B", []float32{0.25, 0, 0, 0, 0, 1e-6}},
+		{"normal.X", []float32{-1, 1, 0, 0.5, -0.5, 0}},
+	}
+	if err := writeEXR(filename, width, height, channels); err != nil {
+		t.Fatal(err)
+	}
+	// the offset table comes right before the scanlines, which fill the rest of the file
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lineSize := 8 + 4*width*len(channels)
+	table := len(contents) - height*(8+lineSize)
+	for y := 0; y < height; y++ {
+		offset := binary.LittleEndian.Uint64(contents[table+8*y:])
+		if want := uint64(table + 8*height + y*lineSize); offset != want {
+			t.Errorf("scanline %d is at offset %d, want %d", y, offset, want)
+		}
+	}
+
+	w, h, read, err := readEXR(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w != width || h != height {
+		t.Fatalf("read a %dx%d image, want %dx%d", w, h, width, height)
+	}
+	if len(read) != len(channels) {
+		t.Fatalf("read %d channels, want %d", len(read), len(channels))
+	}
+	byName := map[string][]float32{}
+	for _, c := range read {
+		byName[c.Name] = c.Values
+	}
+	for _, c := range channels {
+		values, ok := byName[c.Name]
+		if !ok {
+			t.Fatalf("channel %s is missing", c.Name)
+		}
+		for i := range c.Values {
+			if values[i] != c.Values[i] {
+				t.Errorf("channel %s, value %d is %g, want %g", c.Name, i, values[i], c.Values[i])
+			}
+		}
+	}
+}
+
+func TestEXRRejectsBadInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "image.exr")
+	if err := writeEXR(filename, 4, 4, []EXRChannel{{"Y", make([]float32, 16)}}); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tiled := append([]byte(nil), contents...)
+	tiled[5] |= 0x2 // the tiled flag of the version field
+	// a data window of 200001x200001 pixels in the same small file
+	huge := append([]byte(nil), contents...)
+	window := bytes.Index(huge, []byte("dataWindow\x00box2i\x00")) + len("dataWindow\x00box2i\x00") + 4
+	binary.LittleEndian.PutUint32(huge[window+8:], 200000)
+	binary.LittleEndian.PutUint32(huge[window+12:], 200000)
+	overflow := append([]byte(nil), contents...)
+	binary.LittleEndian.PutUint32(overflow[window:], 0x80000000)
+	binary.LittleEndian.PutUint32(overflow[window+8:], 0x7fffffff)
+	// a compression attribute without its value
+	compression := bytes.Replace(contents, []byte("compression\x00compression\x00\x01\x00\x00\x00\x00"),
+		[]byte("compression\x00compression\x00\x00\x00\x00\x00"), 1)
+	// the first scanline's offset pointing into the header
+	offset := append([]byte(nil), contents...)
+	binary.LittleEndian.PutUint64(offset[len(contents)-4*(8+16)-8*4:], 8)
+	bad := map[string][]byte{
+		"empty":       nil,
+		"not exr":     []byte("P6\n4 4\n255\n"),
+		"tiled":       tiled,
+		"no header":   contents[:8],
+		"huge":        huge,
+		"overflow":    overflow,
+		"compression": compression,
+		"offset":      offset,
+	}
+	// cut anywhere in the header, the offset table or the scanlines
+	for _, n := range []int{9, 20, 60, len(contents) / 2, len(contents) - 1} {
+		bad["truncated at "+strconv.Itoa(n)] = contents[:n]
+	}
+	for name, b := range bad {
+		if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := readEXR(filename); err == nil {
+			t.Errorf("%s: read without an error", name)
+		}
+	}
+}
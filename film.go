@@ -0,0 +1,182 @@
+package main
+
+import (
+	"math"
+	"sync"
+
+	"./vec3"
+)
+
+// the image being rendered: filtered sums of the samples splatted to every pixel
+// they are close enough to, rows from the top like the output image
+type Film struct {
+	Width, Height int
+	Filter        Filter
+	Counts        []int // samples taken per pixel
+
+	sum      []vec3.Vec3
+	weight   []float64
+	aov      []AOVSample // nil unless passes are rendered (see EnableAOVs)
+	aovCount []int
+	splat    []vec3.Vec3 // light traced to the camera, nil until some is (see AddSplat)
+	mutex    sync.Mutex
+}
+
+func NewFilm(width, height int, filter Filter) *Film {
+	return &Film{
+		Width:  width,
+		Height: height,
+		Filter: filter,
+		Counts: make([]int, width*height),
+		sum:    make([]vec3.Vec3, width*height),
+		weight: make([]float64, width*height),
+	}
+}
+
+// filtered radiance of every pixel, safe to call while tiles are merged
+func (f *Film) Buffer() []vec3.Vec3 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	buffer := make([]vec3.Vec3, f.Width*f.Height)
+	for i := range buffer {
+		if f.weight[i] != 0 {
+			c := vec3.Scale(f.sum[i], 1/f.weight[i])
+			// filters with negative lobes can overshoot below zero
+			buffer[i] = vec3.New(math.Max(c.X, 0), math.Max(c.Y, 0), math.Max(c.Z, 0))
+		}
+	}
+	if f.splat != nil {
+		// every camera sample traced one light path, which could have reached any pixel
+		total := 0
+		for _, n := range f.Counts {
+			total += n
+		}
+		if total > 0 {
+			scale := float64(f.Width*f.Height) / float64(total)
+			for i := range buffer {
+				buffer[i] = vec3.Add(buffer[i], vec3.Scale(f.splat[i], scale))
+			}
+		}
+	}
+	return buffer
+}
+
+
+// rectangle of pixels [X0, X1) x [Y0, Y1), in film rows counted from the bottom like
+// the sample positions, rendered by one goroutine
+type Tile struct {
+	X0, Y0, X1, Y1 int
+}
+
+// square tiles covering the film, from the top row down
+func (f *Film) Tiles(size int) []Tile {
+	var tiles []Tile
+	for y1 := f.Height; y1 > 0; y1 -= size {
+		for x0 := 0; x0 < f.Width; x0 += size {
+			tiles = append(tiles, Tile{x0, maxInt(y1-size, 0), minInt(x0+size, f.Width), y1})
+		}
+	}
+	return tiles
+}
+
+// private part of the film for a tile, including the margin its samples splat into,
+// so goroutines only need to lock the film when they are done
+type FilmTile struct {
+	film           *Film
+	x0, y0, x1, y1 int
+	sum            []vec3.Vec3
+	weight         []float64
+	counts         []int
+	aov            []AOVSample
+	aovCount       []int
+	splats         []Splat
+}
+
+// light arriving at the camera from a path traced from a light, it lands on a single pixel
+// anywhere on the film (not filtered, there are too few of them)
+type Splat struct {
+	Pixel int // in the film, rows from the top
+	Color vec3.Vec3
+}
+
+func (f *Film) NewTile(t Tile) *FilmTile {
+	margin := int(math.Ceil(f.Filter.Radius() - 0.5))
+	ft := &FilmTile{
+		film: f,
+		x0:   maxInt(t.X0-margin, 0),
+		y0:   maxInt(t.Y0-margin, 0),
+		x1:   minInt(t.X1+margin, f.Width),
+		y1:   minInt(t.Y1+margin, f.Height),
+	}
+	n := (ft.x1 - ft.x0) * (ft.y1 - ft.y0)
+	ft.sum = make([]vec3.Vec3, n)
+	ft.weight = make([]float64, n)
+	ft.counts = make([]int, n)
+	if f.aov != nil {
+		ft.aov = make([]AOVSample, n)
+		ft.aovCount = make([]int, n)
+	}
+	return ft
+}
+
+// adds a sample at film position (x, y) to all pixels whose filter reaches it
+func (ft *FilmTile) AddSample(x, y float64, c vec3.Vec3) {
+	r := ft.film.Filter.Radius()
+	// pixel centers are at half-integer positions
+	i0 := maxInt(int(math.Ceil(x-0.5-r)), ft.x0)
+	i1 := minInt(int(math.Floor(x-0.5+r)), ft.x1-1)
+	j0 := maxInt(int(math.Ceil(y-0.5-r)), ft.y0)
+	j1 := minInt(int(math.Floor(y-0.5+r)), ft.y1-1)
+	for j := j0; j <= j1; j++ {
+		for i := i0; i <= i1; i++ {
+			w := ft.film.Filter.Evaluate(x-float64(i)-0.5, y-float64(j)-0.5)
+			if w == 0 {
+				continue
+			}
+			k := ft.index(i, j)
+			ft.sum[k] = vec3.Add(ft.sum[k], vec3.Scale(c, w))
+			ft.weight[k] += w
+		}
+	}
+}
+
+func (ft *FilmTile) AddSplat(x, y float64, c vec3.Vec3) {
+	f := ft.film
+	i, j := int(math.Floor(x)), int(math.Floor(y))
+	if i < 0 || j < 0 || i >= f.Width || j >= f.Height {
+		return
+	}
+	ft.splats = append(ft.splats, Splat{(f.Height-1-j)*f.Width + i, c})
+}
+
+func (ft *FilmTile) SetCount(i, j, count int) {
+	ft.counts[ft.index(i, j)] = count
+}
+
+func (ft *FilmTile) index(i, j int) int {
+	return (j-ft.y0)*(ft.x1-ft.x0) + (i - ft.x0)
+}
+
+// adds the tile to the film, tiles overlap by the filter's margin
+func (f *Film) Merge(ft *FilmTile) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for j := ft.y0; j < ft.y1; j++ {
+		for i := ft.x0; i < ft.x1; i++ {
+			k := ft.index(i, j)
+			p := (f.Height-1-j)*f.Width + i
+			f.sum[p] = vec3.Add(f.sum[p], ft.sum[k])
+			f.weight[p] += ft.weight[k]
+			f.Counts[p] += ft.counts[k]
+			if f.aov != nil {
+				f.mergeAOV(ft, k, p)
+			}
+		}
+	}
+	if len(ft.splats) > 0 && f.splat == nil {
+		f.splat = make([]vec3.Vec3, f.Width*f.Height)
+	}
+	for _, s := range ft.splats {
+		f.splat[s.Pixel] = vec3.Add(f.splat[s.Pixel], s.Color)
+	}
+}
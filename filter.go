@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// pixel reconstruction filter, weights samples by their offset from a pixel's center
+// all filters here are separable: the weight is the product of a weight for x and for y
+type Filter interface {
+	Radius() float64
+	Evaluate(x, y float64) float64
+}
+
+func newFilter(kind string) (Filter, error) {
+	switch kind {
+	case "box":
+		return BoxFilter{0.5}, nil
+	case "tent":
+		return TentFilter{1.0}, nil
+	case "gaussian":
+		return GaussianFilter{1.5, 2.0}, nil
+	case "mitchell":
+		return MitchellFilter{2.0, 1.0 / 3, 1.0 / 3}, nil
+	case "lanczos":
+		return LanczosFilter{2.0, 2.0}, nil
+	}
+	return nil, fmt.Errorf("unknown filter `%s`", kind)
+}
+
+
+// every sample within the pixel counts the same (radius 0.5 is a plain average)
+type BoxFilter struct {
+	R float64
+}
+
+func (f BoxFilter) Radius() float64 {
+	return f.R
+}
+
+func (f BoxFilter) Evaluate(x, y float64) float64 {
+	if math.Abs(x) > f.R || math.Abs(y) > f.R {
+		return 0
+	}
+	return 1
+}
+
+
+// weights fall off linearly from the center
+type TentFilter struct {
+	R float64
+}
+
+func (f TentFilter) Radius() float64 {
+	return f.R
+}
+
+func (f TentFilter) Evaluate(x, y float64) float64 {
+	return math.Max(0, f.R-math.Abs(x)) * math.Max(0, f.R-math.Abs(y))
+}
+
+
+// gaussian shifted down to reach zero at the radius, larger Alpha falls off faster
+type GaussianFilter struct {
+	R     float64
+	Alpha float64
+}
+
+func (f GaussianFilter) Radius() float64 {
+	return f.R
+}
+
+func (f GaussianFilter) gaussian(d float64) float64 {
+	return math.Max(0, math.Exp(-f.Alpha*d*d)-math.Exp(-f.Alpha*f.R*f.R))
+}
+
+func (f GaussianFilter) Evaluate(x, y float64) float64 {
+	return f.gaussian(x) * f.gaussian(y)
+}
+
+
+// Mitchell-Netravali cubic, B = C = 1/3 balances blurring against ringing
+type MitchellFilter struct {
+	R    float64
+	B, C float64
+}
+
+func (f MitchellFilter) Radius() float64 {
+	return f.R
+}
+
+// the cubic over [-2, 2]
+func (f MitchellFilter) mitchell(x float64) float64 {
+	x = math.Abs(2 * x / f.R)
+	B, C := f.B, f.C
+	if x > 2 {
+		return 0
+	}
+	if x > 1 {
+		return ((-B-6*C)*x*x*x + (6*B+30*C)*x*x + (-12*B-48*C)*x + (8*B + 24*C)) / 6
+	}
+	return ((12-9*B-6*C)*x*x*x + (-18+12*B+6*C)*x*x + (6 - 2*B)) / 6
+}
+
+func (f MitchellFilter) Evaluate(x, y float64) float64 {
+	return f.mitchell(x) * f.mitchell(y)
+}
+
+
+// windowed sinc, sharpest of the filters, Tau is the number of lobes
+type LanczosFilter struct {
+	R   float64
+	Tau float64
+}
+
+func (f LanczosFilter) Radius() float64 {
+	return f.R
+}
+
+func sinc(x float64) float64 {
+	if math.Abs(x) < 1e-5 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+func (f LanczosFilter) lanczos(x float64) float64 {
+	x = math.Abs(x)
+	if x > f.R {
+		return 0
+	}
+	return sinc(x) * sinc(x/f.Tau)
+}
+
+func (f LanczosFilter) Evaluate(x, y float64) float64 {
+	return f.lanczos(x) * f.lanczos(y)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/png"
+	"math"
+	"os"
+
+	"./vec3"
+)
+
+// heightfield (regular grid of height samples, e.g. terrain)
+//
+// the grid is traversed cell by cell along the ray (2D DDA over the XZ plane),
+// every cell keeps the range of its four corner heights so cells the ray passes
+// entirely above or below are skipped without testing their two triangles
+type Heightfield struct {
+	Columns, Rows int
+	Heights       []float64 // world space heights, row-major
+	Corner        vec3.Vec3 // corner with the lowest x and z
+	CellX, CellZ  float64
+	Material      Material
+
+	normals          []vec3.Vec3 // per sample, for smooth shading
+	cellMin, cellMax []float64
+	minY, maxY       float64
+}
+
+// samples are expected in [0, 1] and are scaled by the vertical extent (size.Y),
+// the grid covers size.X by size.Z starting at the given corner
+func NewHeightfield(samples []float64, columns, rows int, corner, size vec3.Vec3, material Material) *Heightfield {
+	h := &Heightfield{
+		Columns:  columns,
+		Rows:     rows,
+		Heights:  make([]float64, len(samples)),
+		Corner:   corner,
+		CellX:    size.X / float64(columns-1),
+		CellZ:    size.Z / float64(rows-1),
+		Material: material,
+	}
+	h.minY = math.Inf(1)
+	h.maxY = math.Inf(-1)
+	for i, s := range samples {
+		y := corner.Y + s*size.Y
+		h.Heights[i] = y
+		h.minY = math.Min(h.minY, y)
+		h.maxY = math.Max(h.maxY, y)
+	}
+
+	h.normals = make([]vec3.Vec3, len(samples))
+	for j := 0; j < rows; j++ {
+		for i := 0; i < columns; i++ {
+			// central differences (one-sided at the borders)
+			i0, i1 := maxInt(i-1, 0), minInt(i+1, columns-1)
+			j0, j1 := maxInt(j-1, 0), minInt(j+1, rows-1)
+			dx := (h.height(i1, j) - h.height(i0, j)) / (float64(i1-i0) * h.CellX)
+			dz := (h.height(i, j1) - h.height(i, j0)) / (float64(j1-j0) * h.CellZ)
+			h.normals[j*columns+i] = vec3.Norm(vec3.New(-dx, 1, -dz))
+		}
+	}
+
+	h.cellMin = make([]float64, (columns-1)*(rows-1))
+	h.cellMax = make([]float64, (columns-1)*(rows-1))
+	for j := 0; j < rows-1; j++ {
+		for i := 0; i < columns-1; i++ {
+			a, b := h.height(i, j), h.height(i+1, j)
+			c, d := h.height(i, j+1), h.height(i+1, j+1)
+			h.cellMin[j*(columns-1)+i] = math.Min(math.Min(a, b), math.Min(c, d))
+			h.cellMax[j*(columns-1)+i] = math.Max(math.Max(a, b), math.Max(c, d))
+		}
+	}
+	return h
+}
+
+// loads a grayscale image (8 or 16 bit), each pixel becomes one height sample
+func loadHeightfield(filename string, corner, size vec3.Vec3, material Material) (*Heightfield, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	columns, rows := bounds.Dx(), bounds.Dy()
+	if columns < 2 || rows < 2 {
+		return nil, fmt.Errorf("heightfield `%s` needs at least 2x2 pixels", filename)
+	}
+	fmt.Printf("Loaded heightfield `%s` (%dx%d)\n", filename, columns, rows)
+
+	samples := make([]float64, columns*rows)
+	for j := 0; j < rows; j++ {
+		for i := 0; i < columns; i++ {
+			g := color.Gray16Model.Convert(img.At(bounds.Min.X+i, bounds.Min.Y+j)).(color.Gray16)
+			samples[j*columns+i] = float64(g.Y) / 65535
+		}
+	}
+	return NewHeightfield(samples, columns, rows, corner, size, material), nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (h *Heightfield) height(i, j int) float64 {
+	return h.Heights[j*h.Columns+i]
+}
+
+func (h *Heightfield) vertex(i, j int) vec3.Vec3 {
+	return vec3.New(h.Corner.X+float64(i)*h.CellX, h.height(i, j), h.Corner.Z+float64(j)*h.CellZ)
+}
+
+func (h *Heightfield) Hit(ray Ray, tMin, tMax float64, record *HitRecord) bool {
+	o, d := ray.Origin(), ray.Direction()
+	sizeX := h.CellX * float64(h.Columns-1)
+	sizeZ := h.CellZ * float64(h.Rows-1)
+
+	t0, t1 := tMin, tMax
+	if !clipSlab(o.X, d.X, h.Corner.X, h.Corner.X+sizeX, &t0, &t1) ||
+		!clipSlab(o.Y, d.Y, h.minY, h.maxY, &t0, &t1) ||
+		!clipSlab(o.Z, d.Z, h.Corner.Z, h.Corner.Z+sizeZ, &t0, &t1) {
+		return false
+	}
+
+	// starting cell
+	p := ray.PointAtParameter(t0)
+	i := minInt(maxInt(int((p.X-h.Corner.X)/h.CellX), 0), h.Columns-2)
+	j := minInt(maxInt(int((p.Z-h.Corner.Z)/h.CellZ), 0), h.Rows-2)
+
+	stepI, stepJ := 1, 1
+	nextX, nextZ := math.Inf(1), math.Inf(1)
+	deltaX, deltaZ := math.Inf(1), math.Inf(1)
+	if d.X > 0 {
+		nextX = (h.Corner.X + float64(i+1)*h.CellX - o.X) / d.X
+		deltaX = h.CellX / d.X
+	} else if d.X < 0 {
+		stepI = -1
+		nextX = (h.Corner.X + float64(i)*h.CellX - o.X) / d.X
+		deltaX = -h.CellX / d.X
+	}
+	if d.Z > 0 {
+		nextZ = (h.Corner.Z + float64(j+1)*h.CellZ - o.Z) / d.Z
+		deltaZ = h.CellZ / d.Z
+	} else if d.Z < 0 {
+		stepJ = -1
+		nextZ = (h.Corner.Z + float64(j)*h.CellZ - o.Z) / d.Z
+		deltaZ = -h.CellZ / d.Z
+	}
+
+	enter := t0
+	for {
+		exit := math.Min(math.Min(nextX, nextZ), t1)
+
+		// skip the cell if the ray segment lies completely above or below it
+		y0 := o.Y + d.Y*enter
+		y1 := o.Y + d.Y*exit
+		c := j*(h.Columns-1) + i
+		if math.Min(y0, y1) <= h.cellMax[c] && math.Max(y0, y1) >= h.cellMin[c] {
+			if h.hitCell(ray, i, j, math.Max(tMin, enter-0.0001), math.Min(tMax, exit+0.0001), record) {
+				return true
+			}
+		}
+
+		if exit >= t1 {
+			return false
+		}
+		if nextX < nextZ {
+			i += stepI
+			enter = nextX
+			nextX += deltaX
+		} else {
+			j += stepJ
+			enter = nextZ
+			nextZ += deltaZ
+		}
+		if i < 0 || i >= h.Columns-1 || j < 0 || j >= h.Rows-1 {
+			return false
+		}
+	}
+}
+
+func (h *Heightfield) BoundingBox(t0, t1 float64, box *AABB) bool {
+	box.Min = vec3.New(h.Corner.X, h.minY, h.Corner.Z)
+	box.Max = vec3.New(h.Corner.X+h.CellX*float64(h.Columns-1), h.maxY, h.Corner.Z+h.CellZ*float64(h.Rows-1))
+	return true
+}
+
+// tests the two triangles of cell (i, j), interpolating normals and texture coordinates
+func (h *Heightfield) hitCell(ray Ray, i, j int, tMin, tMax float64, record *HitRecord) bool {
+	corners := [4][2]int{{i, j}, {i + 1, j}, {i + 1, j + 1}, {i, j + 1}}
+	triangles := [2][3]int{{0, 3, 2}, {0, 2, 1}}
+
+	hit := false
+	for _, tri := range triangles {
+		a, b, c := corners[tri[0]], corners[tri[1]], corners[tri[2]]
+		t, u, v, ok := intersectTriangle(ray, h.vertex(a[0], a[1]), h.vertex(b[0], b[1]), h.vertex(c[0], c[1]))
+		if !ok || t <= tMin || t >= tMax {
+			continue
+		}
+		tMax = t
+		hit = true
+
+		na := h.normals[a[1]*h.Columns+a[0]]
+		nb := h.normals[b[1]*h.Columns+b[0]]
+		nc := h.normals[c[1]*h.Columns+c[0]]
+		n := vec3.Scale(na, 1-u-v)
+		n = vec3.Add(n, vec3.Scale(nb, u))
+		n = vec3.Add(n, vec3.Scale(nc, v))
+
+		record.T = t
+		record.P = ray.PointAtParameter(t)
+		record.Normal = vec3.Norm(n)
+		record.U = (record.P.X - h.Corner.X) / (h.CellX * float64(h.Columns-1))
+		record.V = (record.P.Z - h.Corner.Z) / (h.CellZ * float64(h.Rows-1))
+		record.Material = h.Material
+	}
+	return hit
+}
@@ -1,21 +1,26 @@
 package main
 
 import (
+	"fmt"
 	"math"
 	"./vec3"
 )
 
 type Hitable interface {
     Hit(ray Ray, tMin, tMax float64, record *HitRecord) bool
+    // box enclosing the object during the time interval [t0, t1], false if unbounded
+    BoundingBox(t0, t1 float64, box *AABB) bool
 }
 
 type HitRecord struct {
 	T float64
 	P vec3.Vec3
 	Normal vec3.Vec3
+	U, V float64  // texture coordinates
 	Material Material
 	HitLight bool
 	Light Light
+	Object int  // top-level object that was hit, for the object ID pass (zero if unknown)
 }
 
 
@@ -33,14 +38,35 @@ func (l HitableList) Hit(ray Ray, tMin, tMax float64, record *HitRecord) bool {
 			record.T = tempRecord.T
 			record.P = tempRecord.P
 			record.Normal = tempRecord.Normal
+			record.U = tempRecord.U
+			record.V = tempRecord.V
 			record.Material = tempRecord.Material
 			record.HitLight = tempRecord.HitLight
 			record.Light = tempRecord.Light
+			record.Object = tempRecord.Object
 		}
 	}
 	return hitAnything
 }
 
+func (l HitableList) BoundingBox(t0, t1 float64, box *AABB) bool {
+	if len(l) == 0 {
+		return false
+	}
+	tempBox := AABB{}
+	for i, hitable := range l {
+		if !hitable.BoundingBox(t0, t1, &tempBox) {
+			return false
+		}
+		if i == 0 {
+			*box = tempBox
+		} else {
+			*box = surroundingBox(*box, tempBox)
+		}
+	}
+	return true
+}
+
 
 // sphere
 type Sphere struct {
@@ -76,6 +102,50 @@ func (s Sphere) Hit(ray Ray, tMin, tMax float64, record *HitRecord) bool {
 	return false
 }
 
+func (s Sphere) BoundingBox(t0, t1 float64, box *AABB) bool {
+	r := math.Abs(s.Radius)
+	box.Min = vec3.Translate(s.Center, -r)
+	box.Max = vec3.Translate(s.Center, r)
+	return true
+}
+
+
+// sphere moving linearly from Center0 at Time0 to Center1 at Time1
+type MovingSphere struct {
+	Center0, Center1 vec3.Vec3
+	Time0, Time1 float64
+	Radius float64
+	Material Material
+}
+
+func NewMovingSphere(center0, center1 vec3.Vec3, time0, time1, radius float64, material Material) (MovingSphere, error) {
+	if time1 == time0 {
+		return MovingSphere{}, fmt.Errorf("a moving sphere needs two different times")
+	}
+	return MovingSphere{center0, center1, time0, time1, radius, material}, nil
+}
+
+func (s MovingSphere) Center(time float64) vec3.Vec3 {
+	f := (time - s.Time0) / (s.Time1 - s.Time0)
+	return vec3.Add(s.Center0, vec3.Scale(vec3.Sub(s.Center1, s.Center0), f))
+}
+
+func (s MovingSphere) Hit(ray Ray, tMin, tMax float64, record *HitRecord) bool {
+	return Sphere{s.Center(ray.Time), s.Radius, s.Material}.Hit(ray, tMin, tMax, record)
+}
+
+func (s MovingSphere) PositionAt(p vec3.Vec3, from, to float64) vec3.Vec3 {
+	return vec3.Add(p, vec3.Sub(s.Center(to), s.Center(from)))
+}
+
+func (s MovingSphere) BoundingBox(t0, t1 float64, box *AABB) bool {
+	var box0, box1 AABB
+	Sphere{s.Center(t0), s.Radius, s.Material}.BoundingBox(t0, t1, &box0)
+	Sphere{s.Center(t1), s.Radius, s.Material}.BoundingBox(t0, t1, &box1)
+	*box = surroundingBox(box0, box1)
+	return true
+}
+
 
 // plane (infinite, no borders)
 type Plane struct {
@@ -102,6 +172,10 @@ func (p Plane) Hit(ray Ray, tMin, tMax float64, record *HitRecord) bool {
 	return false
 }
 
+func (p Plane) BoundingBox(t0, t1 float64, box *AABB) bool {
+	return false
+}
+
 
 // triangle
 type Triangle struct {
@@ -112,36 +186,59 @@ type Triangle struct {
 }
 
 // https://en.wikipedia.org/wiki/Möller–Trumbore_intersection_algorithm
-func (tr Triangle) Hit(ray Ray, tMin, tMax float64, record *HitRecord) bool {
-	edge1 := vec3.Sub(tr.Vertex2, tr.Vertex1)
-	edge2 := vec3.Sub(tr.Vertex3, tr.Vertex1)
+// returns the ray parameter and the barycentric coordinates of the hit point
+func intersectTriangle(ray Ray, v1, v2, v3 vec3.Vec3) (float64, float64, float64, bool) {
+	edge1 := vec3.Sub(v2, v1)
+	edge2 := vec3.Sub(v3, v1)
 	h := vec3.Cross(ray.Direction(), edge2)
 	a := vec3.Dot(edge1, h)
 	if -0.0001 < a && a < 0.0001 {
-		return false
+		return 0, 0, 0, false
 	}
 
 	f := 1.0 / a
-	s := vec3.Sub(ray.Origin(), tr.Vertex1)
+	s := vec3.Sub(ray.Origin(), v1)
 	u := f * vec3.Dot(s, h)
 	if u < 0.0 || 1.0 < u {
-		return false
+		return 0, 0, 0, false
 	}
 
 	q := vec3.Cross(s, edge1)
 	v := f * vec3.Dot(ray.Direction(), q)
 	if v < 0.0 || 1.0 < v + u {
-		return false
+		return 0, 0, 0, false
 	}
 
-	t := f * vec3.Dot(edge2, q)
-	if tMin < t && t < tMax {
+	return f * vec3.Dot(edge2, q), u, v, true
+}
+
+func (tr Triangle) Hit(ray Ray, tMin, tMax float64, record *HitRecord) bool {
+	t, u, v, ok := intersectTriangle(ray, tr.Vertex1, tr.Vertex2, tr.Vertex3)
+	if ok && tMin < t && t < tMax {
+		edge1 := vec3.Sub(tr.Vertex2, tr.Vertex1)
+		edge2 := vec3.Sub(tr.Vertex3, tr.Vertex1)
 		record.T = t
 		record.P = ray.PointAtParameter(t)
 		record.Normal = vec3.Norm(vec3.Cross(edge1, edge2))
+		record.U = u
+		record.V = v
 		record.Material = tr.Material
 		return true
 	}
 	
 	return false
-}
\ No newline at end of file
+}
+
+func (tr Triangle) BoundingBox(t0, t1 float64, box *AABB) bool {
+	box.Min = vec3.New(
+		math.Min(tr.Vertex1.X, math.Min(tr.Vertex2.X, tr.Vertex3.X)) - 0.0001,
+		math.Min(tr.Vertex1.Y, math.Min(tr.Vertex2.Y, tr.Vertex3.Y)) - 0.0001,
+		math.Min(tr.Vertex1.Z, math.Min(tr.Vertex2.Z, tr.Vertex3.Z)) - 0.0001,
+	)
+	box.Max = vec3.New(
+		math.Max(tr.Vertex1.X, math.Max(tr.Vertex2.X, tr.Vertex3.X)) + 0.0001,
+		math.Max(tr.Vertex1.Y, math.Max(tr.Vertex2.Y, tr.Vertex3.Y)) + 0.0001,
+		math.Max(tr.Vertex1.Z, math.Max(tr.Vertex2.Z, tr.Vertex3.Z)) + 0.0001,
+	)
+	return true
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"./vec3"
+)
+
+// integrators: how the light arriving along camera rays is computed, those that also trace
+// light to the camera hand it to splat with where it lands in the camera's image (u, v)
+type Integrator interface {
+	Radiance(ray Ray, scene *Scene, sampler Sampler, camera Camera, splat func(u, v float64, c vec3.Vec3)) vec3.Vec3
+}
+
+type IntegratorSettings struct {
+	Kind           string
+	Photons        int     // photon mapping: emitted for the global map
+	CausticPhotons int     // photon mapping: emitted towards mirrors and glass for the caustic map
+	Nearest        int     // photon mapping: photons per radiance estimate
+	Depth          int     // bidirectional path tracing: longest paths, in bounces
+	AORadius       float64 // ambient occlusion: how far surfaces occlude, 0 for a fifth of the scene's size
+	AOSamples      int     // ambient occlusion: rays per camera ray
+}
+
+var INTEGRATOR = IntegratorSettings{Kind: "path", Photons: 200000, CausticPhotons: 200000, Nearest: 64, Depth: 8, AOSamples: 16}
+
+// sets up the integrator for the scene, after its hierarchy is built
+func newIntegrator(settings IntegratorSettings, scene *Scene) (Integrator, error) {
+	switch settings.Kind {
+	case "path":
+		return PathTracer{}, nil
+	case "photon":
+		if settings.Photons < 0 || settings.CausticPhotons < 0 || settings.Nearest <= 0 {
+			return nil, fmt.Errorf("photon mapping needs photons and a positive number of nearest ones")
+		}
+		return newPhotonMapper(scene, settings), nil
+	case "bdpt":
+		if settings.Depth <= 0 {
+			return nil, fmt.Errorf("bidirectional path tracing needs a positive depth")
+		}
+		return newBidirectionalPathTracer(scene, settings.Depth), nil
+	case "ao":
+		if settings.AORadius < 0 || settings.AOSamples <= 0 {
+			return nil, fmt.Errorf("ambient occlusion needs a radius and a positive number of samples")
+		}
+		radius := settings.AORadius
+		if radius == 0 {
+			_, r := sceneBounds(scene)
+			radius = r / 5
+		}
+		return AmbientOcclusion{radius, settings.AOSamples}, nil
+	case "whitted":
+		return Whitted{}, nil
+	}
+	return nil, fmt.Errorf("unknown integrator `%s`", settings.Kind)
+}
+
+func (s *Scene) integrator() Integrator {
+	if s.Integrator == nil {
+		return PathTracer{}
+	}
+	return s.Integrator
+}
+
+
+// path tracing with next event estimation (see pixel)
+type PathTracer struct{}
+
+func (PathTracer) Radiance(ray Ray, scene *Scene, sampler Sampler, camera Camera, splat func(u, v float64, c vec3.Vec3)) vec3.Vec3 {
+	return pixel(ray, scene, sampler, 0, false)
+}
+
+
+// clay render: how open the surface seen is, the fraction of (cosine weighted) rays leaving
+// it that get further than the radius, white where nothing is seen
+type AmbientOcclusion struct {
+	Radius  float64
+	Samples int
+}
+
+func (a AmbientOcclusion) Radiance(ray Ray, scene *Scene, sampler Sampler, camera Camera, splat func(u, v float64, c vec3.Vec3)) vec3.Vec3 {
+	record := HitRecord{}
+	if !scene.World.Hit(ray, 0.001, MAXFLOAT, &record) {
+		return vec3.New(1.0, 1.0, 1.0)
+	}
+	normal := record.Normal
+	if vec3.Dot(normal, ray.Direction()) > 0 {
+		normal = vec3.Scale(normal, -1)
+	}
+	sampler.SetDimension(scatterDimension(0))
+	open := 0
+	for i := 0; i < a.Samples; i++ {
+		direction := vec3.Norm(vec3.Add(normal, sampleSphere(sampler.Get2D())))
+		occluder := HitRecord{}
+		if !scene.World.Hit(Ray{record.P, direction, ray.Time}, 0.001, a.Radius, &occluder) {
+			open++
+		}
+	}
+	ao := float64(open) / float64(a.Samples)
+	return vec3.New(ao, ao, ao)
+}
+
+
+// classic recursive ray tracing, without random numbers: mirrors reflect and glass reflects
+// and refracts (split by the fresnel term) perfectly, and every surface but glass is lit
+// straight by the lights, plus the background seen along its normal as ambient light
+// media are left out, apart from dimming the light reaching surfaces
+type Whitted struct{}
+
+func (w Whitted) Radiance(ray Ray, scene *Scene, sampler Sampler, camera Camera, splat func(u, v float64, c vec3.Vec3)) vec3.Vec3 {
+	return w.trace(ray, scene, 0)
+}
+
+func (w Whitted) trace(ray Ray, scene *Scene, depth int) vec3.Vec3 {
+	record := HitRecord{}
+	if !scene.World.Hit(ray, 0.001, MAXFLOAT, &record) {
+		return background(ray, scene, false)
+	}
+	var c vec3.Vec3
+	if emitter, ok := record.Material.(Emitter); ok {
+		c = emitter.Emitted(record)
+	}
+	direction := vec3.Norm(ray.Direction())
+	if d, ok := record.Material.(Dielectric); ok {
+		if depth >= 10 {
+			return c
+		}
+		return vec3.Add(c, w.refract(ray, record, d, scene, depth))
+	}
+
+	albedo := materialAlbedo(record)
+	normal := record.Normal
+	for _, light := range scene.Lights {
+		towards, distance, intensity := light.Illuminate(record.P)
+		cosine := vec3.Dot(normal, towards)
+		if cosine <= 0 {
+			continue
+		}
+		cosine *= visibility(scene, record.P, towards, distance, ray.Time)
+		c = vec3.Add(c, vec3.Scale(vec3.Mul(albedo, intensity), cosine))
+	}
+	if m, ok := record.Material.(Metal); ok {
+		if depth < 10 {
+			reflected := Ray{record.P, reflect(direction, normal), ray.Time}
+			c = vec3.Add(c, vec3.Mul(m.Albedo, w.trace(reflected, scene, depth+1)))
+		}
+		return c
+	}
+	if vec3.Dot(normal, direction) > 0 {
+		normal = vec3.Scale(normal, -1)
+	}
+	ambient := background(Ray{record.P, normal, ray.Time}, scene, false)
+	return vec3.Add(c, vec3.Mul(albedo, ambient))
+}
+
+// glass: the reflected and refracted light weighted by the fresnel term (like Dielectric
+// chooses between them), dimmed by absorption when leaving
+func (w Whitted) refract(ray Ray, record HitRecord, d Dielectric, scene *Scene, depth int) vec3.Vec3 {
+	direction := vec3.Norm(ray.Direction())
+	attenuation := vec3.New(1.0, 1.0, 1.0)
+	outwardNormal := record.Normal
+	niOverNt := 1.0 / d.RefractiveIndex
+	cosine := -vec3.Dot(direction, record.Normal)
+	if vec3.Dot(direction, record.Normal) > 0 {
+		distance := record.T * vec3.Len(ray.Direction())
+		attenuation = vec3.New(math.Exp(-d.Absorption.X*distance), math.Exp(-d.Absorption.Y*distance), math.Exp(-d.Absorption.Z*distance))
+		outwardNormal = vec3.Scale(record.Normal, -1)
+		niOverNt = d.RefractiveIndex
+		cosine = d.RefractiveIndex * vec3.Dot(direction, record.Normal)
+	}
+	reflected := w.trace(Ray{record.P, reflect(direction, record.Normal), ray.Time}, scene, depth+1)
+	var refracted vec3.Vec3
+	if !refract(direction, outwardNormal, niOverNt, &refracted) {
+		return vec3.Mul(attenuation, reflected)
+	}
+	r := schlick(cosine, d.RefractiveIndex)
+	transmitted := w.trace(Ray{record.P, refracted, ray.Time}, scene, depth+1)
+	return vec3.Mul(attenuation, vec3.Add(vec3.Scale(reflected, r), vec3.Scale(transmitted, 1-r)))
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"./vec3"
+)
+
+type Light interface {
+	// light arriving at p: the (normalized) direction towards the light, the distance
+	// to it (MAXFLOAT if infinitely far away) and the intensity reaching p
+	Illuminate(p vec3.Vec3) (vec3.Vec3, float64, vec3.Vec3)
+}
+
+// light from a position fades linearly with the distance (like the original point lights)
+func towards(p, position vec3.Vec3) (vec3.Vec3, float64) {
+	d := vec3.Sub(position, p)
+	distance := vec3.Len(d)
+	return vec3.Scale(d, 1/distance), distance
+}
+
+func smoothstep(edge0, edge1, x float64) float64 {
+	t := math.Max(0, math.Min(1, (x-edge0)/(edge1-edge0)))
+	return t * t * (3 - 2*t)
+}
+
+
+// point light
+type PointLight struct {
+	P         vec3.Vec3
+	Intensity vec3.Vec3
+	Color     vec3.Vec3
+}
+
+func (l PointLight) Illuminate(p vec3.Vec3) (vec3.Vec3, float64, vec3.Vec3) {
+	direction, distance := towards(p, l.P)
+	return direction, distance, vec3.Scale(vec3.Mul(l.Intensity, l.Color), 1/distance)
+}
+
+
+// spot light, a point light shining in a cone
+// full intensity up to Falloff degrees from the axis, fading to zero at Angle degrees
+type SpotLight struct {
+	P         vec3.Vec3
+	Direction vec3.Vec3
+	Angle     float64
+	Falloff   float64
+	Intensity vec3.Vec3
+	Color     vec3.Vec3
+	Gobo      Texture // optional, projected over the cone (like a slide)
+}
+
+func (l SpotLight) Illuminate(p vec3.Vec3) (vec3.Vec3, float64, vec3.Vec3) {
+	direction, distance := towards(p, l.P)
+	axis := vec3.Norm(l.Direction)
+	out := vec3.Scale(direction, -1)
+	cosine := vec3.Dot(out, axis)
+	cosOuter := math.Cos(l.Angle * math.Pi / 180)
+	cosInner := math.Cos(l.Falloff * math.Pi / 180)
+	if cosine <= cosOuter {
+		return direction, distance, vec3.New(0, 0, 0)
+	}
+	intensity := vec3.Scale(vec3.Mul(l.Intensity, l.Color), smoothstep(cosOuter, cosInner, cosine)/distance)
+
+	if l.Gobo != nil {
+		// project onto the plane at unit distance, the cone maps to [0, 1]^2
+		u, v := orthonormalBasis(axis)
+		r := math.Tan(l.Angle * math.Pi / 180)
+		s := vec3.Scale(out, 1/cosine)
+		x := 0.5 + vec3.Dot(s, u)/(2*r)
+		y := 0.5 + vec3.Dot(s, v)/(2*r)
+		intensity = vec3.Mul(intensity, l.Gobo.Value(x, y, p))
+	}
+	return direction, distance, intensity
+}
+
+
+// directional light, infinitely far away (e.g. the sun)
+type DirectionalLight struct {
+	Direction vec3.Vec3 // in which the light travels
+	Intensity vec3.Vec3
+	Color     vec3.Vec3
+}
+
+func (l DirectionalLight) Illuminate(p vec3.Vec3) (vec3.Vec3, float64, vec3.Vec3) {
+	return vec3.Norm(vec3.Scale(l.Direction, -1)), MAXFLOAT, vec3.Mul(l.Intensity, l.Color)
+}
+
+
+// photometric data of a luminaire (IES LM-63), candela per direction
+type IESProfile struct {
+	Vertical   []float64   // degrees, 0 is straight down
+	Horizontal []float64   // degrees
+	Candela    [][]float64 // per horizontal angle, per vertical angle
+	Max        float64
+}
+
+func loadIESProfile(filename string) (*IESProfile, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	profile, err := parseIES(string(contents))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	fmt.Printf("Loaded IES profile `%s`\n", filename)
+	return profile, nil
+}
+
+func parseIES(text string) (*IESProfile, error) {
+	lines := strings.Split(strings.Replace(text, "\r", "", -1), "\n")
+	i := 0
+	for ; i < len(lines); i++ {
+		if strings.HasPrefix(strings.TrimSpace(lines[i]), "TILT=") {
+			break
+		}
+	}
+	if i == len(lines) {
+		return nil, fmt.Errorf("missing TILT line")
+	}
+	if strings.TrimSpace(lines[i]) != "TILT=NONE" {
+		return nil, fmt.Errorf("only TILT=NONE is supported")
+	}
+
+	var numbers []float64
+	for _, field := range strings.Fields(strings.Join(lines[i+1:], " ")) {
+		n, err := strconv.ParseFloat(strings.TrimSuffix(field, ","), 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number `%s`", field)
+		}
+		numbers = append(numbers, n)
+	}
+	if len(numbers) < 13 {
+		return nil, fmt.Errorf("truncated header")
+	}
+	multiplier := numbers[2]
+	nv, nh := int(numbers[3]), int(numbers[4])
+	if numbers[5] != 1 {
+		return nil, fmt.Errorf("only type C photometry is supported")
+	}
+	ballast := numbers[10]
+	numbers = numbers[13:]
+	if nv < 1 || nh < 1 || nv > len(numbers) || nh > len(numbers) || len(numbers) < nv+nh+nv*nh {
+		return nil, fmt.Errorf("truncated candela values")
+	}
+
+	p := &IESProfile{
+		Vertical:   numbers[:nv],
+		Horizontal: numbers[nv : nv+nh],
+		Candela:    make([][]float64, nh),
+	}
+	numbers = numbers[nv+nh:]
+	for h := 0; h < nh; h++ {
+		p.Candela[h] = make([]float64, nv)
+		for v := 0; v < nv; v++ {
+			p.Candela[h][v] = numbers[h*nv+v] * multiplier * ballast
+			p.Max = math.Max(p.Max, p.Candela[h][v])
+		}
+	}
+	return p, nil
+}
+
+// linear interpolation in a sorted table of angles, returns the lower index and the weight of the next one
+func angleIndex(angles []float64, a float64) (int, float64) {
+	if len(angles) == 1 || a <= angles[0] {
+		return 0, 0
+	}
+	if a >= angles[len(angles)-1] {
+		return len(angles) - 2, 1
+	}
+	i := sort.SearchFloat64s(angles, a) - 1
+	if i < 0 {
+		i = 0
+	}
+	return i, (a - angles[i]) / (angles[i+1] - angles[i])
+}
+
+func (p *IESProfile) lookup(h, v int, f float64) float64 {
+	if f == 0 || v+1 >= len(p.Vertical) {
+		return p.Candela[h][v]
+	}
+	return p.Candela[h][v]*(1-f) + p.Candela[h][v+1]*f
+}
+
+// candela at vertical angle theta and horizontal angle phi (degrees)
+func (p *IESProfile) Intensity(theta, phi float64) float64 {
+	// the horizontal angles only cover part of the circle when the luminaire is symmetric
+	last := p.Horizontal[len(p.Horizontal)-1]
+	phi = math.Mod(phi, 360)
+	if phi < 0 {
+		phi += 360
+	}
+	switch {
+	case len(p.Horizontal) == 1:
+		phi = 0
+	case last == 90:
+		phi = math.Mod(phi, 180)
+		if phi > 90 {
+			phi = 180 - phi
+		}
+	case last == 180:
+		if phi > 180 {
+			phi = 360 - phi
+		}
+	}
+
+	if theta < p.Vertical[0] || theta > p.Vertical[len(p.Vertical)-1] {
+		return 0
+	}
+	v, fv := angleIndex(p.Vertical, theta)
+	h, fh := angleIndex(p.Horizontal, phi)
+	c := p.lookup(h, v, fv)
+	if fh > 0 && h+1 < len(p.Horizontal) {
+		c = c*(1-fh) + p.lookup(h+1, v, fv)*fh
+	}
+	return c
+}
+
+
+// light shaped by an IES profile, the profile's nadir points along Down
+type IESLight struct {
+	P       vec3.Vec3
+	Down    vec3.Vec3
+	Profile *IESProfile
+	Scale   float64 // candela to scene units
+	Color   vec3.Vec3
+}
+
+func (l IESLight) Illuminate(p vec3.Vec3) (vec3.Vec3, float64, vec3.Vec3) {
+	direction, distance := towards(p, l.P)
+	down := vec3.Norm(l.Down)
+	u, v := orthonormalBasis(down)
+	out := vec3.Scale(direction, -1)
+	theta := math.Acos(math.Max(-1, math.Min(1, vec3.Dot(out, down)))) * 180 / math.Pi
+	phi := math.Atan2(vec3.Dot(out, v), vec3.Dot(out, u)) * 180 / math.Pi
+	candela := l.Profile.Intensity(theta, phi)
+	return direction, distance, vec3.Scale(l.Color, candela*l.Scale/distance)
+}
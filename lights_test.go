@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+)
+
+const iesHeader = "IESNA:LM-63-2002\n[TEST] test\nTILT=NONE\n"
+
+func TestParseIES(t *testing.T) {
+	// two vertical and two horizontal angles, multiplier 2 and ballast factor 0.5
+	p, err := parseIES(iesHeader + "1 1000 2 2 2 1 2 0 0 0\r\n0.5 1 100\n0 90\n0, 180\n100 50\n300 0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Vertical) != 2 || len(p.Horizontal) != 2 || p.Horizontal[1] != 180 {
+		t.Fatalf("angles %v and %v", p.Vertical, p.Horizontal)
+	}
+	if p.Candela[0][0] != 100 || p.Candela[0][1] != 50 || p.Candela[1][0] != 300 || p.Max != 300 {
+		t.Errorf("candela %v, max %g", p.Candela, p.Max)
+	}
+}
+
+func TestParseIESRejectsBadInput(t *testing.T) {
+	bad := map[string]string{
+		"empty":            "",
+		"missing tilt":     "IESNA:LM-63-2002\n1 1000 1 1 1 1 2 0 0 0\n1 1 100\n0\n0\n1000\n",
+		"tilt file":        "IESNA:LM-63-2002\nTILT=lamp.tlt\n",
+		"bad number":       iesHeader + "1 1000 1 1 1 1 2 0 0 x\n",
+		"truncated header": iesHeader + "1 1000 1 1 1 1 2 0 0 0\n1 1\n",
+		"type a":           iesHeader + "1 1000 1 1 1 3 2 0 0 0\n1 1 100\n0\n0\n1000\n",
+		"no angles":        iesHeader + "1 1000 1 0 1 1 2 0 0 0\n1 1 100\n0\n",
+		"truncated values": iesHeader + "1 1000 1 7 1 1 2 0 0 0\n1 1 100\n0 15 30 45 60 75 90\n0\n1000 950\n",
+		"huge counts":      iesHeader + "1 1000 1 4611686018427387904 4611686018427387904 1 2 0 0 0\n1 1 100\n0\n0\n1000\n",
+	}
+	for name, text := range bad {
+		if _, err := parseIES(text); err == nil {
+			t.Errorf("%s: parsed without an error", name)
+		}
+	}
+}
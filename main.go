@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"image"
 	"image/color"
 	"image/png"
+	"io/ioutil"
 	"math"
-	"math/rand"
 	"os"
+	"runtime"
+	"strings"
 	"sync"
 
 	"./vec3"
@@ -16,121 +20,381 @@ import (
 // Simple raytracer implementation, based on the tutorial found at
 // http://www.realtimerendering.com/raytracing/Ray%20Tracing%20in%20a%20Weekend.pdf
 
-// comment out a setup scene (may take several seconds to execute)
-// arguments: width and height of picture + number of samples for antialiasing
+// choose a setup scene with -setup (may take several seconds to execute)
+// -width and -height of picture + -samples for antialiasing
 // lower values = faster execution, higher values = more polished result
+//
+//	1  sample scene                      7  smoke, fog and colored glass
+//	2  awesome scene                     8  voxel grid volume (-input smoke.vxgr)
+//	3  triangle scene                    9  environment map (-input environment.hdr)
+//	4  STL model (-input elephant.stl)  10  awesome scene under a physical sky
+//	5  terrain (-input heightmap.png)   11  spot, directional and IES lights (-input light.ies)
+//	6  motion blur                      12  turntable of an STL model (-input elephant.stl), turntable.gif
+//
+// or render a scene file with -scene scene.json (see SceneFile), its frames with -frames
+// if it is animated (see Track)
+//
+// `denoise image.exr` filters a render saved with -aov-format exr instead (see denoiseCommand)
+// `serve` renders scene files sent over HTTP (see serveCommand)
+// `worker` renders tiles for -workers (see renderDistributed)
 func main() {
-	//setup1(400, 200, 100)
-	setup2(500, 500, 50)
-	//setup3(300, 300, 50)
-	//setup4(200, 200, 5, "elephant.stl")
-	//setup4(200, 200, 5, "tyranitar.stl")
+	if len(os.Args) > 1 {
+		commands := map[string]func([]string) error{"denoise": denoiseCommand, "serve": serveCommand, "worker": workerCommand}
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	setup := flag.Int("setup", 2, "scene to render (1-12)")
+	nx := flag.Int("width", 500, "width of the picture")
+	ny := flag.Int("height", 500, "height of the picture")
+	ns := flag.Int("samples", 50, "samples per pixel")
+	sceneFile := flag.String("scene", "", "render a scene file (JSON, see SceneFile) instead of a setup")
+	input := flag.String("input", "", "file used by the scene (model, heightmap, grid, environment map, IES profile)")
+	texture := flag.String("texture", "", "image the terrain of setup 5 is colored with")
+	flag.StringVar(&SAMPLER, "sampler", SAMPLER, "independent, stratified, halton, sobol or bluenoise")
+	flag.StringVar(&FILTER, "filter", FILTER, "pixel filter: box, tent, gaussian, mitchell or lanczos")
+	flag.IntVar(&PROGRESSIVE.Passes, "passes", 0, "progressive rendering: passes of -samples each, saving the image and a checkpoint after every pass")
+	flag.StringVar(&PROGRESSIVE.Checkpoint, "checkpoint", PROGRESSIVE.Checkpoint, "progressive rendering: checkpoint file")
+	flag.BoolVar(&PROGRESSIVE.Resume, "resume", false, "progressive rendering: continue from the checkpoint, adding -passes more passes")
+	flag.BoolVar(&BENCHMARK, "benchmark", false, "print the error of every sampler for 1 to -samples samples per pixel")
+	flag.Float64Var(&ADAPTIVE.Threshold, "adaptive", 0, "adaptive sampling: relative error at which pixels stop (e.g. 0.02), 0 for off")
+	flag.IntVar(&ADAPTIVE.MaxSamples, "max-samples", 0, "adaptive sampling: most samples per pixel (default 4 times -samples)")
+	flag.StringVar(&ADAPTIVE.Heatmap, "heatmap", "", "write the samples taken per pixel to this image (numbered like the frames of animations)")
+	flag.StringVar(&CAMERA.Kind, "camera", CAMERA.Kind, "pinhole, orthographic, fisheye, equirectangular, cubemap or physical")
+	flag.Float64Var(&CAMERA.FOV, "fov", 0, "field of view in degrees, overrides the scene's (fisheye defaults to 180)")
+	flag.Float64Var(&CAMERA.FocalLength, "focal", 0, "physical camera: focal length in mm (default matches the field of view)")
+	flag.Float64Var(&CAMERA.SensorWidth, "sensor", CAMERA.SensorWidth, "physical camera: sensor width in mm")
+	flag.Float64Var(&CAMERA.FNumber, "fstop", CAMERA.FNumber, "physical camera: f-number")
+	flag.Float64Var(&CAMERA.ShutterSpeed, "shutter", CAMERA.ShutterSpeed, "physical camera: shutter speed in seconds")
+	flag.Float64Var(&CAMERA.ISO, "iso", CAMERA.ISO, "physical camera: ISO sensitivity")
+	flag.IntVar(&CAMERA.Blades, "blades", 0, "physical camera: aperture blades (0 for a round aperture)")
+	flag.StringVar(&CAMERA.Aperture, "aperture", "", "physical camera: image of the aperture shape")
+	flag.StringVar(&CAMERA.Stereo, "stereo", "", "stereo layout: side-by-side, top-bottom or anaglyph (pinhole and equirectangular cameras)")
+	flag.Float64Var(&CAMERA.Interaxial, "interaxial", CAMERA.Interaxial, "stereo: distance between the eyes")
+	flag.Float64Var(&CAMERA.Convergence, "convergence", 0, "stereo: distance at which the views meet (default lookAt)")
+	flag.StringVar(&CAMERA.Focus, "focus", "", "physical camera: `auto` (image center), a distance or a point x,y,z (default lookAt)")
+	flag.StringVar(&INTEGRATOR.Kind, "integrator", INTEGRATOR.Kind, "path, photon (photon mapping, for caustics), bdpt (bidirectional path tracing, for indoor scenes), ao (ambient occlusion) or whitted (recursive ray tracing)")
+	flag.IntVar(&INTEGRATOR.Photons, "photons", INTEGRATOR.Photons, "photon mapping: photons emitted for the global map")
+	flag.IntVar(&INTEGRATOR.CausticPhotons, "caustic-photons", INTEGRATOR.CausticPhotons, "photon mapping: photons emitted towards mirrors and glass for the caustic map")
+	flag.IntVar(&INTEGRATOR.Nearest, "photon-nearest", INTEGRATOR.Nearest, "photon mapping: photons per radiance estimate")
+	flag.IntVar(&INTEGRATOR.Depth, "bdpt-depth", INTEGRATOR.Depth, "bidirectional path tracing: longest paths, in bounces")
+	flag.Float64Var(&INTEGRATOR.AORadius, "ao-radius", INTEGRATOR.AORadius, "ambient occlusion: how far surfaces occlude (default a fifth of the scene's size)")
+	flag.IntVar(&INTEGRATOR.AOSamples, "ao-samples", INTEGRATOR.AOSamples, "ambient occlusion: rays per camera ray")
+	flag.BoolVar(&PREVIEW.Enabled, "preview", false, "preview in the terminal first, changing the view with the keyboard")
+	flag.IntVar(&PREVIEW.Samples, "preview-samples", PREVIEW.Samples, "samples per pixel the terminal preview stops at")
+	workers := flag.String("workers", "", "render the -scene on these worker processes (comma separated host:port)")
+	flag.DurationVar(&DISTRIBUTED.Timeout, "worker-timeout", DISTRIBUTED.Timeout, "time a worker may take for a tile before its tiles go to the others")
+	aovs := flag.String("aovs", "", "extra passes, comma separated or `all`: "+strings.Join(aovNames[:], ", "))
+	flag.StringVar(&AOVS.Format, "aov-format", AOVS.Format, "png (output_<pass>.png) or exr (layers of output.exr)")
+	flag.StringVar(&OUTPUT, "output", OUTPUT, "image to write (its passes are named after it)")
+	flag.StringVar(&ANIMATION.Frames, "frames", "", "animation: frames of the -scene to render, `first-last` (default the scene file's)")
+	flag.StringVar(&ANIMATION.Output, "frame-output", ANIMATION.Output, "animation: images of the frames, with the frame number as a printf verb")
+	flag.StringVar(&ANIMATION.Movie, "movie", "", "animation: write the frames to one animated GIF (.gif) or APNG (.png) instead")
+	flag.Float64Var(&ANIMATION.FPS, "fps", ANIMATION.FPS, "animation: frames per second of the -movie")
+	flag.BoolVar(&ANIMATION.Dither, "dither", ANIMATION.Dither, "animation: dither the colors of GIF movies")
+	flag.BoolVar(&DENOISE.Enabled, "denoise", false, "denoise output.png, guided by the albedo, normal and depth passes")
+	DENOISE.AddFlags(flag.CommandLine)
+	flag.Parse()
+	if err := AOVS.Parse(*aovs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	inputOr := func(filename string) string {
+		if *input != "" {
+			return *input
+		}
+		return filename
+	}
+	PROGRESSIVE.Scene = fmt.Sprint(*setup, " ", *input)
+	for _, filename := range []string{*input, *texture} {
+		if filename == "" {
+			continue
+		}
+		if contents, err := ioutil.ReadFile(filename); err == nil {
+			PROGRESSIVE.Scene += fmt.Sprintf(" %x", hashBytes(contents))
+		}
+	}
+	if *workers != "" {
+		if *sceneFile == "" || renderAOVs() || PROGRESSIVE.Passes > 0 || ADAPTIVE.Threshold > 0 {
+			fmt.Fprintln(os.Stderr, "-workers only renders -scene files (not with -aovs, -denoise, -passes or -adaptive)")
+			os.Exit(2)
+		}
+		DISTRIBUTED.Workers = strings.Split(*workers, ",")
+	}
+	if ANIMATION.Frames != "" && *sceneFile == "" && *setup != 12 {
+		fmt.Fprintln(os.Stderr, "-frames only renders -scene files and the turntable")
+		os.Exit(2)
+	}
+	if ANIMATION.Movie != "" {
+		if _, err := movieFormat(ANIMATION.Movie); err != nil || ANIMATION.FPS <= 0 {
+			fmt.Fprintln(os.Stderr, "-movie has to be a .gif or .png and -fps positive")
+			os.Exit(2)
+		}
+	}
+	if *sceneFile != "" {
+		if contents, err := ioutil.ReadFile(*sceneFile); err == nil {
+			PROGRESSIVE.Scene = fmt.Sprintf("scene %x", hashBytes(contents))
+			DISTRIBUTED.Scene = contents
+		}
+		setupFile(*nx, *ny, *ns, *sceneFile)
+		return
+	}
+	switch *setup {
+	case 1:
+		setup1(*nx, *ny, *ns)
+	case 2:
+		setup2(*nx, *ny, *ns)
+	case 3:
+		setup3(*nx, *ny, *ns)
+	case 4:
+		setup4(*nx, *ny, *ns, inputOr("elephant.stl"))
+	case 5:
+		setup5(*nx, *ny, *ns, inputOr("heightmap.png"), *texture)
+	case 6:
+		setup6(*nx, *ny, *ns)
+	case 7:
+		setup7(*nx, *ny, *ns)
+	case 8:
+		setup8(*nx, *ny, *ns, inputOr("smoke.vxgr"))
+	case 9:
+		setup9(*nx, *ny, *ns, inputOr("environment.hdr"))
+	case 10:
+		setup10(*nx, *ny, *ns)
+	case 11:
+		setup11(*nx, *ny, *ns, *input)
+	case 12:
+		setup12(*nx, *ny, *ns, inputOr("elephant.stl"))
+	default:
+		fmt.Fprintf(os.Stderr, "unknown setup %d\n", *setup)
+		os.Exit(2)
+	}
 }
 
 const MAXFLOAT = 999999.99
 
-var BACKGROUND_COLOR vec3.Vec3
+// which camera renders the scenes
+type CameraSettings struct {
+	Kind string
+	FOV  float64 // degrees, zero to keep the scene's
+
+	// physical camera
+	FocalLength  float64 // mm, zero to match the field of view
+	SensorWidth  float64 // mm, the height follows from the aspect ratio
+	FNumber      float64
+	ShutterSpeed float64 // seconds
+	ISO          float64
+	Blades       int
+	Aperture     string // image file
+	Focus        string
+
+	// stereo
+	Stereo      string // layout, empty for a single view
+	Interaxial  float64
+	Convergence float64 // zero for the distance to lookAt
+}
+
+// how the samples of a pixel are spread out (see newSampler)
+var SAMPLER = "sobol"
+
+// pixel reconstruction filter (see newFilter)
+var FILTER = "box"
+
+// compare the samplers instead of rendering
+var BENCHMARK = false
+
+// the rendered image
+var OUTPUT = "output.png"
 
-// point light
-type Light struct {
-	P         vec3.Vec3
-	Intensity vec3.Vec3
-	Color     vec3.Vec3
+// the physical camera defaults to a full frame sensor exposed for the scenes' brightness
+var CAMERA = CameraSettings{Kind: "pinhole", SensorWidth: 36, FNumber: 2.8, ShutterSpeed: 1.0 / 3200, ISO: 100, Interaxial: 0.065}
+
+// everything that is rendered
+type Scene struct {
+	World       HitableList
+	Lights      []Light
+	Background  vec3.Vec3
+	Environment Environment // replaces the background if set
+	Volumes     []Volume    // fog, clouds, ...
+	Objects     []Hitable   // top-level objects by ID minus one (see tagObjects)
+	Integrator  Integrator  // path tracing if not set
 }
 
 // the actual ray tracing happens here
-func pixel(ray Ray, lights []Light, world HitableList, depth int) vec3.Vec3 {
+// skipEnvironment is set when the environment light was already sampled directly
+// at the previous hit, so it is not counted twice when the scattered ray escapes
+func pixel(ray Ray, scene *Scene, sampler Sampler, depth int, skipEnvironment bool) vec3.Vec3 {
 	record := HitRecord{}
-	if world.Hit(ray, 0.001, MAXFLOAT, &record) {
-		// comment out to see normal map
-		//x, y, z := record.Normal.X, record.Normal.Y, record.Normal.Z
-		//return vec3.Scale(vec3.New(x+1, y+1, z+1), 0.5)
-
-		attenuation := vec3.New(0.0, 0.0, 0.0)
-		var current vec3.Vec3
-		rayOut := Ray{}
-		if depth < 10 && record.Material.Scatter(ray, record, &attenuation, &rayOut) {
-			//return vec3.Mul(pixel(rayOut, lights, world, depth+1), attenuation)
-			current = vec3.Mul(pixel(rayOut, lights, world, depth+1), attenuation)
-		}
-
-		for _, light := range lights {
-			if _, ok := record.Material.(Dielectric); ok {
-				continue
-			}
-			shadowRay := Ray{record.P, vec3.Sub(light.P, record.P)}
-			rec := HitRecord{}
-			if world.Hit(shadowRay, 0.001, MAXFLOAT, &rec) {
-				if vec3.LenSq(vec3.Sub(light.P, shadowRay.A)) > vec3.LenSq(vec3.Sub(rec.P, shadowRay.A)) {
-					continue
-				}
-			}
-			var albedo vec3.Vec3
-			switch m := record.Material.(type) {
-			case Lambertian:
-				albedo = m.Albedo
-			case Metal:
-				albedo = m.Albedo
-			}
-			d := vec3.Dot(record.Normal, shadowRay.Direction()) / vec3.LenSq(vec3.Sub(light.P, shadowRay.A))
-			if d < 0 {
-				d = 0
-			}
+	if intersect(ray, scene, &record) {
+		emitted, direct, indirect := shade(ray, record, scene, sampler, depth)
+		return vec3.Add(emitted, vec3.Add(direct, indirect))
+	}
+	return background(ray, scene, skipEnvironment)
+}
 
-			res := vec3.Scale(vec3.Mul(vec3.Mul(albedo, light.Intensity), light.Color), d)
-			current = vec3.Add(current, res)
-			if current.X > 1 {
-				current.X = 1.0
-			}
-			if current.Y > 1 {
-				current.Y = 1.0
-			}
-			if current.Z > 1 {
-				current.Z = 1.0
-			}
+// closest surface or scattering event in a volume along the ray
+func intersect(ray Ray, scene *Scene, record *HitRecord) bool {
+	hit := scene.World.Hit(ray, 0.001, MAXFLOAT, record)
+	for _, volume := range scene.Volumes {
+		tMax := MAXFLOAT
+		if hit {
+			tMax = record.T
 		}
-		return current
-		//return vec3.New(0.0, 0.0, 0.0)
+		if volume.Sample(ray, 0.001, tMax, record) {
+			hit = true
+			record.Object = 0
+		}
+	}
+	return hit
+}
+
+// light leaving a hit point towards the ray's origin: emitted by the material itself,
+// arriving directly from the lights and the environment, and arriving after scattering
+func shade(ray Ray, record HitRecord, scene *Scene, sampler Sampler, depth int) (vec3.Vec3, vec3.Vec3, vec3.Vec3) {
+	attenuation := vec3.New(0.0, 0.0, 0.0)
+	var emitted, indirect vec3.Vec3
+	if emitter, ok := record.Material.(Emitter); ok {
+		emitted = emitter.Emitted(record)
+	}
+	sampleEnvironment := scene.Environment != nil && diffuse(record.Material)
+	rayOut := Ray{Time: ray.Time}
+	sampler.SetDimension(scatterDimension(depth))
+	if depth < 10 && record.Material.Scatter(ray, record, &attenuation, &rayOut, sampler) {
+		indirect = vec3.Mul(pixel(rayOut, scene, sampler, depth+1, sampleEnvironment), attenuation)
+	}
+
+	direct := directLight(ray, record, scene, sampler, depth, vec3.Add(emitted, indirect))
+	return emitted, direct, indirect
+}
+
+// light arriving directly from the lights and the environment and leaving towards the ray's
+// origin, the lights add up to white at most (together with base, the rest of that light)
+func directLight(ray Ray, record HitRecord, scene *Scene, sampler Sampler, depth int, base vec3.Vec3) vec3.Vec3 {
+	current := base
+	for _, light := range scene.Lights {
+		if _, ok := record.Material.(Dielectric); ok {
+			continue
+		}
+		direction, distance, intensity := light.Illuminate(record.P)
+		albedo := materialAlbedo(record)
+		var d float64
+		if phase, ok := record.Material.(PhaseFunction); ok {
+			// relative to isotropic scattering, media have no orientation
+			d = 4 * math.Pi * phase.Phase(vec3.Dot(vec3.Norm(ray.Direction()), direction))
+		} else {
+			d = vec3.Dot(record.Normal, direction)
+		}
+		if d <= 0 {
+			continue
+		}
+		d *= visibility(scene, record.P, direction, distance, ray.Time)
+
+		res := vec3.Scale(vec3.Mul(albedo, intensity), d)
+		current = vec3.Add(current, res)
+		if current.X > 1 {
+			current.X = 1.0
+		}
+		if current.Y > 1 {
+			current.Y = 1.0
+		}
+		if current.Z > 1 {
+			current.Z = 1.0
+		}
+	}
+	// whatever the lights added (after clamping)
+	direct := vec3.Sub(current, base)
+	if scene.Environment != nil && diffuse(record.Material) {
+		sampler.SetDimension(lightDimension(depth))
+		direct = vec3.Add(direct, directEnvironment(ray, record, scene, sampler))
+	}
+	return direct
+}
+
+// what a ray leaving the scene sees
+func background(ray Ray, scene *Scene, skipEnvironment bool) vec3.Vec3 {
+	if scene.Environment != nil {
+		if skipEnvironment {
+			return vec3.New(0.0, 0.0, 0.0)
+		}
+		return scene.Environment.Radiance(ray.Direction())
 	}
 
-	// background
 	//unitDirection := vec3.Norm(ray.Direction())
 	//t := 0.5 * (unitDirection.Y + 1.0)
 	//from := vec3.New(0.0, 0.0, 0.0)
 	//to := vec3.New(0, 0, 0)
 	//from := vec3.New(1.0, 1.0, 1.0)
 	//to := vec3.New(0.5, 0.7, 1.0)
-	return BACKGROUND_COLOR //vec3.Add(vec3.Scale(from, 1.0-t), vec3.Scale(to, t))
+	return scene.Background //vec3.Add(vec3.Scale(from, 1.0-t), vec3.Scale(to, t))
 }
 
-func setup1(nx, ny, ns int) {
-	BACKGROUND_COLOR = vec3.New(0.6, 0.8, 1.0)
+// shadow ray query: fraction of the light reaching p from the given (normalized)
+// direction and distance, zero if blocked and less than one through volumes
+func visibility(scene *Scene, p, direction vec3.Vec3, distance float64, time float64) float64 {
+	shadowRay := Ray{p, direction, time}
+	rec := HitRecord{}
+	if scene.World.Hit(shadowRay, 0.001, distance, &rec) {
+		return 0
+	}
+	transmittance := 1.0
+	end := shadowRay.PointAtParameter(distance)
+	for _, volume := range scene.Volumes {
+		transmittance *= volume.Transmittance(p, end)
+	}
+	return transmittance
+}
 
+// next event estimation: light arriving directly from the environment
+// at a diffuse surface or inside a medium
+func directEnvironment(ray Ray, record HitRecord, scene *Scene, sampler Sampler) vec3.Vec3 {
+	direction, radiance, pdf := scene.Environment.Sample(sampler.Get2D())
+	if pdf == 0 {
+		return vec3.New(0.0, 0.0, 0.0)
+	}
+	var f float64
+	if phase, ok := record.Material.(PhaseFunction); ok {
+		f = phase.Phase(vec3.Dot(vec3.Norm(ray.Direction()), direction))
+	} else {
+		f = vec3.Dot(record.Normal, direction) / math.Pi
+	}
+	if f <= 0 {
+		return vec3.New(0.0, 0.0, 0.0)
+	}
+
+	f *= visibility(scene, record.P, direction, MAXFLOAT, ray.Time)
+	return vec3.Scale(vec3.Mul(materialAlbedo(record), radiance), f/pdf)
+}
+
+func setup1(nx, ny, ns int) {
 	var lookFrom, lookAt vec3.Vec3
 	var vfov float64
 	world, lights := createSampleScene(&lookFrom, &lookAt, &vfov)
+	scene := &Scene{World: world, Lights: lights, Background: vec3.New(0.6, 0.8, 1.0)}
 
-	setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, world, lights)
+	setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, scene)
 }
 
 func setup2(nx, ny, ns int) {
-	BACKGROUND_COLOR = vec3.New(0.6, 0.8, 1.0)
-
 	var lookFrom, lookAt vec3.Vec3
 	var vfov float64
 	world, lights := createAwesomeScene(&lookFrom, &lookAt, &vfov)
+	scene := &Scene{World: world, Lights: lights, Background: vec3.New(0.6, 0.8, 1.0)}
 
-	setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, world, lights)
+	setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, scene)
 }
 
 func setup3(nx, ny, ns int) {
-	BACKGROUND_COLOR = vec3.New(0.0, 0.0, 0.0)
-
 	var lookFrom, lookAt vec3.Vec3
 	var vfov float64
 	world, lights := createTriangleScene(&lookFrom, &lookAt, &vfov)
+	scene := &Scene{World: world, Lights: lights, Background: vec3.New(0.0, 0.0, 0.0)}
 
-	setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, world, lights)
+	setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, scene)
 }
 
 func setup4(nx, ny, ns int, filename string) {
@@ -140,8 +404,6 @@ func setup4(nx, ny, ns int, filename string) {
 	}
 	fmt.Printf("%d triangles\n", len(list))
 
-	BACKGROUND_COLOR = vec3.New(0.0, 0.0, 0.0)
-
 	var lookFrom, lookAt vec3.Vec3
 	var vfov float64
 	world, lights := createModelScene(&lookFrom, &lookAt, &vfov)
@@ -150,62 +412,594 @@ func setup4(nx, ny, ns int, filename string) {
 		world = append(world, tr)
 		index += 1
 	}
+	scene := &Scene{World: world, Lights: lights, Background: vec3.New(0.0, 0.0, 0.0)}
 
-	setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, world, lights)
+	setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, scene)
 }
 
-func setupExecute(nx, ny, ns int, lookFrom, lookAt vec3.Vec3, vfov float64, world HitableList, lights []Light) {
-	pixels := image.NewRGBA(image.Rect(0, 0, nx, ny))
+// terrain from a grayscale heightmap, optionally colored by an image texture
+func setup5(nx, ny, ns int, heightmap, texture string) {
+	var tex Texture = ConstantTexture{vec3.New(0.5, 0.45, 0.35)}
+	if texture != "" {
+		t, err := loadImageTexture(texture)
+		if err != nil {
+			panic(err)
+		}
+		tex = t
+	}
+	terrain, err := loadHeightfield(heightmap, vec3.New(-10, 0, -10), vec3.New(20, 3, 20), TexturedLambertian{tex})
+	if err != nil {
+		panic(err)
+	}
 
-	upVector := vec3.New(0, 1, 0)
-	aspect := float64(nx) / float64(ny)
-	camera := NewPinholeCamera(lookFrom, lookAt, upVector, vfov, aspect)
+	var lookFrom, lookAt vec3.Vec3
+	var vfov float64
+	world, lights := createTerrainScene(&lookFrom, &lookAt, &vfov)
+	world = append(world, terrain)
+	scene := &Scene{World: world, Lights: lights, Background: vec3.New(0.6, 0.8, 1.0)}
 
-	mutex := new(sync.Mutex)
-	wg := new(sync.WaitGroup)
-	for j := ny - 1; j >= 0; j-- {
-		wg.Add(1)
-		go raytracer(pixels, j, nx, ny, ns, mutex, wg, camera, world, lights)
+	setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, scene)
+}
+
+// motion blur
+func setup6(nx, ny, ns int) {
+	var lookFrom, lookAt vec3.Vec3
+	var vfov float64
+	world, lights := createMotionScene(&lookFrom, &lookAt, &vfov)
+	scene := &Scene{World: world, Lights: lights, Background: vec3.New(0.6, 0.8, 1.0)}
+
+	setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, scene)
+}
+
+// smoke, fog and colored glass
+func setup7(nx, ny, ns int) {
+	var lookFrom, lookAt vec3.Vec3
+	var vfov float64
+	world, lights := createFogScene(&lookFrom, &lookAt, &vfov)
+	scene := &Scene{World: world, Lights: lights, Background: vec3.New(0.6, 0.8, 1.0)}
+	scene.Volumes = append(scene.Volumes, &Atmosphere{
+		Density: 0.04,
+		Height:  1.0,
+		Phase:   HenyeyGreenstein{vec3.New(0.9, 0.9, 0.9), 0.3},
+	})
+
+	setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, scene)
+}
+
+// heterogeneous volume loaded from a voxel grid file
+func setup8(nx, ny, ns int, filename string) {
+	grid, err := loadVoxelGrid(filename)
+	if err != nil {
+		panic(err)
 	}
-	wg.Wait()
 
-	f, err := os.Create("output.png")
+	var lookFrom, lookAt vec3.Vec3
+	var vfov float64
+	world, lights := createVolumeScene(&lookFrom, &lookAt, &vfov)
+	scene := &Scene{World: world, Lights: lights, Background: vec3.New(0.05, 0.05, 0.08)}
+	scene.Volumes = append(scene.Volumes, &GridVolume{
+		Grid:          grid,
+		Box:           AABB{vec3.New(-1.5, 0, -1.5), vec3.New(1.5, 3, 1.5)},
+		DensityScale:  8.0,
+		Albedo:        vec3.New(0.8, 0.8, 0.8),
+		G:             0.2,
+		EmissionScale: 1.0,
+	})
+
+	setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, scene)
+}
+
+// the sample scene lit by an HDR environment map
+func setup9(nx, ny, ns int, filename string) {
+	environment, err := loadEnvironmentLight(filename, 0.0, 1.0)
 	if err != nil {
 		panic(err)
 	}
-	defer f.Close()
-	if err := png.Encode(f, pixels); err != nil {
+
+	var lookFrom, lookAt vec3.Vec3
+	var vfov float64
+	world, lights := createSampleScene(&lookFrom, &lookAt, &vfov)
+	scene := &Scene{World: world, Lights: lights, Environment: environment}
+
+	setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, scene)
+}
+
+// the awesome scene outdoors, under a physical sky in the late afternoon
+func setup10(nx, ny, ns int) {
+	var lookFrom, lookAt vec3.Vec3
+	var vfov float64
+	world, lights := createAwesomeScene(&lookFrom, &lookAt, &vfov)
+	scene := &Scene{World: world, Lights: lights}
+	scene.Environment = NewPhysicalSky(vec3.New(-1.0, 0.5, -0.6), 3.0, vec3.New(0.3, 0.3, 0.3), 0.05)
+
+	setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, scene)
+}
+
+// spot, directional and (if a profile is given) IES lights
+func setup11(nx, ny, ns int, iesFile string) {
+	var lookFrom, lookAt vec3.Vec3
+	var vfov float64
+	world, lights := createLightsScene(&lookFrom, &lookAt, &vfov)
+	if iesFile != "" {
+		profile, err := loadIESProfile(iesFile)
+		if err != nil {
+			panic(err)
+		}
+		lights = append(lights, IESLight{
+			P:       vec3.New(0.0, 3.5, -2.0),
+			Down:    vec3.New(0, -1, 0),
+			Profile: profile,
+			Scale:   4.0 / profile.Max,
+			Color:   vec3.New(1.0, 1.0, 1.0),
+		})
+	}
+	scene := &Scene{World: world, Lights: lights, Background: vec3.New(0.0, 0.0, 0.0)}
+
+	setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, scene)
+}
+
+// the camera circles the model once over the frames (-frames, by default 0-35),
+// written to turntable.gif unless there is another -movie
+func setup12(nx, ny, ns int, filename string) {
+	if err := animationModes(); err != nil {
+		panic(err)
+	}
+	model, err := loadBinarySTLModel(filename, vec3.New(0.8, 0.1, 0.6), 1.0, vec3.New(0, 0, 0))
+	if err != nil {
 		panic(err)
 	}
+	if len(model) == 0 {
+		panic(fmt.Errorf("`%s` has no triangles to turn", filename))
+	}
+	fmt.Printf("%d triangles\n", len(model))
+
+	var lookFrom, lookAt vec3.Vec3
+	var vfov float64
+	world, lights := createTurntableScene(model, &lookFrom, &lookAt, &vfov)
+	if ANIMATION.Movie == "" {
+		ANIMATION.Movie = "turntable.gif"
+	}
+	if err := renderTurntable(nx, ny, ns, world, lights, vec3.New(0.6, 0.8, 1.0), lookFrom, lookAt, vfov); err != nil {
+		panic(err)
+	}
+}
+
+// scene file, its size, samples, sampler, filter and camera settings replace the command line's
+func setupFile(nx, ny, ns int, filename string) {
+	f, err := loadSceneFile(filename)
+	if err != nil {
+		panic(err)
+	}
+	if f.Width > 0 {
+		nx = f.Width
+	}
+	if f.Height > 0 {
+		ny = f.Height
+	}
+	if f.Samples > 0 {
+		ns = f.Samples
+	}
+	if f.Sampler != "" {
+		SAMPLER = f.Sampler
+	}
+	if f.Filter != "" {
+		FILTER = f.Filter
+	}
+	CAMERA = f.Camera.CameraSettings
+	if f.Animation != nil || ANIMATION.Frames != "" {
+		if err := animationModes(); err != nil {
+			panic(fmt.Errorf("%s: %v", filename, err))
+		}
+		if err := renderAnimation(f, nx, ny, ns); err != nil {
+			panic(fmt.Errorf("%s: %v", filename, err))
+		}
+		return
+	}
+	scene, err := f.Build(nil)
+	if err != nil {
+		panic(fmt.Errorf("%s: %v", filename, err))
+	}
+
+	lookFrom, lookAt, vfov := f.View()
+	CAMERA = f.viewSettings(CAMERA, vfov)
+	setupExecute(nx, ny, ns, lookFrom, lookAt, vfov, scene)
+}
+
+func newCamera(settings CameraSettings, lookFrom, lookAt vec3.Vec3, vfov, aspect, shutterOpen, shutterClose float64, world Hitable) Camera {
+	upVector := vec3.New(0, 1, 0)
+	if settings.FOV != 0 {
+		vfov = settings.FOV
+	}
+	if settings.Stereo != "" {
+		return newStereoCamera(settings, lookFrom, lookAt, vfov, aspect, shutterOpen, shutterClose)
+	}
+	switch settings.Kind {
+	case "orthographic":
+		// same framing as the pinhole camera at the distance of lookAt
+		height := 2 * vec3.Len(vec3.Sub(lookAt, lookFrom)) * math.Tan(vfov*math.Pi/360)
+		c := NewOrthographicCamera(lookFrom, lookAt, upVector, height, aspect)
+		c.ShutterOpen, c.ShutterClose = shutterOpen, shutterClose
+		return c
+	case "fisheye":
+		if settings.FOV == 0 {
+			vfov = 180
+		}
+		c := NewFisheyeCamera(lookFrom, lookAt, upVector, vfov, aspect)
+		c.ShutterOpen, c.ShutterClose = shutterOpen, shutterClose
+		return c
+	case "equirectangular":
+		c := NewEquirectangularCamera(lookFrom, lookAt, upVector)
+		c.ShutterOpen, c.ShutterClose = shutterOpen, shutterClose
+		return c
+	case "cubemap":
+		c := NewCubeMapCamera(lookFrom)
+		c.ShutterOpen, c.ShutterClose = shutterOpen, shutterClose
+		return c
+	case "physical":
+		c, err := newPhysicalCamera(settings, lookFrom, lookAt, vfov, aspect, world)
+		if err != nil {
+			panic(err)
+		}
+		c.ShutterOpen = shutterOpen
+		return c
+	case "pinhole":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown camera `%s`, using pinhole\n", settings.Kind)
+	}
+	c := NewPinholeCamera(lookFrom, lookAt, upVector, vfov, aspect)
+	c.ShutterOpen, c.ShutterClose = shutterOpen, shutterClose
+	return c
 }
 
-func raytracer(pixels *image.RGBA, j, nx, ny, ns int, mutex *sync.Mutex, wg *sync.WaitGroup, camera PinholeCamera, world HitableList, lights []Light) {
-	cs := make([]color.RGBA, nx)
-	for i := 0; i < nx; i++ {
-		// antialiasing (average of `ns` samples per pixel)
-		col := vec3.New(0, 0, 0)
-		for s := 0; s < ns; s++ {
-			u := (float64(i) + rand.Float64()) / float64(nx)
-			v := (float64(j) + rand.Float64()) / float64(ny)
+func newStereoCamera(settings CameraSettings, lookFrom, lookAt vec3.Vec3, vfov, aspect, shutterOpen, shutterClose float64) Camera {
+	upVector := vec3.New(0, 1, 0)
+	switch settings.Stereo {
+	case SideBySide, TopBottom, Anaglyph:
+	default:
+		fmt.Fprintf(os.Stderr, "unknown stereo layout `%s`, using %s\n", settings.Stereo, SideBySide)
+		settings.Stereo = SideBySide
+	}
+	if settings.Kind == "equirectangular" {
+		left, right := NewODSCameras(lookFrom, lookAt, upVector, settings.Interaxial)
+		left.ShutterOpen, left.ShutterClose = shutterOpen, shutterClose
+		right.ShutterOpen, right.ShutterClose = shutterOpen, shutterClose
+		return StereoCamera{left, right, settings.Stereo}
+	}
+	if settings.Kind != "pinhole" {
+		fmt.Fprintf(os.Stderr, "stereo needs a pinhole or equirectangular camera, using pinhole\n")
+	}
+	convergence := settings.Convergence
+	if convergence == 0 {
+		convergence = vec3.Len(vec3.Sub(lookAt, lookFrom))
+	}
+	left, right := NewStereoPinholeCameras(lookFrom, lookAt, upVector, vfov, eyeAspect(settings.Stereo, aspect),
+		settings.Interaxial, convergence)
+	left.ShutterOpen, left.ShutterClose = shutterOpen, shutterClose
+	right.ShutterOpen, right.ShutterClose = shutterOpen, shutterClose
+	return StereoCamera{left, right, settings.Stereo}
+}
+
+func newPhysicalCamera(settings CameraSettings, lookFrom, lookAt vec3.Vec3, vfov, aspect float64, world Hitable) (*PhysicalCamera, error) {
+	sensorHeight := settings.SensorWidth / aspect
+	focalLength := settings.FocalLength
+	if focalLength == 0 {
+		focalLength = focalLengthForFOV(vfov, sensorHeight)
+	}
+	c := NewPhysicalCamera(lookFrom, lookAt, vec3.New(0, 1, 0), focalLength, settings.SensorWidth, sensorHeight,
+		settings.FNumber, settings.ShutterSpeed, settings.ISO)
 
-			ray := camera.GetRay(u, v)
-			col = vec3.Add(col, pixel(ray, lights, world, 0))
+	if settings.Aperture != "" {
+		aperture, err := loadTexturedAperture(settings.Aperture)
+		if err != nil {
+			return nil, err
 		}
-		col = vec3.Scale(col, 1.0/float64(ns))
-		col = vec3.New(math.Sqrt(col.X), math.Sqrt(col.Y), math.Sqrt(col.Z))
+		c.Aperture = aperture
+	} else if settings.Blades > 0 {
+		c.Aperture = PolygonalAperture{Blades: settings.Blades, Rotation: 90}
+	}
 
-		c := color.RGBA{
-			uint8(255 * col.X),
-			uint8(255 * col.Y),
-			uint8(255 * col.Z),
-			255,
+	var x, y, z float64
+	switch {
+	case settings.Focus == "":
+	case settings.Focus == "auto":
+		if !c.Autofocus(world, 0.5, 0.5) {
+			fmt.Fprintf(os.Stderr, "autofocus found nothing at the image center\n")
+		}
+	default:
+		if n, _ := fmt.Sscanf(settings.Focus, "%g,%g,%g", &x, &y, &z); n == 3 {
+			c.FocusOn(vec3.New(x, y, z))
+		} else if n == 1 {
+			c.FocusDistance = x
+		} else {
+			return nil, fmt.Errorf("bad focus `%s`", settings.Focus)
 		}
-		cs[i] = c
 	}
-	mutex.Lock()
-	for i := 0; i < nx; i++ {
-		pixels.SetRGBA(i, ny-1-j, cs[i])
+	fmt.Printf("Physical camera: %.0fmm f/%.1f 1/%.0fs ISO %.0f, focused at %.2f\n",
+		c.FocalLength, c.FNumber, 1/c.ShutterSpeed, c.ISO, c.FocusDistance)
+	return c, nil
+}
+
+func setupExecute(nx, ny, ns int, lookFrom, lookAt vec3.Vec3, vfov float64, scene *Scene) {
+	width := filmWidth(CAMERA, nx)
+	camera := prepareScene(scene, CAMERA, lookFrom, lookAt, vfov, width, ny)
+	var err error
+	if scene.Integrator, err = newIntegrator(INTEGRATOR, scene); err != nil {
+		panic(err)
+	}
+	if PREVIEW.Enabled {
+		var ok bool
+		var err error
+		lookFrom, lookAt, ok, err = terminalPreview(scene, lookFrom, lookAt, vfov, width, ny)
+		if err != nil {
+			panic(err)
+		}
+		if !ok {
+			return
+		}
+		fmt.Printf("Rendering the view from %v to %v\n", lookFrom, lookAt)
+		camera = newCamera(CAMERA, lookFrom, lookAt, vfov, float64(width)/float64(ny), 0.0, 1.0, scene.World)
+	}
+	if BENCHMARK {
+		benchmarkSamplers(width, ny, ns, camera, scene)
+		return
+	}
+	if PROGRESSIVE.Passes > 0 {
+		view := fmt.Sprint(lookFrom, lookAt, vfov)
+		if err := renderProgressive(width, ny, ns, camera, scene, view); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	// the frames of animations get different noise, it flickers less than noise that stays put
+	seed := int64(ANIMATION.Frame)
+	var film *Film
+	if len(DISTRIBUTED.Workers) > 0 {
+		var err error
+		if film, err = renderDistributed(width, ny, ns, SAMPLER, seed); err != nil {
+			panic(err)
+		}
+	} else {
+		film = renderFilm(width, ny, ns, camera, scene, SAMPLER, seed)
+	}
+	if ADAPTIVE.Threshold > 0 {
+		total := 0
+		for _, c := range film.Counts {
+			total += c
+		}
+		fmt.Printf("%.1f samples per pixel on average\n", float64(total)/float64(len(film.Counts)))
+	}
+	if err := saveOutput(film, camera); err != nil {
+		panic(err)
+	}
+}
+
+// width of the film for an image nx pixels wide
+func filmWidth(settings CameraSettings, nx int) int {
+	if settings.Stereo == Anaglyph {
+		// both views side by side, combined after rendering
+		return 2 * nx
+	}
+	return nx
+}
+
+// builds the scene's hierarchy (tagging its objects first if passes are rendered)
+// and sets up the camera for a film of the given size
+func prepareScene(scene *Scene, settings CameraSettings, lookFrom, lookAt vec3.Vec3, vfov float64, width, ny int) Camera {
+	aspect := float64(width) / float64(ny)
+	if renderAOVs() {
+		tagObjects(scene)
+	}
+	// scenes animate their moving objects between time 0 and 1
+	scene.World = buildBVH(scene.World, 0.0, 1.0)
+	return newCamera(settings, lookFrom, lookAt, vfov, aspect, 0.0, 1.0, scene.World)
+}
+
+// writes OUTPUT (and the heatmap and passes if asked for), the EXR keeps the noisy image
+func saveOutput(film *Film, camera Camera) error {
+	nx, ny := film.Width, film.Height
+	buffer := film.Buffer()
+	if DENOISE.Enabled {
+		buffer = denoise(buffer, nx, ny, filmGuides(film), DENOISE)
+	}
+	img := finalImage(buffer, nx, ny, camera)
+	if ANIMATION.movie != nil {
+		ANIMATION.movie = append(ANIMATION.movie, img)
+	} else if err := savePNG(OUTPUT, img); err != nil {
+		return err
+	}
+	if ADAPTIVE.Heatmap != "" {
+		if err := savePNG(ADAPTIVE.Heatmap, heatmapImage(film.Counts, nx, ny)); err != nil {
+			return err
+		}
+	}
+	return saveAOVs(film, cameraExposure(camera))
+}
+
+// the image as it is saved: exposed by the camera, and anaglyphs combined from their two views
+func finalImage(buffer []vec3.Vec3, nx, ny int, camera Camera) *image.RGBA {
+	pixels := toImage(buffer, nx, ny, cameraExposure(camera))
+	if c, ok := camera.(StereoCamera); ok && c.Layout == Anaglyph {
+		pixels = anaglyph(pixels)
+	}
+	return pixels
+}
+
+func savePNG(filename string, img image.Image) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return png.Encode(f, img)
+}
+
+// renders the linear radiance of every pixel, top row first, and how many samples each took
+func render(nx, ny, ns int, camera Camera, scene *Scene, samplerKind string, seed int64) ([]vec3.Vec3, []int) {
+	film := renderFilm(nx, ny, ns, camera, scene, samplerKind, seed)
+	return film.Buffer(), film.Counts
+}
+
+// renders into a new film, with the passes if any are enabled
+func renderFilm(nx, ny, ns int, camera Camera, scene *Scene, samplerKind string, seed int64) *Film {
+	filter, err := newFilter(FILTER)
+	if err != nil {
+		panic(err)
+	}
+	film := NewFilm(nx, ny, filter)
+	if renderAOVs() {
+		film.EnableAOVs()
+	}
+	if err := renderPass(film, ns, 0, camera, scene, samplerKind, seed); err != nil {
+		panic(err)
+	}
+	return film
+}
+
+// adds `ns` samples per pixel to the film (or as many as adaptive sampling takes), their
+// indices start at firstSample so passes continue the sampler's sequence
+func renderPass(film *Film, ns, firstSample int, camera Camera, scene *Scene, samplerKind string, seed int64) error {
+	return renderTiles(context.Background(), film, ns, firstSample, camera, scene, samplerKind, seed, nil)
+}
+
+// renderPass that stops early (with the context's error) once the context is done,
+// calling tileDone (if set) after every tile is merged into the film
+// tiles are handed out to one goroutine per CPU
+func renderTiles(ctx context.Context, film *Film, ns, firstSample int, camera Camera, scene *Scene, samplerKind string, seed int64, tileDone func(Tile)) error {
+	if _, err := newSampler(samplerKind, ns, seed, 0); err != nil {
+		return err
+	}
+	tiles := film.Tiles(tileSize)
+	queue := make(chan int, len(tiles))
+	for t := range tiles {
+		queue <- t
+	}
+	close(queue)
+
+	// a panic while rendering a tile stops the others and is returned as the error
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	var failed error
+	var once sync.Once
+
+	wg := new(sync.WaitGroup)
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					once.Do(func() { failed = fmt.Errorf("rendering failed: %v", r) })
+					cancel()
+				}
+			}()
+			for t := range queue {
+				if ctx.Err() != nil {
+					return
+				}
+				ft := renderTile(film, tiles, t, ns, firstSample, camera, scene, samplerKind, seed)
+				film.Merge(ft)
+				if tileDone != nil {
+					tileDone(tiles[t])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if failed != nil {
+		return failed
+	}
+	return parent.Err()
+}
+
+const tileSize = 16
+
+// renders tile t of the film's tiles into a film tile of its own, for the caller to merge
+func renderTile(film *Film, tiles []Tile, t, ns, firstSample int, camera Camera, scene *Scene, samplerKind string, seed int64) *FilmTile {
+	// one sampler per tile (and pass), so the result does not depend on which goroutine
+	// (or worker process) rendered it
+	stream := int64(firstSample)*int64(len(tiles)) + int64(t)
+	sampler, _ := newSampler(samplerKind, ns, seed, stream)
+	ft := film.NewTile(tiles[t])
+	raytracer(ft, tiles[t], ns, firstSample, camera, scene, sampler)
+	return ft
+}
+
+func raytracer(ft *FilmTile, tile Tile, ns, firstSample int, camera Camera, scene *Scene, sampler Sampler) {
+	film := ft.film
+	nx, ny := film.Width, film.Height
+	lensCamera, hasLens := camera.(ApertureCamera)
+	shutter, hasShutter := camera.(ShutterCamera)
+	splat := func(u, v float64, c vec3.Vec3) { ft.AddSplat(u*float64(nx), v*float64(ny), c) }
+	minSamples, maxSamples := ADAPTIVE.sampleRange(ns)
+	for j := tile.Y0; j < tile.Y1; j++ {
+		for i := tile.X0; i < tile.X1; i++ {
+			// antialiasing (`ns` samples per pixel, or as many as needed when adaptive)
+			estimate := pixelEstimate{}
+			for s := 0; s < maxSamples; s++ {
+				if s >= minSamples && s%4 == 0 && estimate.converged(ADAPTIVE.Threshold) {
+					break
+				}
+				sampler.StartSample(i, j, firstSample+s)
+				du, dv := sampler.Get2D()
+				u := (float64(i) + du) / float64(nx)
+				v := (float64(j) + dv) / float64(ny)
+
+				var ray Ray
+				if hasLens {
+					lensU, lensV := sampler.Get2D()
+					ray = lensCamera.GetLensRay(u, v, lensU, lensV)
+				} else {
+					ray = camera.GetRay(u, v)
+				}
+				if hasShutter {
+					open, close := shutter.Shutter()
+					sampler.SetDimension(timeDimension)
+					ray.Time = open + sampler.Get1D()*(close-open)
+				}
+				col := vec3.New(0, 0, 0) // outside of the camera's image (e.g. fisheye)
+				if ray.Direction() != (vec3.Vec3{}) {
+					if ft.aov != nil {
+						var aov AOVSample
+						col, aov = pixelAOV(ray, scene, sampler, camera, nx, ny, splat)
+						ft.AddAOV(i, j, aov)
+					} else {
+						col = scene.integrator().Radiance(ray, scene, sampler, camera, splat)
+					}
+				}
+				estimate.add(col)
+				ft.AddSample(float64(i)+du, float64(j)+dv, col)
+			}
+			ft.SetCount(i, j, estimate.n)
+		}
+	}
+}
+
+func cameraExposure(camera Camera) float64 {
+	if c, ok := camera.(ExposureCamera); ok {
+		return c.Exposure()
+	}
+	return 1.0
+}
+
+// gamma corrected 8 bit image of a rendered buffer
+func toImage(buffer []vec3.Vec3, nx, ny int, exposure float64) *image.RGBA {
+	pixels := image.NewRGBA(image.Rect(0, 0, nx, ny))
+	for y := 0; y < ny; y++ {
+		for x := 0; x < nx; x++ {
+			col := vec3.Scale(buffer[y*nx+x], exposure)
+			col = vec3.New(math.Sqrt(col.X), math.Sqrt(col.Y), math.Sqrt(col.Z))
+			// high dynamic range values (e.g. from environment maps) would overflow
+			col = vec3.New(math.Min(col.X, 1), math.Min(col.Y, 1), math.Min(col.Z, 1))
+
+			pixels.SetRGBA(x, y, color.RGBA{
+				uint8(255 * col.X),
+				uint8(255 * col.Y),
+				uint8(255 * col.Z),
+				255,
+			})
+		}
 	}
-	mutex.Unlock()
-	wg.Done()
+	return pixels
 }
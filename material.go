@@ -2,26 +2,56 @@ package main
 
 import (
 	"math"
-	"math/rand"
 
 	"./vec3"
 )
 
 type Material interface {
-    Scatter(rayIn Ray, record HitRecord, attenuation *vec3.Vec3, rayOut *Ray) bool
-}
-
-func randomUnitInSphere() vec3.Vec3 {
-	p := vec3.New(0.0, 0.0, 0.0)
-	for {
-		p.X = rand.Float64()*2 - 1
-		p.Y = rand.Float64()*2 - 1
-		p.Z = rand.Float64()*2 - 1
-		if vec3.LenSq(p) < 1.0 {
-			break
-		}
+    Scatter(rayIn Ray, record HitRecord, attenuation *vec3.Vec3, rayOut *Ray, sampler Sampler) bool
+}
+
+// materials that give off light themselves
+type Emitter interface {
+	Emitted(record HitRecord) vec3.Vec3
+}
+
+// base color of the material at the hit point
+func materialAlbedo(record HitRecord) vec3.Vec3 {
+	switch m := record.Material.(type) {
+	case Lambertian:
+		return m.Albedo
+	case Metal:
+		return m.Albedo
+	case TexturedLambertian:
+		return m.Texture.Value(record.U, record.V, record.P)
+	case Isotropic:
+		return m.Albedo
+	case HenyeyGreenstein:
+		return m.Albedo
+	case EmissiveMedium:
+		return m.Albedo
+	}
+	return vec3.New(0.0, 0.0, 0.0)
+}
+
+// materials scattering light in all directions (as opposed to mirrors and glass)
+func diffuse(m Material) bool {
+	switch m.(type) {
+	case Lambertian, TexturedLambertian, PhaseFunction:
+		return true
 	}
-	return p
+	return false
+}
+
+// two unit vectors perpendicular to w and to each other
+func orthonormalBasis(w vec3.Vec3) (vec3.Vec3, vec3.Vec3) {
+	a := vec3.New(1.0, 0.0, 0.0)
+	if math.Abs(w.X) > 0.9 {
+		a = vec3.New(0.0, 1.0, 0.0)
+	}
+	v := vec3.Norm(vec3.Cross(w, a))
+	u := vec3.Cross(w, v)
+	return u, v
 }
 
 func reflect(v, n vec3.Vec3) vec3.Vec3 {
@@ -52,8 +82,10 @@ type Lambertian struct {
 	Albedo vec3.Vec3
 }
 
-func (l Lambertian) Scatter(rayIn Ray, record HitRecord, attenuation *vec3.Vec3, rayOut *Ray) bool {
-	target := vec3.Add(vec3.Add(record.P, record.Normal), randomUnitInSphere())
+func (l Lambertian) Scatter(rayIn Ray, record HitRecord, attenuation *vec3.Vec3, rayOut *Ray, sampler Sampler) bool {
+	// a point in the unit ball around the tip of the normal, like the original renderer
+	u, v := sampler.Get2D()
+	target := vec3.Add(vec3.Add(record.P, record.Normal), sampleBall(u, v, sampler.Get1D()))
 	rayOut.A = record.P
 	rayOut.B = vec3.Sub(target, record.P)
 	attenuation.X = l.Albedo.X
@@ -63,17 +95,34 @@ func (l Lambertian) Scatter(rayIn Ray, record HitRecord, attenuation *vec3.Vec3,
 }
 
 
+// lambertian with the albedo looked up from a texture
+type TexturedLambertian struct {
+	Texture Texture
+}
+
+func (l TexturedLambertian) Scatter(rayIn Ray, record HitRecord, attenuation *vec3.Vec3, rayOut *Ray, sampler Sampler) bool {
+	// scattered like Lambertian
+	u, v := sampler.Get2D()
+	target := vec3.Add(vec3.Add(record.P, record.Normal), sampleBall(u, v, sampler.Get1D()))
+	rayOut.A = record.P
+	rayOut.B = vec3.Sub(target, record.P)
+	*attenuation = l.Texture.Value(record.U, record.V, record.P)
+	return true
+}
+
+
 // metal
 type Metal struct {
 	Albedo vec3.Vec3
 	Fuzz   float64
 }
 
-func (m Metal) Scatter(rayIn Ray, record HitRecord, attenuation *vec3.Vec3, rayOut *Ray) bool {
+func (m Metal) Scatter(rayIn Ray, record HitRecord, attenuation *vec3.Vec3, rayOut *Ray, sampler Sampler) bool {
 	reflected := reflect(vec3.Norm(rayIn.Direction()), record.Normal)
 	rayOut.A = record.P
 	if m.Fuzz > 0 {
-		rayOut.B = vec3.Add(reflected, vec3.Scale(randomUnitInSphere(), m.Fuzz))
+		u, v := sampler.Get2D()
+		rayOut.B = vec3.Add(reflected, vec3.Scale(sampleBall(u, v, sampler.Get1D()), m.Fuzz))
 	} else {
 		rayOut.B = reflected
 	}
@@ -87,10 +136,18 @@ func (m Metal) Scatter(rayIn Ray, record HitRecord, attenuation *vec3.Vec3, rayO
 // dielectric
 type Dielectric struct {
 	RefractiveIndex float64  // typically air = 1, glass = 1.3-1.7, diamond = 2.4
+	Absorption vec3.Vec3  // per unit of distance travelled inside (Beer-Lambert), zero for clear glass
 }
 
-func (d Dielectric) Scatter(rayIn Ray, record HitRecord, attenuation *vec3.Vec3, rayOut *Ray) bool {
+func (d Dielectric) Scatter(rayIn Ray, record HitRecord, attenuation *vec3.Vec3, rayOut *Ray, sampler Sampler) bool {
 	*attenuation = vec3.New(1.0, 1.0, 1.0)
+	if vec3.Dot(rayIn.Direction(), record.Normal) > 0 {
+		// leaving the object, the ray travelled through it since its origin
+		distance := record.T * vec3.Len(rayIn.Direction())
+		attenuation.X = math.Exp(-d.Absorption.X * distance)
+		attenuation.Y = math.Exp(-d.Absorption.Y * distance)
+		attenuation.Z = math.Exp(-d.Absorption.Z * distance)
+	}
 
 	outwardNormal := vec3.New(0.0, 0.0, 0.0)
 	var niOverNt float64
@@ -111,10 +168,75 @@ func (d Dielectric) Scatter(rayIn Ray, record HitRecord, attenuation *vec3.Vec3,
 	if refract(rayIn.Direction(), outwardNormal, niOverNt, &refracted) {
 		reflectProb = schlick(cosine, d.RefractiveIndex)
 	}
-	if rand.Float64() < reflectProb {
+	if sampler.Get1D() < reflectProb {
 		rayOut.B = reflect(vec3.Norm(rayIn.Direction()), record.Normal)
 	} else {
 		rayOut.B = refracted
 	}
 	return true
-}
\ No newline at end of file
+}
+
+
+// isotropic phase function (for participating media)
+type Isotropic struct {
+	Albedo vec3.Vec3
+}
+
+func (i Isotropic) Scatter(rayIn Ray, record HitRecord, attenuation *vec3.Vec3, rayOut *Ray, sampler Sampler) bool {
+	rayOut.A = record.P
+	rayOut.B = sampleSphere(sampler.Get2D())
+	*attenuation = i.Albedo
+	return true
+}
+
+func (i Isotropic) Phase(cosine float64) float64 {
+	return 1 / (4 * math.Pi)
+}
+
+
+// Henyey-Greenstein phase function, G in (-1, 1): positive scatters forward, negative backward
+type HenyeyGreenstein struct {
+	Albedo vec3.Vec3
+	G      float64
+}
+
+func (h HenyeyGreenstein) Scatter(rayIn Ray, record HitRecord, attenuation *vec3.Vec3, rayOut *Ray, sampler Sampler) bool {
+	var cosine float64
+	xi, xi2 := sampler.Get2D()
+	if math.Abs(h.G) < 0.001 {
+		cosine = 1 - 2*xi
+	} else {
+		s := (1 - h.G*h.G) / (1 - h.G + 2*h.G*xi)
+		cosine = (1 + h.G*h.G - s*s) / (2 * h.G)
+	}
+	sine := math.Sqrt(math.Max(0, 1-cosine*cosine))
+	phi := 2 * math.Pi * xi2
+
+	w := vec3.Norm(rayIn.Direction())
+	u, v := orthonormalBasis(w)
+	direction := vec3.Scale(w, cosine)
+	direction = vec3.Add(direction, vec3.Scale(u, sine*math.Cos(phi)))
+	direction = vec3.Add(direction, vec3.Scale(v, sine*math.Sin(phi)))
+
+	rayOut.A = record.P
+	rayOut.B = direction
+	*attenuation = h.Albedo
+	return true
+}
+
+// cosine of the angle between the incoming and outgoing direction
+func (h HenyeyGreenstein) Phase(cosine float64) float64 {
+	denom := 1 + h.G*h.G - 2*h.G*cosine
+	return (1 - h.G*h.G) / (4 * math.Pi * denom * math.Sqrt(denom))
+}
+
+
+// Henyey-Greenstein scattering medium that also glows (e.g. fire)
+type EmissiveMedium struct {
+	HenyeyGreenstein
+	Emission vec3.Vec3
+}
+
+func (e EmissiveMedium) Emitted(record HitRecord) vec3.Vec3 {
+	return e.Emission
+}
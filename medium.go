@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+
+	"./vec3"
+)
+
+// phase functions scatter light inside media
+type PhaseFunction interface {
+	Material
+	Phase(cosine float64) float64
+}
+
+
+// random numbers of media, drawn from the ray (and where along it the medium starts,
+// salt) rather than math/rand: a ray always meets a medium the same way whichever goroutine
+// or worker process traces it, and goroutines do not wait for each other's random numbers
+type mediumRandom struct {
+	seed, n uint32
+}
+
+func newMediumRandom(ray Ray, salt float64) *mediumRandom {
+	seed := uint32(0)
+	for _, f := range []float64{ray.A.X, ray.A.Y, ray.A.Z, ray.B.X, ray.B.Y, ray.B.Z, ray.Time, salt} {
+		bits := math.Float64bits(f)
+		seed = hash(seed, uint32(bits), uint32(bits>>32))
+	}
+	return &mediumRandom{seed: seed}
+}
+
+func (r *mediumRandom) Float64() float64 {
+	r.n++
+	return unitFloat(hash(r.seed, r.n))
+}
+
+
+// medium of constant density filling a closed boundary (e.g. smoke in a box)
+type ConstantMedium struct {
+	Boundary Hitable
+	Density  float64 // chance of scattering per unit of distance
+	Phase    PhaseFunction
+}
+
+func (m ConstantMedium) Hit(ray Ray, tMin, tMax float64, record *HitRecord) bool {
+	rec1 := HitRecord{}
+	rec2 := HitRecord{}
+	if !m.Boundary.Hit(ray, -MAXFLOAT, MAXFLOAT, &rec1) {
+		return false
+	}
+	if !m.Boundary.Hit(ray, rec1.T+0.0001, MAXFLOAT, &rec2) {
+		return false
+	}
+	enter := math.Max(rec1.T, tMin)
+	exit := math.Min(rec2.T, tMax)
+	if enter >= exit {
+		return false
+	}
+
+	length := vec3.Len(ray.Direction())
+	random := newMediumRandom(ray, enter)
+	distance := -math.Log(1-random.Float64()) / m.Density
+	if distance > (exit-enter)*length {
+		return false
+	}
+	record.T = enter + distance/length
+	record.P = ray.PointAtParameter(record.T)
+	record.Normal = vec3.Scale(ray.Direction(), -1/length) // arbitrary
+	record.U, record.V = 0, 0
+	record.Material = m.Phase
+	return true
+}
+
+func (m ConstantMedium) BoundingBox(t0, t1 float64, box *AABB) bool {
+	return m.Boundary.BoundingBox(t0, t1, box)
+}
+
+
+// fog filling all of space below a given height (use math.Inf(1) for everywhere)
+// this is a Volume of the scene rather than a Hitable
+type Atmosphere struct {
+	Density float64
+	Height  float64
+	Phase   PhaseFunction
+}
+
+// part [t0, t1] of the ray segment [tMin, tMax] below the fog height
+func (a *Atmosphere) segment(ray Ray, tMin, tMax float64) (float64, float64, bool) {
+	o, d := ray.Origin(), ray.Direction()
+	if d.Y == 0 {
+		return tMin, tMax, o.Y < a.Height
+	}
+	tc := (a.Height - o.Y) / d.Y
+	if d.Y > 0 {
+		tMax = math.Min(tMax, tc)
+	} else {
+		tMin = math.Max(tMin, tc)
+	}
+	return tMin, tMax, tMin < tMax
+}
+
+func (a *Atmosphere) Sample(ray Ray, tMin, tMax float64, record *HitRecord) bool {
+	t0, t1, ok := a.segment(ray, tMin, tMax)
+	if !ok {
+		return false
+	}
+	length := vec3.Len(ray.Direction())
+	random := newMediumRandom(ray, t0)
+	distance := -math.Log(1-random.Float64()) / a.Density
+	if distance > (t1-t0)*length {
+		return false
+	}
+	record.T = t0 + distance/length
+	record.P = ray.PointAtParameter(record.T)
+	record.Normal = vec3.Scale(ray.Direction(), -1/length)
+	record.U, record.V = 0, 0
+	record.Material = a.Phase
+	return true
+}
+
+func (a *Atmosphere) Transmittance(from, to vec3.Vec3) float64 {
+	ray := Ray{from, vec3.Sub(to, from), 0}
+	t0, t1, ok := a.segment(ray, 0, 1)
+	if !ok {
+		return 1
+	}
+	return math.Exp(-a.Density * (t1 - t0) * vec3.Len(ray.Direction()))
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// movies: the frames of an animation in one file, an animated GIF (256 colors chosen
+// for every frame) or an APNG (every frame lossless, shown as the first frame where
+// APNG is not supported)
+func movieFormat(filename string) (string, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".gif":
+		return "gif", nil
+	case ".png", ".apng":
+		return "apng", nil
+	}
+	return "", fmt.Errorf("movie `%s` is neither a .gif nor a .png", filename)
+}
+
+func saveMovie(filename string, frames []*image.RGBA, fps float64, dither bool) error {
+	format, err := movieFormat(filename)
+	if err != nil {
+		return err
+	}
+	if len(frames) == 0 {
+		return fmt.Errorf("no frames for the movie")
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if format == "gif" {
+		err = writeGIF(f, frames, fps, dither)
+	} else {
+		err = writeAPNG(f, frames, fps)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+
+// looping animated GIF, the delays are in hundredths of a second (browsers slow down
+// anything under 2)
+func writeGIF(w io.Writer, frames []*image.RGBA, fps float64, dither bool) error {
+	delay := maxInt(int(math.Round(100/fps)), 2)
+	movie := &gif.GIF{}
+	for _, frame := range frames {
+		bounds := frame.Bounds()
+		paletted := image.NewPaletted(bounds, quantize(frame, 256))
+		if dither {
+			draw.FloydSteinberg.Draw(paletted, bounds, frame, bounds.Min)
+		} else {
+			draw.Draw(paletted, bounds, frame, bounds.Min, draw.Src)
+		}
+		movie.Image = append(movie.Image, paletted)
+		movie.Delay = append(movie.Delay, delay)
+	}
+	return gif.EncodeAll(w, movie)
+}
+
+// a color of the image and how many pixels have it
+type colorCount struct {
+	c [3]uint8
+	n int
+}
+
+// box of colors being split by the median cut
+type colorBox struct {
+	colors []colorCount
+	pixels int
+	axis   int   // channel with the largest range
+	size   uint8 // its range
+}
+
+func newColorBox(colors []colorCount) colorBox {
+	box := colorBox{colors: colors}
+	lo, hi := [3]uint8{255, 255, 255}, [3]uint8{}
+	for _, c := range colors {
+		box.pixels += c.n
+		for i, v := range c.c {
+			if v < lo[i] {
+				lo[i] = v
+			}
+			if v > hi[i] {
+				hi[i] = v
+			}
+		}
+	}
+	for i := range lo {
+		if hi[i]-lo[i] > box.size {
+			box.axis, box.size = i, hi[i]-lo[i]
+		}
+	}
+	return box
+}
+
+// at most n colors for the image by median cut: the box of colors that is largest
+// (by range times pixels) is split at the median pixel of its widest channel until there
+// are n boxes, the palette is the boxes' average colors
+func quantize(img *image.RGBA, n int) color.Palette {
+	counts := map[[3]uint8]int{}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			counts[[3]uint8{c.R, c.G, c.B}]++
+		}
+	}
+	colors := make([]colorCount, 0, len(counts))
+	for c, count := range counts {
+		colors = append(colors, colorCount{c, count})
+	}
+
+	boxes := []colorBox{newColorBox(colors)}
+	for len(boxes) < n {
+		best, score := -1, 0.0
+		for i, box := range boxes {
+			if s := float64(box.size) * float64(box.pixels); box.size > 0 && s > score {
+				best, score = i, s
+			}
+		}
+		if best < 0 {
+			// every box is a single color
+			break
+		}
+		box := boxes[best]
+		sort.Slice(box.colors, func(i, j int) bool { return box.colors[i].c[box.axis] < box.colors[j].c[box.axis] })
+		median, seen := 1, box.colors[0].n
+		for median < len(box.colors)-1 && seen+box.colors[median].n <= box.pixels/2 {
+			seen += box.colors[median].n
+			median++
+		}
+		boxes[best] = newColorBox(box.colors[:median])
+		boxes = append(boxes, newColorBox(box.colors[median:]))
+	}
+
+	palette := make(color.Palette, len(boxes))
+	for i, box := range boxes {
+		var sum [3]int
+		for _, c := range box.colors {
+			for k, v := range c.c {
+				sum[k] += int(v) * c.n
+			}
+		}
+		average := func(k int) uint8 { return uint8((sum[k] + box.pixels/2) / box.pixels) }
+		palette[i] = color.RGBA{average(0), average(1), average(2), 255}
+	}
+	return palette
+}
+
+
+// looping APNG: every frame is encoded as a PNG, whose image data becomes the frame's
+// (the first frame's is the default image, the others go into fdAT chunks)
+func writeAPNG(w io.Writer, frames []*image.RGBA, fps float64) error {
+	// delay in milliseconds
+	delay := uint16(math.Max(math.Min(math.Round(1000/fps), 65535), 1))
+	bounds := frames[0].Bounds()
+	var header []byte
+	sequence := uint32(0)
+
+	out := &pngWriter{w: w}
+	out.signature()
+	for i, frame := range frames {
+		if frame.Bounds().Size() != bounds.Size() {
+			return fmt.Errorf("frame %d is not %dx%d like the first", i, bounds.Dx(), bounds.Dy())
+		}
+		buffer := new(bytes.Buffer)
+		if err := png.Encode(buffer, frame); err != nil {
+			return err
+		}
+		chunks, err := pngChunks(buffer.Bytes())
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			header = chunks["IHDR"][0]
+			out.chunk("IHDR", header)
+			out.chunk("acTL", be32(uint32(len(frames)), 0))
+		} else if !bytes.Equal(chunks["IHDR"][0], header) {
+			// the color type depends on the image, they all have to be the same
+			return fmt.Errorf("frame %d is not encoded like the first", i)
+		}
+
+		control := be32(sequence, uint32(bounds.Dx()), uint32(bounds.Dy()), 0, 0)
+		control = append(control, byte(delay>>8), byte(delay), 0x03, 0xe8, 0, 0) // delay/1000, no disposal or blending
+		out.chunk("fcTL", control)
+		sequence++
+		for _, data := range chunks["IDAT"] {
+			if i == 0 {
+				out.chunk("IDAT", data)
+				continue
+			}
+			out.chunk("fdAT", append(be32(sequence), data...))
+			sequence++
+		}
+	}
+	out.chunk("IEND", nil)
+	return out.err
+}
+
+// the data of the chunks of a PNG file, by type
+func pngChunks(file []byte) (map[string][][]byte, error) {
+	chunks := map[string][][]byte{}
+	if len(file) < 8 {
+		return nil, fmt.Errorf("not a PNG")
+	}
+	for rest := file[8:]; len(rest) >= 12; {
+		length := int(binary.BigEndian.Uint32(rest))
+		if 12+length > len(rest) {
+			return nil, fmt.Errorf("PNG chunk is cut off")
+		}
+		kind := string(rest[4:8])
+		chunks[kind] = append(chunks[kind], rest[8:8+length])
+		rest = rest[12+length:]
+	}
+	if len(chunks["IHDR"]) != 1 || len(chunks["IDAT"]) == 0 {
+		return nil, fmt.Errorf("PNG without header or image data")
+	}
+	return chunks, nil
+}
+
+// writes PNG chunks, keeping the first error
+type pngWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *pngWriter) write(b []byte) {
+	if p.err == nil {
+		_, p.err = p.w.Write(b)
+	}
+}
+
+func (p *pngWriter) signature() {
+	p.write([]byte("\x89PNG\r\n\x1a\n"))
+}
+
+func (p *pngWriter) chunk(kind string, data []byte) {
+	p.write(be32(uint32(len(data))))
+	typed := append([]byte(kind), data...)
+	p.write(typed)
+	p.write(be32(crc32.ChecksumIEEE(typed)))
+}
+
+func be32(values ...uint32) []byte {
+	b := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	return b
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"runtime"
+	"sync"
+
+	"./vec3"
+)
+
+// photon mapping: photons shot from the lights are stored where they land on diffuse
+// surfaces, in a global map (all of them) and a caustic map (those that came through
+// mirrors and glass only). Camera rays use the caustic map for the light the lights cannot
+// be found by (point lights focused by glass, which shadow rays see as opaque) and gather
+// the rest of the indirect light with a bounce into the global map (final gathering).
+//
+// photons carry light in the units of the lights' Illuminate, their density is what a
+// light adds at a diffuse surface before the albedo (so the maps and the shadow rays agree)
+type Photon struct {
+	P         vec3.Vec3
+	Direction vec3.Vec3 // travelled, normalized
+	Power     vec3.Vec3
+	axis      int // splitting the kd-tree below it
+}
+
+// photons in a balanced kd-tree: the middle of every range splits the rest of it
+type PhotonMap struct {
+	photons []Photon
+}
+
+func NewPhotonMap(photons []Photon) *PhotonMap {
+	m := &PhotonMap{photons}
+	m.build(0, len(photons))
+	return m
+}
+
+func (m *PhotonMap) build(lo, hi int) {
+	if hi-lo < 2 {
+		return
+	}
+	// split along the axis the photons are spread the most
+	box := AABB{m.photons[lo].P, m.photons[lo].P}
+	for _, p := range m.photons[lo:hi] {
+		box = surroundingBox(box, AABB{p.P, p.P})
+	}
+	extent := vec3.Sub(box.Max, box.Min)
+	split := 0
+	for i := 1; i < 3; i++ {
+		if axis(extent, i) > axis(extent, split) {
+			split = i
+		}
+	}
+	mid := (lo + hi) / 2
+	m.selectPhoton(lo, hi, mid, split)
+	m.photons[mid].axis = split
+	m.build(lo, mid)
+	m.build(mid+1, hi)
+}
+
+// partially sorts photons[lo:hi] along the axis so photon k is in its sorted place (quickselect)
+func (m *PhotonMap) selectPhoton(lo, hi, k, split int) {
+	photons := m.photons
+	for hi-lo > 1 {
+		pivot := axis(photons[(lo+hi)/2].P, split)
+		i, j := lo, hi-1
+		for i <= j {
+			for axis(photons[i].P, split) < pivot {
+				i++
+			}
+			for axis(photons[j].P, split) > pivot {
+				j--
+			}
+			if i <= j {
+				photons[i], photons[j] = photons[j], photons[i]
+				i++
+				j--
+			}
+		}
+		switch {
+		case k <= j:
+			hi = j + 1
+		case k >= i:
+			lo = i
+		default:
+			return
+		}
+	}
+}
+
+// photon found near a point, by its squared distance
+type neighbour struct {
+	photon *Photon
+	dist2  float64
+}
+
+// max-heap of the nearest photons so far, the farthest on top
+type neighbours []neighbour
+
+func (n neighbours) Len() int            { return len(n) }
+func (n neighbours) Less(i, j int) bool  { return n[i].dist2 > n[j].dist2 }
+func (n neighbours) Swap(i, j int)       { n[i], n[j] = n[j], n[i] }
+func (n *neighbours) Push(x interface{}) { *n = append(*n, x.(neighbour)) }
+func (n *neighbours) Pop() interface{} {
+	old := *n
+	last := old[len(old)-1]
+	*n = old[:len(old)-1]
+	return last
+}
+
+// the k photons nearest to p within the radius
+func (m *PhotonMap) nearest(p vec3.Vec3, k int, radius float64) neighbours {
+	found := make(neighbours, 0, k)
+	limit := radius * radius
+	m.search(0, len(m.photons), p, k, &found, &limit)
+	return found
+}
+
+func (m *PhotonMap) search(lo, hi int, p vec3.Vec3, k int, found *neighbours, limit *float64) {
+	if lo >= hi {
+		return
+	}
+	mid := (lo + hi) / 2
+	photon := &m.photons[mid]
+	delta := axis(p, photon.axis) - axis(photon.P, photon.axis)
+	if hi-lo > 1 {
+		if delta < 0 {
+			m.search(lo, mid, p, k, found, limit)
+		} else {
+			m.search(mid+1, hi, p, k, found, limit)
+		}
+	}
+	if d := vec3.Sub(photon.P, p); vec3.Dot(d, d) < *limit {
+		heap.Push(found, neighbour{photon, vec3.Dot(d, d)})
+		if len(*found) > k {
+			heap.Pop(found)
+		}
+		if len(*found) == k {
+			*limit = (*found)[0].dist2
+		}
+	}
+	if hi-lo > 1 && delta*delta < *limit {
+		if delta < 0 {
+			m.search(mid+1, hi, p, k, found, limit)
+		} else {
+			m.search(lo, mid, p, k, found, limit)
+		}
+	}
+}
+
+// light leaving a diffuse surface from the photons around the hit point that arrived
+// on the side the normal faces, cone filtered so the edges of caustics stay sharp
+func (m *PhotonMap) radiance(record HitRecord, normal vec3.Vec3, k int, radius float64) vec3.Vec3 {
+	found := m.nearest(record.P, k, radius)
+	if len(found) == 0 {
+		return vec3.Vec3{}
+	}
+	r2 := radius * radius
+	if len(found) == k {
+		// not zero when all of them landed on the point
+		r2 = math.Max(found[0].dist2, 1e-6*radius*radius)
+	}
+	r := math.Sqrt(r2)
+	var sum vec3.Vec3
+	for _, n := range found {
+		if vec3.Dot(n.photon.Direction, normal) >= 0 {
+			continue
+		}
+		weight := 1 - math.Sqrt(n.dist2)/r
+		sum = vec3.Add(sum, vec3.Scale(n.photon.Power, weight))
+	}
+	// the cone filter's weights average 1/3 over the disc
+	return vec3.Mul(materialAlbedo(record), vec3.Scale(sum, 3/(math.Pi*r2)))
+}
+
+
+// integrator rendering with a global and a caustic photon map
+type PhotonMapper struct {
+	settings                    IntegratorSettings
+	global, caustic             *PhotonMap
+	globalRadius, causticRadius float64 // largest search radius
+	backgroundPhotons           bool    // the background's light reaching diffuse surfaces through mirrors and glass is in the caustic map
+}
+
+// shoots the photons of both maps
+func newPhotonMapper(scene *Scene, settings IntegratorSettings) *PhotonMapper {
+	center, radius := sceneBounds(scene)
+	var targets []AABB
+	specularBoxes(scene.World, &targets)
+	targets = mergeTargets(targets, 64)
+
+	p := &PhotonMapper{settings: settings, globalRadius: 0.1 * radius, causticRadius: 0.05 * radius}
+	var emitters []*photonEmitter
+	for _, light := range scene.Lights {
+		emitters = append(emitters, newPhotonEmitter(light, scene, center, radius))
+	}
+	if scene.Environment != nil || scene.Background != (vec3.Vec3{}) {
+		emitters = append(emitters, newPhotonEmitter(nil, scene, center, radius))
+		p.backgroundPhotons = true
+	}
+	var global, caustic []Photon
+	for i, emitter := range emitters {
+		seed := int64(2 * i)
+		global = append(global, shootPhotons(scene, settings.Photons/len(emitters), seed, false, emitter.emit)...)
+		if len(targets) > 0 {
+			emitter := emitter
+			emit := func(sampler Sampler, n int) (Ray, vec3.Vec3, bool) { return emitter.emitTowards(sampler, n, targets) }
+			caustic = append(caustic, shootPhotons(scene, settings.CausticPhotons/len(emitters), seed+1, true, emit)...)
+		}
+	}
+	p.global, p.caustic = NewPhotonMap(global), NewPhotonMap(caustic)
+	fmt.Printf("Photon maps: %d global and %d caustic photons\n", len(global), len(caustic))
+	return p
+}
+
+func (p *PhotonMapper) Radiance(ray Ray, scene *Scene, sampler Sampler, camera Camera, splat func(u, v float64, c vec3.Vec3)) vec3.Vec3 {
+	return p.radiance(ray, scene, sampler, 0, false, false)
+}
+
+// gathering rays end at the first diffuse surface they hit with the global map's estimate,
+// skipBackground is set when the background seen by the ray is already counted otherwise
+// (sampled directly, or in the caustic map)
+func (p *PhotonMapper) radiance(ray Ray, scene *Scene, sampler Sampler, depth int, gathering, skipBackground bool) vec3.Vec3 {
+	record := HitRecord{}
+	if !intersect(ray, scene, &record) {
+		if skipBackground {
+			return vec3.New(0.0, 0.0, 0.0)
+		}
+		return background(ray, scene, false)
+	}
+	if _, ok := record.Material.(PhaseFunction); ok {
+		// photons do not enter media, they are path traced
+		emitted, direct, indirect := shade(ray, record, scene, sampler, depth)
+		return vec3.Add(emitted, vec3.Add(direct, indirect))
+	}
+	var emitted vec3.Vec3
+	if emitter, ok := record.Material.(Emitter); ok {
+		emitted = emitter.Emitted(record)
+	}
+	normal := record.Normal
+	if vec3.Dot(normal, ray.Direction()) > 0 {
+		normal = vec3.Scale(normal, -1)
+	}
+	if gathering && diffuse(record.Material) {
+		return vec3.Add(emitted, p.global.radiance(record, normal, p.settings.Nearest, p.globalRadius))
+	}
+
+	// mirrors and glass are followed, diffuse surfaces gather
+	var indirect vec3.Vec3
+	attenuation := vec3.New(0.0, 0.0, 0.0)
+	rayOut := Ray{Time: ray.Time}
+	sampler.SetDimension(scatterDimension(depth))
+	if depth < 10 && record.Material.Scatter(ray, record, &attenuation, &rayOut, sampler) {
+		gather := gathering || diffuse(record.Material)
+		skip := scene.Environment != nil
+		if !diffuse(record.Material) {
+			skip = gathering && p.backgroundPhotons
+		}
+		indirect = vec3.Mul(p.radiance(rayOut, scene, sampler, depth+1, gather, skip), attenuation)
+	}
+	if diffuse(record.Material) {
+		indirect = vec3.Add(indirect, p.caustic.radiance(record, normal, p.settings.Nearest, p.causticRadius))
+	}
+	direct := directLight(ray, record, scene, sampler, depth, vec3.Add(emitted, indirect))
+	return vec3.Add(emitted, vec3.Add(direct, indirect))
+}
+
+
+// photons stored by one goroutine at a time, in batches that always get the same random numbers
+const photonBatch = 4096
+
+// emits n photons (the ones that miss have no power), returning those that were stored:
+// the caustic ones, or else every one landing on a diffuse surface
+func shootPhotons(scene *Scene, n int, seed int64, caustic bool, emit func(sampler Sampler, n int) (Ray, vec3.Vec3, bool)) []Photon {
+	batches := (n + photonBatch - 1) / photonBatch
+	stored := make([][]Photon, batches)
+	queue := make(chan int, batches)
+	for b := 0; b < batches; b++ {
+		queue <- b
+	}
+	close(queue)
+	wg := new(sync.WaitGroup)
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range queue {
+				sampler, _ := newSampler("independent", 1, seed, int64(b))
+				for i := b * photonBatch; i < minInt((b+1)*photonBatch, n); i++ {
+					ray, power, byDistance := emit(sampler, n)
+					if power != (vec3.Vec3{}) {
+						stored[b] = tracePhoton(scene, ray, power, byDistance, caustic, sampler, stored[b])
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	var photons []Photon
+	for _, batch := range stored {
+		photons = append(photons, batch...)
+	}
+	return photons
+}
+
+// follows a photon through the scene, byDistance scales its power with the distance to the
+// first hit (for lights fading linearly rather than with the square of the distance)
+func tracePhoton(scene *Scene, ray Ray, power vec3.Vec3, byDistance, caustic bool, sampler Sampler, stored []Photon) []Photon {
+	specular := false
+	for depth := 0; depth < 10; depth++ {
+		record := HitRecord{}
+		if !scene.World.Hit(ray, 0.001, MAXFLOAT, &record) {
+			return stored
+		}
+		if _, ok := record.Material.(PhaseFunction); ok {
+			return stored
+		}
+		if depth == 0 && byDistance {
+			power = vec3.Scale(power, record.T*vec3.Len(ray.Direction()))
+		}
+		direction := vec3.Norm(ray.Direction())
+		attenuation := vec3.New(0.0, 0.0, 0.0)
+		rayOut := Ray{Time: ray.Time}
+		if diffuse(record.Material) {
+			if caustic {
+				if specular {
+					stored = append(stored, Photon{P: record.P, Direction: direction, Power: power})
+				}
+				return stored
+			}
+			stored = append(stored, Photon{P: record.P, Direction: direction, Power: power})
+			// russian roulette, surviving photons carry what the others would have
+			albedo := materialAlbedo(record)
+			survive := (albedo.X + albedo.Y + albedo.Z) / 3
+			if sampler.Get1D() >= survive || !record.Material.Scatter(ray, record, &attenuation, &rayOut, sampler) {
+				return stored
+			}
+			power = vec3.Scale(vec3.Mul(power, attenuation), 1/survive)
+		} else {
+			if !record.Material.Scatter(ray, record, &attenuation, &rayOut, sampler) {
+				return stored
+			}
+			specular = true
+			power = vec3.Mul(power, attenuation)
+		}
+		ray = rayOut
+	}
+	return stored
+}
+
+
+// center and radius of a sphere around the bounded objects
+func sceneBounds(scene *Scene) (vec3.Vec3, float64) {
+	var bounds AABB
+	found := false
+	for _, h := range scene.World {
+		var box AABB
+		if h.BoundingBox(0.0, 1.0, &box) {
+			if !found {
+				bounds = box
+			}
+			bounds, found = surroundingBox(bounds, box), true
+		}
+	}
+	if !found {
+		return vec3.New(0.0, 0.0, 0.0), 10
+	}
+	return bounds.Center(), math.Max(0.5*vec3.Len(vec3.Sub(bounds.Max, bounds.Min)), 1e-3)
+}
+
+func specular(m Material) bool {
+	switch m.(type) {
+	case Metal, Dielectric:
+		return true
+	}
+	return false
+}
+
+// bounding boxes of the objects with mirrors or glass, which caustic photons are shot at
+func specularBoxes(h Hitable, boxes *[]AABB) {
+	var box AABB
+	switch o := h.(type) {
+	case HitableList:
+		for _, child := range o {
+			specularBoxes(child, boxes)
+		}
+	case *BVHNode:
+		specularBoxes(o.Left, boxes)
+		specularBoxes(o.Right, boxes)
+	case taggedObject:
+		specularBoxes(o.Hitable, boxes)
+	case Sphere:
+		if specular(o.Material) && o.BoundingBox(0.0, 1.0, &box) {
+			*boxes = append(*boxes, box)
+		}
+	case MovingSphere:
+		if specular(o.Material) && o.BoundingBox(0.0, 1.0, &box) {
+			*boxes = append(*boxes, box)
+		}
+	case Triangle:
+		if specular(o.Material) && o.BoundingBox(0.0, 1.0, &box) {
+			*boxes = append(*boxes, box)
+		}
+	case *Instance, *MovingInstance:
+		// the whole instance if anything inside it is specular
+		var inner []AABB
+		var object Hitable
+		if in, ok := o.(*Instance); ok {
+			object = in.Object
+		} else {
+			object = o.(*MovingInstance).Object
+		}
+		specularBoxes(object, &inner)
+		if len(inner) > 0 && h.BoundingBox(0.0, 1.0, &box) {
+			*boxes = append(*boxes, box)
+		}
+	}
+}
+
+// at most n boxes, merging the ones in the same cell of a grid over all of them
+// (meshes would otherwise be a box per triangle)
+func mergeTargets(boxes []AABB, n int) []AABB {
+	if len(boxes) <= n {
+		return boxes
+	}
+	bounds := boxes[0]
+	for _, box := range boxes {
+		bounds = surroundingBox(bounds, box)
+	}
+	cells := int(math.Cbrt(float64(n)))
+	size := vec3.Sub(bounds.Max, bounds.Min)
+	cell := func(c vec3.Vec3, i int) int {
+		if axis(size, i) == 0 {
+			return 0
+		}
+		return minInt(int(float64(cells)*(axis(c, i)-axis(bounds.Min, i))/axis(size, i)), cells-1)
+	}
+	merged := map[int]AABB{}
+	var order []int
+	for _, box := range boxes {
+		c := box.Center()
+		key := (cell(c, 0)*cells+cell(c, 1))*cells + cell(c, 2)
+		if m, ok := merged[key]; ok {
+			merged[key] = surroundingBox(m, box)
+		} else {
+			merged[key] = box
+			order = append(order, key)
+		}
+	}
+	result := make([]AABB, len(order))
+	for i, key := range order {
+		result[i] = merged[key]
+	}
+	return result
+}
+
+
+// where the photons of a light (or of the background, if light is nil) start and how
+// much light they carry
+type photonEmitter struct {
+	light      Light
+	scene      *Scene
+	position   vec3.Vec3 // of lights at a point
+	positioned bool
+	cone       float64 // cosine of the angle light leaves a spot light in
+	direction  vec3.Vec3
+	center     vec3.Vec3 // of the scene, lit by directional lights and the background
+	radius     float64
+}
+
+func newPhotonEmitter(light Light, scene *Scene, center vec3.Vec3, radius float64) *photonEmitter {
+	e := &photonEmitter{light: light, scene: scene, cone: -1, center: center, radius: radius}
+	switch l := light.(type) {
+	case PointLight:
+		e.position, e.positioned = l.P, true
+	case SpotLight:
+		e.position, e.positioned = l.P, true
+		e.direction, e.cone = vec3.Norm(l.Direction), math.Cos(l.Angle*math.Pi/180)
+	case IESLight:
+		e.position, e.positioned = l.P, true
+	case DirectionalLight:
+		e.direction = vec3.Norm(l.Direction)
+	}
+	return e
+}
+
+// direction photons travel in from far away and the light they bring per unit of area
+// across it (divided by the density of the direction for the background)
+func (e *photonEmitter) parallel(sampler Sampler) (vec3.Vec3, vec3.Vec3) {
+	if e.light != nil {
+		_, _, intensity := e.light.Illuminate(e.center)
+		return e.direction, intensity
+	}
+	var direction, radiance vec3.Vec3
+	var pdf float64
+	if e.scene.Environment != nil {
+		direction, radiance, pdf = e.scene.Environment.Sample(sampler.Get2D())
+	} else {
+		direction, radiance, pdf = sampleSphere(sampler.Get2D()), e.scene.Background, 1/(4*math.Pi)
+	}
+	if pdf == 0 {
+		return vec3.New(0.0, 0.0, 1.0), vec3.Vec3{}
+	}
+	// radiance over the directions arriving at a surface is pi times what it adds before the albedo
+	return vec3.Scale(direction, -1), vec3.Scale(radiance, 1/(math.Pi*pdf))
+}
+
+// intensity of a light at a point towards the direction, at unit distance
+func (e *photonEmitter) intensity(direction vec3.Vec3) vec3.Vec3 {
+	_, _, intensity := e.light.Illuminate(vec3.Add(e.position, direction))
+	return intensity
+}
+
+// one of n photons spread over everything the light reaches
+func (e *photonEmitter) emit(sampler Sampler, n int) (Ray, vec3.Vec3, bool) {
+	time := sampler.Get1D()
+	if !e.positioned {
+		// through a disc across the direction that covers the scene
+		direction, light := e.parallel(sampler)
+		origin := discPoint(e.center, e.radius, direction, sampler)
+		origin = vec3.Sub(origin, vec3.Scale(direction, 2*e.radius))
+		area := math.Pi * e.radius * e.radius
+		return Ray{origin, direction, time}, vec3.Scale(light, area/float64(n)), false
+	}
+	var direction vec3.Vec3
+	if e.cone == -1 {
+		direction = sampleSphere(sampler.Get2D())
+	} else {
+		direction = sampleCone(e.direction, e.cone, sampler)
+	}
+	solidAngle := 2 * math.Pi * (1 - e.cone)
+	return Ray{e.position, direction, time}, vec3.Scale(e.intensity(direction), solidAngle/float64(n)), true
+}
+
+// one of n photons shot at one of the targets, weighted by how likely any of them would
+// have sent it that way
+func (e *photonEmitter) emitTowards(sampler Sampler, n int, targets []AABB) (Ray, vec3.Vec3, bool) {
+	time := sampler.Get1D()
+	target := targets[minInt(int(sampler.Get1D()*float64(len(targets))), len(targets)-1)]
+	center, radius := boundingSphere(target)
+	if !e.positioned {
+		direction, light := e.parallel(sampler)
+		origin := discPoint(center, radius, direction, sampler)
+		// density of all the targets' discs there
+		pdf := 0.0
+		for _, t := range targets {
+			c, r := boundingSphere(t)
+			d := vec3.Sub(c, origin)
+			d = vec3.Sub(d, vec3.Scale(direction, vec3.Dot(d, direction)))
+			if vec3.Dot(d, d) <= r*r {
+				pdf += 1 / (math.Pi * r * r)
+			}
+		}
+		pdf /= float64(len(targets))
+		origin = vec3.Sub(origin, vec3.Scale(direction, 2*e.radius+radius))
+		return Ray{origin, direction, time}, vec3.Scale(light, 1/(float64(n)*pdf)), false
+	}
+
+	cone := func(t AABB) (vec3.Vec3, float64) {
+		center, radius := boundingSphere(t)
+		to := vec3.Sub(center, e.position)
+		distance := vec3.Len(to)
+		if distance <= radius {
+			return vec3.New(0.0, 0.0, 1.0), -1
+		}
+		return vec3.Scale(to, 1/distance), math.Sqrt(1 - radius*radius/(distance*distance))
+	}
+	axis, cosMax := cone(target)
+	direction := sampleCone(axis, cosMax, sampler)
+	pdf := 0.0
+	for _, t := range targets {
+		if a, c := cone(t); vec3.Dot(direction, a) >= c {
+			pdf += 1 / (2 * math.Pi * (1 - c))
+		}
+	}
+	pdf /= float64(len(targets))
+	return Ray{e.position, direction, time}, vec3.Scale(e.intensity(direction), 1/(float64(n)*pdf)), true
+}
+
+func boundingSphere(box AABB) (vec3.Vec3, float64) {
+	return box.Center(), 0.5 * vec3.Len(vec3.Sub(box.Max, box.Min))
+}
+
+// uniform point on the disc around the center across the direction
+func discPoint(center vec3.Vec3, radius float64, direction vec3.Vec3, sampler Sampler) vec3.Vec3 {
+	u, v := orthonormalBasis(direction)
+	x, y := sampleDisk(sampler.Get2D())
+	return vec3.Add(center, vec3.Add(vec3.Scale(u, x*radius), vec3.Scale(v, y*radius)))
+}
+
+// uniform direction within the angle with the cosine around the axis
+func sampleCone(axis vec3.Vec3, cosMax float64, sampler Sampler) vec3.Vec3 {
+	u, v := sampler.Get2D()
+	z := 1 - u*(1-cosMax)
+	r := math.Sqrt(math.Max(0, 1-z*z))
+	phi := 2 * math.Pi * v
+	a, b := orthonormalBasis(axis)
+	return vec3.Add(vec3.Scale(axis, z), vec3.Add(vec3.Scale(a, r*math.Cos(phi)), vec3.Scale(b, r*math.Sin(phi))))
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// the render server's web page: a list of the jobs and the image of the chosen one
+// (the latest by default), reloaded whenever its events say more tiles are done
+const previewPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Renders</title>
+<style>
+body { font-family: sans-serif; background: #222; color: #ddd; margin: 1em 2em; }
+a { color: #8bf; }
+#jobs a { margin-right: 0.8em; }
+#jobs a.current { font-weight: bold; color: #fff; }
+#image { display: block; margin-top: 1em; max-width: 100%; image-rendering: pixelated; background: #000; }
+#bar { height: 4px; background: #8bf; width: 0; transition: width 0.2s; }
+</style>
+</head>
+<body>
+<div id="jobs">no jobs yet</div>
+<h2 id="title"></h2>
+<div id="status"></div>
+<div id="bar"></div>
+<img id="image" alt="">
+<script>
+let current = null, events = null;
+
+function seconds(s) {
+  if (s < 60) return Math.round(s) + "s";
+  return Math.floor(s / 60) + "m " + Math.round(s % 60) + "s";
+}
+
+function show(status) {
+  let text = status.status;
+  if (status.total) text += " — " + status.samples + " of " + status.total + " samples per pixel";
+  text += ", " + Math.floor(100 * status.progress) + "%";
+  if (status.eta) text += ", about " + seconds(status.eta) + " left";
+  if (status.error) text += " — " + status.error;
+  document.getElementById("status").textContent = text;
+  document.getElementById("bar").style.width = (100 * status.progress) + "%";
+  if (status.started) {
+    document.getElementById("image").src = "/jobs/" + status.id + "/image?progress=" + status.progress;
+  }
+}
+
+function watch(id) {
+  if (events) events.close();
+  current = id;
+  document.getElementById("title").textContent = "Job " + id;
+  document.getElementById("image").removeAttribute("src");
+  events = new EventSource("/jobs/" + id + "/events");
+  events.addEventListener("status", e => show(JSON.parse(e.data)));
+  events.addEventListener("end", () => events.close());
+  listJobs();
+}
+
+async function listJobs() {
+  const jobs = await (await fetch("/jobs")).json();
+  const list = document.getElementById("jobs");
+  if (jobs.length == 0) return;
+  list.textContent = "";
+  for (const job of jobs) {
+    const link = document.createElement("a");
+    link.href = "#" + job.id;
+    link.textContent = job.id + " (" + job.status + ")";
+    if (job.id == current) link.className = "current";
+    list.appendChild(link);
+  }
+  const wanted = location.hash.slice(1) || jobs[jobs.length - 1].id;
+  if (wanted != current) watch(wanted);
+}
+
+window.addEventListener("hashchange", () => watch(location.hash.slice(1)));
+listJobs();
+setInterval(listJobs, 2000);
+</script>
+</body>
+</html>
+`
+
+func (s *Server) preview(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, previewPage)
+}
+
+// how often the events of a job are checked for changes
+const eventInterval = 250 * time.Millisecond
+
+// streams the job's status as server-sent events until it ends (or the client goes away),
+// `status` events whenever something changed and an `end` event at the end
+func (s *Server) events(w http.ResponseWriter, r *http.Request, job *Job) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ticker := time.NewTicker(eventInterval)
+	defer ticker.Stop()
+	var last JobStatus
+	for first := true; ; first = false {
+		status := job.Status()
+		if first || status != last {
+			data, _ := json.Marshal(status)
+			fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+			flusher.Flush()
+			last = status
+		}
+		if status.Finished != nil {
+			fmt.Fprint(w, "event: end\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"time"
+
+	"./vec3"
+)
+
+// progressive rendering: the samples are taken in passes, after every pass the image so far
+// and a checkpoint are written, so a render can be stopped and resumed later
+type ProgressiveSettings struct {
+	Passes     int
+	Checkpoint string
+	Resume     bool
+	Scene      string // identifies the scene (setup and input file), checkpoints only resume the same one
+}
+
+var PROGRESSIVE = ProgressiveSettings{Checkpoint: "output.checkpoint"}
+
+// everything needed to continue a render
+type Checkpoint struct {
+	Width, Height int
+	SceneHash     uint64
+	Sampler       string
+	Filter        string
+	Integrator    IntegratorSettings // samples of different estimators must not be mixed
+	Adaptive      AdaptiveSettings   // the heatmap aside
+	Seed          int64
+	NextSample    int // index of the first sample of the next pass
+	Passes        int
+
+	Sum    []vec3.Vec3
+	Weight []float64
+	Counts []int
+	Splat  []vec3.Vec3 // nil unless light was traced to the camera
+}
+
+func hashBytes(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+func saveCheckpoint(filename string, c *Checkpoint) error {
+	// written next to the old one first, a crash while writing keeps the old checkpoint
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(c); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+func loadCheckpoint(filename string) (*Checkpoint, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c := &Checkpoint{}
+	if err := gob.NewDecoder(f).Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	n := c.Width * c.Height
+	if len(c.Sum) != n || len(c.Weight) != n || len(c.Counts) != n || (c.Splat != nil && len(c.Splat) != n) {
+		return nil, fmt.Errorf("%s: truncated checkpoint", filename)
+	}
+	return c, nil
+}
+
+func (f *Film) checkpoint() *Checkpoint {
+	return &Checkpoint{Width: f.Width, Height: f.Height, Sum: f.sum, Weight: f.weight, Counts: f.Counts, Splat: f.splat}
+}
+
+func (f *Film) restore(c *Checkpoint) {
+	copy(f.sum, c.Sum)
+	copy(f.weight, c.Weight)
+	copy(f.Counts, c.Counts)
+	if c.Splat != nil {
+		f.splat = append([]vec3.Vec3(nil), c.Splat...)
+	}
+}
+
+// view describes the camera, together with the settings it makes up the scene hash
+func renderProgressive(nx, ny, ns int, camera Camera, scene *Scene, view string) error {
+	filter, err := newFilter(FILTER)
+	if err != nil {
+		return err
+	}
+	film := NewFilm(nx, ny, filter)
+	if renderAOVs() {
+		// the passes are not kept in checkpoints, they start over when resuming
+		film.EnableAOVs()
+	}
+	sceneHash := hashBytes([]byte(fmt.Sprint(PROGRESSIVE.Scene, view, CAMERA)))
+	var seed int64
+	nextSample, passes := 0, 0
+
+	if PROGRESSIVE.Resume {
+		c, err := loadCheckpoint(PROGRESSIVE.Checkpoint)
+		if err != nil {
+			return err
+		}
+		switch {
+		case c.SceneHash != sceneHash:
+			return fmt.Errorf("checkpoint `%s` is of another scene or camera", PROGRESSIVE.Checkpoint)
+		case c.Width != nx || c.Height != ny:
+			return fmt.Errorf("checkpoint `%s` is %dx%d", PROGRESSIVE.Checkpoint, c.Width, c.Height)
+		case c.Sampler != SAMPLER || c.Filter != FILTER:
+			return fmt.Errorf("checkpoint `%s` uses sampler %s and filter %s", PROGRESSIVE.Checkpoint, c.Sampler, c.Filter)
+		case c.Integrator != INTEGRATOR:
+			return fmt.Errorf("checkpoint `%s` uses integrator %s with other settings (%+v)", PROGRESSIVE.Checkpoint, c.Integrator.Kind, c.Integrator)
+		case c.Adaptive.Threshold != ADAPTIVE.Threshold || c.Adaptive.MaxSamples != ADAPTIVE.MaxSamples:
+			return fmt.Errorf("checkpoint `%s` uses adaptive sampling with threshold %g and at most %d samples", PROGRESSIVE.Checkpoint, c.Adaptive.Threshold, c.Adaptive.MaxSamples)
+		}
+		film.restore(c)
+		seed, nextSample, passes = c.Seed, c.NextSample, c.Passes
+		fmt.Printf("Resuming after %d passes (%d samples per pixel)\n", passes, nextSample)
+	}
+
+	for p := 0; p < PROGRESSIVE.Passes; p++ {
+		start := time.Now()
+		if err := renderPass(film, ns, nextSample, camera, scene, SAMPLER, seed); err != nil {
+			return err
+		}
+		nextSample += ns
+		passes++
+
+		if err := saveOutput(film, camera); err != nil {
+			return err
+		}
+		c := film.checkpoint()
+		c.SceneHash, c.Sampler, c.Filter = sceneHash, SAMPLER, FILTER
+		c.Integrator, c.Adaptive = INTEGRATOR, AdaptiveSettings{Threshold: ADAPTIVE.Threshold, MaxSamples: ADAPTIVE.MaxSamples}
+		c.Seed, c.NextSample, c.Passes = seed, nextSample, passes
+		if err := saveCheckpoint(PROGRESSIVE.Checkpoint, c); err != nil {
+			return err
+		}
+		fmt.Printf("Pass %d: %d samples per pixel (%v)\n", passes, nextSample, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 
 type Ray struct {
     A, B vec3.Vec3
+    Time float64  // moment during the exposure, for motion blur
 }
 
 func (r Ray) Origin() vec3.Vec3 {
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+	"sync"
+
+	"./vec3"
+)
+
+// source of the random numbers of a pixel's samples
+// every sample of a pixel is a point in many dimensions (jitter, lens, then a few per bounce),
+// samplers spread these points out better than independent random numbers
+type Sampler interface {
+	// starts sample `index` of pixel (x, y) at the first dimension
+	StartSample(x, y, index int)
+	SetDimension(dimension int)
+	Get1D() float64
+	Get2D() (float64, float64)
+}
+
+// dimensions used by a path: pixel jitter (0, 1), lens (2, 3) and time (4),
+// then scattering (4 dimensions) and light sampling (2) at every bounce
+const (
+	pixelDimension = 0
+	lensDimension  = 2
+	timeDimension  = 4
+)
+
+func scatterDimension(depth int) int {
+	return 5 + 6*depth
+}
+
+func lightDimension(depth int) int {
+	return 5 + 6*depth + 4
+}
+
+var samplerKinds = []string{"independent", "stratified", "halton", "sobol", "bluenoise"}
+
+// samplesPerPixel is what the stratified sampler divides the pixel into, seed tells renders apart
+// and stream the samplers of one render (each goroutine needs its own)
+func newSampler(kind string, samplesPerPixel int, seed, stream int64) (Sampler, error) {
+	rng := rand.New(rand.NewSource(int64(hash(uint32(seed), uint32(stream)))))
+	switch kind {
+	case "independent":
+		return &IndependentSampler{rng: rng}, nil
+	case "stratified":
+		return &StratifiedSampler{Samples: samplesPerPixel, seed: uint32(seed), rng: rng}, nil
+	case "halton":
+		return &HaltonSampler{seed: uint32(seed), rng: rng}, nil
+	case "sobol":
+		return &SobolSampler{seed: uint32(seed)}, nil
+	case "bluenoise":
+		return &SobolSampler{seed: uint32(seed), blueNoise: true}, nil
+	}
+	return nil, fmt.Errorf("unknown sampler `%s`", kind)
+}
+
+
+// uniform direction
+func sampleSphere(u, v float64) vec3.Vec3 {
+	z := 1 - 2*u
+	r := math.Sqrt(math.Max(0, 1-z*z))
+	phi := 2 * math.Pi * v
+	return vec3.New(r*math.Cos(phi), r*math.Sin(phi), z)
+}
+
+// uniform point in the unit ball
+func sampleBall(u, v, w float64) vec3.Vec3 {
+	return vec3.Scale(sampleSphere(u, v), math.Cbrt(w))
+}
+
+// uniform point in the unit disk (Shirley's concentric mapping, keeps strata together)
+func sampleDisk(u, v float64) (float64, float64) {
+	a, b := 2*u-1, 2*v-1
+	if a == 0 && b == 0 {
+		return 0, 0
+	}
+	var r, phi float64
+	if math.Abs(a) > math.Abs(b) {
+		r, phi = a, math.Pi/4*(b/a)
+	} else {
+		r, phi = b, math.Pi/2-math.Pi/4*(a/b)
+	}
+	return r * math.Cos(phi), r * math.Sin(phi)
+}
+
+
+// hash of a few integers (murmur3 finalizer)
+func hash(values ...uint32) uint32 {
+	h := uint32(0x9e3779b9)
+	for _, v := range values {
+		h ^= v
+		h ^= h >> 16
+		h *= 0x85ebca6b
+		h ^= h >> 13
+		h *= 0xc2b2ae35
+		h ^= h >> 16
+	}
+	return h
+}
+
+// i-th element of a random permutation of 0..l-1 chosen by p, without storing it
+// (Kensler, "Correlated Multi-Jittered Sampling")
+func permute(i, l, p uint32) uint32 {
+	w := l - 1
+	w |= w >> 1
+	w |= w >> 2
+	w |= w >> 4
+	w |= w >> 8
+	w |= w >> 16
+	for {
+		i ^= p
+		i *= 0xe170893d
+		i ^= p >> 16
+		i ^= (i & w) >> 4
+		i ^= p >> 8
+		i *= 0x0929eb3f
+		i ^= p >> 23
+		i ^= (i & w) >> 1
+		i *= 1 | p>>27
+		i *= 0x6935fa69
+		i ^= (i & w) >> 11
+		i *= 0x74dcb303
+		i ^= (i & w) >> 2
+		i *= 0x9e501cc3
+		i ^= (i & w) >> 2
+		i *= 0xc860a3df
+		i &= w
+		i ^= i >> 5
+		if i < l {
+			break
+		}
+	}
+	return (i + p) % l
+}
+
+// fraction in [0, 1) of a 32 bit integer
+func unitFloat(v uint32) float64 {
+	return math.Min(float64(v)/(1<<32), 1-1e-16)
+}
+
+
+// independent random numbers (what every sample used before samplers)
+type IndependentSampler struct {
+	rng *rand.Rand
+}
+
+func (s *IndependentSampler) StartSample(x, y, index int) {}
+
+func (s *IndependentSampler) SetDimension(dimension int) {}
+
+func (s *IndependentSampler) Get1D() float64 {
+	return s.rng.Float64()
+}
+
+func (s *IndependentSampler) Get2D() (float64, float64) {
+	return s.rng.Float64(), s.rng.Float64()
+}
+
+
+// jittered strata, every dimension is divided into as many strata as there are samples
+// and the samples visit them in a random order per pixel and dimension (pairs use a grid if possible)
+type StratifiedSampler struct {
+	Samples          int
+	x, y, index, dim int
+	seed             uint32
+	rng              *rand.Rand
+}
+
+func (s *StratifiedSampler) StartSample(x, y, index int) {
+	s.x, s.y, s.index, s.dim = x, y, index, 0
+}
+
+func (s *StratifiedSampler) SetDimension(dimension int) {
+	s.dim = dimension
+}
+
+// stratum of the current sample, samples beyond the count start another round of strata
+func (s *StratifiedSampler) stratum(n, salt int) int {
+	round := s.index / n
+	seed := hash(uint32(s.x), uint32(s.y), uint32(s.dim), uint32(round), uint32(salt), s.seed)
+	return int(permute(uint32(s.index%n), uint32(n), seed))
+}
+
+func (s *StratifiedSampler) Get1D() float64 {
+	n := maxInt(s.Samples, 1)
+	u := (float64(s.stratum(n, 0)) + s.rng.Float64()) / float64(n)
+	s.dim++
+	return u
+}
+
+func (s *StratifiedSampler) Get2D() (float64, float64) {
+	n := maxInt(s.Samples, 1)
+	var u, v float64
+	if k := int(math.Sqrt(float64(n)) + 0.5); k*k == n {
+		p := s.stratum(n, 0)
+		u = (float64(p%k) + s.rng.Float64()) / float64(k)
+		v = (float64(p/k) + s.rng.Float64()) / float64(k)
+	} else {
+		// latin hypercube: stratified along each axis on its own
+		u = (float64(s.stratum(n, 1)) + s.rng.Float64()) / float64(n)
+		v = (float64(s.stratum(n, 2)) + s.rng.Float64()) / float64(n)
+	}
+	s.dim += 2
+	return u, v
+}
+
+
+// Halton sequence, one prime base per dimension, with the digits scrambled per pixel and dimension
+// (unscrambled, neighbouring large bases are strongly correlated for small sample counts)
+type HaltonSampler struct {
+	x, y, index, dim int
+	seed             uint32
+	rng              *rand.Rand
+}
+
+var haltonPrimes = firstPrimes(128)
+
+func firstPrimes(n int) []int {
+	var primes []int
+	for p := 2; len(primes) < n; p++ {
+		prime := true
+		for _, q := range primes {
+			if q*q > p {
+				break
+			}
+			if p%q == 0 {
+				prime = false
+				break
+			}
+		}
+		if prime {
+			primes = append(primes, p)
+		}
+	}
+	return primes
+}
+
+// digits of i in the given base mirrored around the decimal point, every digit position
+// permuted randomly by seed (the zeros beyond the last digit too, until they no longer matter)
+func scrambledRadicalInverse(base, i int, seed uint32) float64 {
+	inverse := 1.0 / float64(base)
+	f := inverse
+	result := 0.0
+	for k := 0; i > 0 || f > 1e-9; k++ {
+		digit := permute(uint32(i%base), uint32(base), hash(seed, uint32(k)))
+		result += float64(digit) * f
+		i /= base
+		f *= inverse
+	}
+	return result
+}
+
+func (s *HaltonSampler) StartSample(x, y, index int) {
+	s.x, s.y, s.index, s.dim = x, y, index, 0
+}
+
+func (s *HaltonSampler) SetDimension(dimension int) {
+	s.dim = dimension
+}
+
+func (s *HaltonSampler) Get1D() float64 {
+	d := s.dim
+	s.dim++
+	if d >= len(haltonPrimes) {
+		return s.rng.Float64()
+	}
+	seed := hash(uint32(s.x), uint32(s.y), uint32(d), s.seed)
+	return math.Min(scrambledRadicalInverse(haltonPrimes[d], s.index, seed), 1-1e-16)
+}
+
+func (s *HaltonSampler) Get2D() (float64, float64) {
+	u := s.Get1D()
+	return u, s.Get1D()
+}
+
+
+// Sobol sequence with hash-based Owen scrambling (Burley, "Practical Hash-based Owen Scrambling")
+// every pair of dimensions uses the first two Sobol dimensions with its own shuffle and scramble,
+// so no table of direction numbers is needed
+// with blueNoise all pixels share the sequence and are offset by a blue noise texture instead,
+// which moves the remaining error to high frequencies (Heitz and Belcour)
+type SobolSampler struct {
+	x, y, index, dim int
+	seed             uint32
+	blueNoise        bool
+}
+
+// direction numbers of the second Sobol dimension
+var sobolMatrix = func() [32]uint32 {
+	var m [32]uint32
+	m[0] = 1 << 31
+	for i := 1; i < 32; i++ {
+		m[i] = m[i-1] ^ (m[i-1] >> 1)
+	}
+	return m
+}()
+
+// the first two Sobol dimensions of point i (the first is the van der Corput sequence)
+func sobol2D(i uint32) (uint32, uint32) {
+	x := bits.Reverse32(i)
+	y := uint32(0)
+	for k := 0; i != 0; i, k = i>>1, k+1 {
+		if i&1 != 0 {
+			y ^= sobolMatrix[k]
+		}
+	}
+	return x, y
+}
+
+func laineKarrasPermutation(x, seed uint32) uint32 {
+	x += seed
+	x ^= x * 0x6c50b47c
+	x ^= x * 0xb82f1e52
+	x ^= x * 0xc7afe638
+	x ^= x * 0x8d22f6e6
+	return x
+}
+
+func nestedUniformScramble(x, seed uint32) uint32 {
+	return bits.Reverse32(laineKarrasPermutation(bits.Reverse32(x), seed))
+}
+
+func (s *SobolSampler) StartSample(x, y, index int) {
+	s.x, s.y, s.index, s.dim = x, y, index, 0
+}
+
+func (s *SobolSampler) SetDimension(dimension int) {
+	s.dim = dimension
+}
+
+func (s *SobolSampler) Get1D() float64 {
+	u, _ := s.sample()
+	s.dim++
+	return u
+}
+
+func (s *SobolSampler) Get2D() (float64, float64) {
+	u, v := s.sample()
+	s.dim += 2
+	return u, v
+}
+
+func (s *SobolSampler) sample() (float64, float64) {
+	seed := hash(uint32(s.x), uint32(s.y), uint32(s.dim), s.seed)
+	if s.blueNoise {
+		seed = hash(uint32(s.dim), s.seed)
+	}
+	x, y := sobol2D(nestedUniformScramble(uint32(s.index), seed))
+	u := unitFloat(nestedUniformScramble(x, hash(seed, 1)))
+	v := unitFloat(nestedUniformScramble(y, hash(seed, 2)))
+	if s.blueNoise {
+		du, dv := blueNoiseOffset(s.x, s.y, s.dim)
+		u, v = u+du, v+dv
+		u, v = u-math.Floor(u), v-math.Floor(v)
+	}
+	return u, v
+}
+
+
+// tileable blue noise texture, ranks of the pixels made by void and cluster (Ulichney)
+const blueNoiseSize = 64
+
+var (
+	blueNoiseOnce    sync.Once
+	blueNoiseTexture []float64
+)
+
+func blueNoiseOffset(x, y, dimension int) (float64, float64) {
+	blueNoiseOnce.Do(func() { blueNoiseTexture = voidAndCluster(blueNoiseSize, 1.5) })
+	// other dimensions look at the texture shifted by a random amount
+	lookup := func(salt uint32) float64 {
+		h := hash(uint32(dimension), salt)
+		i := (x + int(h%blueNoiseSize)) % blueNoiseSize
+		j := (y + int((h>>8)%blueNoiseSize)) % blueNoiseSize
+		return blueNoiseTexture[j*blueNoiseSize+i]
+	}
+	return lookup(1), lookup(2)
+}
+
+// texture of size x size values in [0, 1), evenly spread and without low frequencies
+func voidAndCluster(size int, sigma float64) []float64 {
+	n := size * size
+	ones := make([]bool, n)
+	energy := make([]float64, n)
+	// gaussian splat around a pixel, wrapping around the edges
+	kernel := make([]float64, n)
+	for y := 0; y < size; y++ {
+		dy := float64(minInt(y, size-y))
+		for x := 0; x < size; x++ {
+			dx := float64(minInt(x, size-x))
+			kernel[y*size+x] = math.Exp(-(dx*dx + dy*dy) / (2 * sigma * sigma))
+		}
+	}
+	splat := func(p int, sign float64) {
+		px, py := p%size, p/size
+		for y := 0; y < size; y++ {
+			row := ((y - py + size) % size) * size
+			for x := 0; x < size; x++ {
+				energy[y*size+x] += sign * kernel[row+(x-px+size)%size]
+			}
+		}
+	}
+	set := func(p int, value bool) {
+		ones[p] = value
+		if value {
+			splat(p, 1)
+		} else {
+			splat(p, -1)
+		}
+	}
+	// tightest cluster: the one with the most energy, largest void: the zero with the least
+	tightest := func() int {
+		best := -1
+		for p := 0; p < n; p++ {
+			if ones[p] && (best < 0 || energy[p] > energy[best]) {
+				best = p
+			}
+		}
+		return best
+	}
+	largestVoid := func() int {
+		best := -1
+		for p := 0; p < n; p++ {
+			if !ones[p] && (best < 0 || energy[p] < energy[best]) {
+				best = p
+			}
+		}
+		return best
+	}
+
+	// random initial pattern, relaxed by moving points from clusters into voids
+	rng := rand.New(rand.NewSource(1))
+	initial := n / 10
+	for count := 0; count < initial; {
+		if p := rng.Intn(n); !ones[p] {
+			set(p, true)
+			count++
+		}
+	}
+	for {
+		cluster := tightest()
+		set(cluster, false)
+		void := largestVoid()
+		if void == cluster {
+			set(cluster, true)
+			break
+		}
+		set(void, true)
+	}
+	pattern := make([]bool, n)
+	copy(pattern, ones)
+	saved := make([]float64, n)
+	copy(saved, energy)
+
+	rank := make([]int, n)
+	// ranks of the initial points, removing the tightest clusters first
+	for r := initial - 1; r >= 0; r-- {
+		p := tightest()
+		set(p, false)
+		rank[p] = r
+	}
+	// the remaining pixels, filling the largest voids first
+	copy(ones, pattern)
+	copy(energy, saved)
+	for r := initial; r < n; r++ {
+		p := largestVoid()
+		set(p, true)
+		rank[p] = r
+	}
+
+	texture := make([]float64, n)
+	for p := range texture {
+		texture[p] = (float64(rank[p]) + 0.5) / float64(n)
+	}
+	return texture
+}
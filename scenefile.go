@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"./vec3"
+)
+
+// scene described in JSON (for -scene and the render server) instead of in Go, e.g.
+//
+//	{
+//	  "width": 400, "height": 300, "samples": 32,
+//	  "camera": {"lookFrom": [0, 1, 4], "lookAt": [0, 0, -1], "fov": 40},
+//	  "background": [0.6, 0.8, 1.0],
+//	  "materials": {"red": {"type": "lambertian", "albedo": [0.8, 0.1, 0.1]}},
+//	  "objects": [
+//	    {"type": "sphere", "center": [0, 0, -1], "radius": 0.5, "material": "red"},
+//	    {"type": "plane", "point": [0, -0.5, 0], "normal": [0, 1, 0],
+//	     "material": {"type": "metal", "albedo": [0.8, 0.8, 0.8], "fuzz": 0.1}}
+//	  ],
+//	  "lights": [{"type": "point", "position": [2, 3, 2]}]
+//	}
+//
+// objects: sphere, movingSphere, plane, triangle, rectangle, box, mesh (binary STL) and heightfield
+// materials: lambertian, metal, dielectric and texture
+// lights: point, spot and directional
+// the environment is an image file or a physical sky (with "sun" set)
+//
+// the camera, objects, lights and materials can be animated with "tracks" (see Track), e.g.
+//
+//	"animation": {"frames": [0, 47], "shutter": 0.5},
+//	"camera": {"lookAt": [0, 0, -1], "tracks": {"lookFrom": {"keys": [{"frame": 0, "value": [0, 1, 4]}, {"frame": 47, "value": [4, 1, 0]}]}}}
+type SceneFile struct {
+	Width, Height, Samples int    // zero keeps the command line's
+	Sampler, Filter        string // empty keeps the command line's
+
+	Camera      SceneCamera
+	Background  *vector
+	Environment *SceneEnvironment
+	Materials   map[string]json.RawMessage
+	Objects     []SceneObject
+	Lights      []SceneLight
+	Animation   *SceneAnimation
+
+	frame float64 // see AtFrame
+}
+
+type SceneCamera struct {
+	LookFrom, LookAt vector
+	// kind, fov, focalLength, fNumber, stereo ... like the command line flags
+	CameraSettings
+	Tracks Tracks // lookFrom, lookAt and fov
+}
+
+type SceneEnvironment struct {
+	File      string
+	Rotation  float64
+	Intensity float64
+
+	// physical sky
+	Sun          *vector // direction towards the sun
+	Turbidity    float64
+	GroundAlbedo *vector
+}
+
+type SceneObject struct {
+	Type     string
+	Material json.RawMessage // name of one of the materials or a material
+
+	Center, Center1 vector // sphere and moving sphere (at times 0 and 1)
+	Radius          float64
+	Point, Normal   vector   // plane
+	Vertices        []vector // triangle, three corners of a rectangle
+	Min, Max        vector   // box
+	File            string   // mesh and heightfield
+	Scale           float64  // mesh
+	Translation     vector   // mesh
+	Corner, Size    vector   // heightfield
+
+	Transform *SceneTransform
+	Tracks    Tracks // translation, rotation and scale (of the transform)
+}
+
+// placement of an object: scaled, then rotated (degrees around x, y and z) and then translated
+type SceneTransform struct {
+	Translation, Rotation vector
+	Scale                 *vector
+}
+
+type SceneMaterial struct {
+	Type            string
+	Albedo          vector
+	Fuzz            float64 // metal
+	RefractiveIndex float64 // dielectric
+	Absorption      vector  // dielectric
+	Image           string  // texture
+	Tracks          Tracks  // albedo, fuzz, refractiveIndex and absorption
+}
+
+type SceneLight struct {
+	Type      string
+	Position  vector
+	Direction vector
+	Angle     float64 // spot: cone, degrees
+	Falloff   float64 // spot: full intensity up to this many degrees
+	Intensity *vector // default 1, 1, 1
+	Color     *vector // default white
+	Tracks    Tracks  // position, direction, color and intensity
+}
+
+// [x, y, z] in JSON
+type vector [3]float64
+
+func (v vector) vec() vec3.Vec3 {
+	return vec3.New(v[0], v[1], v[2])
+}
+
+// defaults for what a scene file leaves out
+func (v *vector) or(x, y, z float64) vec3.Vec3 {
+	if v == nil {
+		return vec3.New(x, y, z)
+	}
+	return v.vec()
+}
+
+func loadSceneFile(filename string) (*SceneFile, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parseSceneFile(contents)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return f, nil
+}
+
+func parseSceneFile(contents []byte) (*SceneFile, error) {
+	f := &SceneFile{}
+	f.Camera.CameraSettings = CAMERA
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(f); err != nil {
+		return nil, err
+	}
+	if a := f.Animation; a != nil && (a.Frames[1] < a.Frames[0] || a.Shutter < 0 || a.Shutter > 1) {
+		return nil, fmt.Errorf("animation frames have to be [first, last] and the shutter 0 to 1")
+	}
+	if err := f.Camera.Tracks.check("lookFrom", "lookAt", "fov"); err != nil {
+		return nil, fmt.Errorf("camera: %v", err)
+	}
+	return f, nil
+}
+
+// builds the scene, the files it uses are looked up with open (which may refuse them)
+func (f *SceneFile) Build(open func(name string) (string, error)) (*Scene, error) {
+	if open == nil {
+		open = func(name string) (string, error) { return name, nil }
+	}
+	scene := &Scene{Background: f.Background.or(0.6, 0.8, 1.0)}
+
+	materials := map[string]Material{}
+	for name, raw := range f.Materials {
+		m, err := f.material(raw, nil, open)
+		if err != nil {
+			return nil, fmt.Errorf("material `%s`: %v", name, err)
+		}
+		materials[name] = m
+	}
+	for i, o := range f.Objects {
+		objects, err := f.object(o, materials, open)
+		if err != nil {
+			return nil, fmt.Errorf("object %d (%s): %v", i+1, o.Type, err)
+		}
+		scene.World = append(scene.World, objects...)
+	}
+	for i, l := range f.Lights {
+		light, err := l.light(f.frame)
+		if err != nil {
+			return nil, fmt.Errorf("light %d: %v", i+1, err)
+		}
+		scene.Lights = append(scene.Lights, light)
+	}
+
+	if e := f.Environment; e != nil {
+		intensity := e.Intensity
+		if intensity == 0 {
+			intensity = 1
+		}
+		switch {
+		case e.Sun != nil:
+			turbidity := e.Turbidity
+			if turbidity == 0 {
+				turbidity = 3
+			}
+			scene.Environment = NewPhysicalSky(e.Sun.vec(), turbidity, e.GroundAlbedo.or(0.3, 0.3, 0.3), 0.05*intensity)
+		case e.File != "":
+			filename, err := open(e.File)
+			if err != nil {
+				return nil, err
+			}
+			environment, err := loadEnvironmentLight(filename, e.Rotation, intensity)
+			if err != nil {
+				return nil, err
+			}
+			scene.Environment = environment
+		default:
+			return nil, fmt.Errorf("the environment needs a file or a sun")
+		}
+	}
+	return scene, nil
+}
+
+// for Build: files have to be inside the directory root (scene files sent over the network)
+func insideOf(root string) func(name string) (string, error) {
+	return func(name string) (string, error) {
+		if !filepath.IsLocal(name) {
+			return "", fmt.Errorf("`%s` is outside of the server's directory", name)
+		}
+		return filepath.Join(root, name), nil
+	}
+}
+
+// the camera's files looked up with open, like Build does for the scene's
+func (settings CameraSettings) files(open func(name string) (string, error)) (CameraSettings, error) {
+	if settings.Aperture != "" {
+		filename, err := open(settings.Aperture)
+		if err != nil {
+			return settings, err
+		}
+		settings.Aperture = filename
+	}
+	return settings, nil
+}
+
+// view of the scene file's camera: lookFrom, lookAt and vertical field of view
+func (f *SceneFile) View() (vec3.Vec3, vec3.Vec3, float64) {
+	vfov := f.Camera.FOV
+	if vfov == 0 {
+		vfov = 40
+	}
+	tracks := f.Camera.Tracks
+	return tracks.at("lookFrom", f.frame, f.Camera.LookFrom.vec()),
+		tracks.at("lookAt", f.frame, f.Camera.LookAt.vec()),
+		tracks.scalarAt("fov", f.frame, vfov)
+}
+
+// camera settings for the view, an animated field of view replaces the static one
+// (which newCamera would otherwise prefer)
+func (f *SceneFile) viewSettings(settings CameraSettings, vfov float64) CameraSettings {
+	if _, ok := f.Camera.Tracks["fov"]; ok {
+		settings.FOV = vfov
+	}
+	return settings
+}
+
+// a material by name or given in place
+func (f *SceneFile) material(raw json.RawMessage, materials map[string]Material, open func(string) (string, error)) (Material, error) {
+	if len(raw) == 0 {
+		return Lambertian{vec3.New(0.5, 0.5, 0.5)}, nil
+	}
+	var name string
+	if json.Unmarshal(raw, &name) == nil {
+		if m, ok := materials[name]; ok {
+			return m, nil
+		}
+		return nil, fmt.Errorf("unknown material `%s`", name)
+	}
+	var m SceneMaterial
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&m); err != nil {
+		return nil, err
+	}
+	if err := m.Tracks.check("albedo", "fuzz", "refractiveIndex", "absorption"); err != nil {
+		return nil, err
+	}
+	albedo := m.Tracks.at("albedo", f.frame, m.Albedo.vec())
+	switch m.Type {
+	case "lambertian", "":
+		return Lambertian{albedo}, nil
+	case "metal":
+		return Metal{albedo, m.Tracks.scalarAt("fuzz", f.frame, m.Fuzz)}, nil
+	case "dielectric":
+		index := m.RefractiveIndex
+		if index == 0 {
+			index = 1.5
+		}
+		index = m.Tracks.scalarAt("refractiveIndex", f.frame, index)
+		return Dielectric{RefractiveIndex: index, Absorption: m.Tracks.at("absorption", f.frame, m.Absorption.vec())}, nil
+	case "texture":
+		filename, err := open(m.Image)
+		if err != nil {
+			return nil, err
+		}
+		texture, err := loadImageTexture(filename)
+		if err != nil {
+			return nil, err
+		}
+		return TexturedLambertian{texture}, nil
+	}
+	return nil, fmt.Errorf("unknown material type `%s`", m.Type)
+}
+
+func (f *SceneFile) object(o SceneObject, materials map[string]Material, open func(string) (string, error)) ([]Hitable, error) {
+	if err := o.Tracks.check("translation", "rotation", "scale"); err != nil {
+		return nil, err
+	}
+	objects, err := f.shape(o, materials, open)
+	if err != nil || (o.Transform == nil && len(o.Tracks) == 0) {
+		return objects, err
+	}
+	placed, err := f.place(o, HitableList(objects))
+	if err != nil {
+		return nil, err
+	}
+	return []Hitable{placed}, nil
+}
+
+func (f *SceneFile) shape(o SceneObject, materials map[string]Material, open func(string) (string, error)) ([]Hitable, error) {
+	m, err := f.material(o.Material, materials, open)
+	if err != nil {
+		return nil, err
+	}
+	switch o.Type {
+	case "sphere":
+		return []Hitable{Sphere{o.Center.vec(), o.Radius, m}}, nil
+	case "movingSphere":
+		s, err := NewMovingSphere(o.Center.vec(), o.Center1.vec(), 0, 1, o.Radius, m)
+		if err != nil {
+			return nil, err
+		}
+		return []Hitable{s}, nil
+	case "plane":
+		return []Hitable{Plane{o.Point.vec(), o.Normal.vec(), m}}, nil
+	case "triangle", "rectangle":
+		if len(o.Vertices) != 3 {
+			return nil, fmt.Errorf("needs three vertices")
+		}
+		v1, v2, v3 := o.Vertices[0].vec(), o.Vertices[1].vec(), o.Vertices[2].vec()
+		if o.Type == "triangle" {
+			return []Hitable{Triangle{v1, v2, v3, m}}, nil
+		}
+		t1, t2 := makeRectangle(v1, v2, v3, m)
+		return []Hitable{t1, t2}, nil
+	case "box":
+		return makeBox(o.Min.vec(), o.Max.vec(), m), nil
+	case "mesh":
+		filename, err := open(o.File)
+		if err != nil {
+			return nil, err
+		}
+		scale := o.Scale
+		if scale == 0 {
+			scale = 1
+		}
+		triangles, err := loadBinarySTLModel(filename, vec3.Vec3{}, scale, o.Translation.vec())
+		if err != nil {
+			return nil, err
+		}
+		var list []Hitable
+		for _, t := range triangles {
+			t.Material = m
+			list = append(list, t)
+		}
+		// one object (for the object IDs), with a hierarchy of its own
+		return []Hitable{buildBVH(list, 0.0, 1.0)}, nil
+	case "heightfield":
+		filename, err := open(o.File)
+		if err != nil {
+			return nil, err
+		}
+		h, err := loadHeightfield(filename, o.Corner.vec(), o.Size.vec(), m)
+		if err != nil {
+			return nil, err
+		}
+		return []Hitable{h}, nil
+	}
+	return nil, fmt.Errorf("unknown object type")
+}
+
+func (l SceneLight) light(frame float64) (Light, error) {
+	if err := l.Tracks.check("position", "direction", "color", "intensity"); err != nil {
+		return nil, err
+	}
+	intensity := l.Tracks.at("intensity", frame, l.Intensity.or(1.0, 1.0, 1.0))
+	color := l.Tracks.at("color", frame, l.Color.or(1.0, 1.0, 1.0))
+	position := l.Tracks.at("position", frame, l.Position.vec())
+	direction := l.Tracks.at("direction", frame, l.Direction.vec())
+	switch l.Type {
+	case "point":
+		return PointLight{position, intensity, color}, nil
+	case "spot":
+		angle, falloff := l.Angle, l.Falloff
+		if angle == 0 {
+			angle = 30
+		}
+		if falloff == 0 {
+			falloff = 0.8 * angle
+		}
+		return SpotLight{P: position, Direction: direction, Angle: angle, Falloff: falloff, Intensity: intensity, Color: color}, nil
+	case "directional":
+		return DirectionalLight{direction, intensity, color}, nil
+	}
+	return nil, fmt.Errorf("unknown light type `%s`", l.Type)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"math"
 	"math/rand"
 
 	"./vec3"
@@ -30,12 +31,12 @@ func createSampleScene(lookFrom, lookAt *vec3.Vec3, fov *float64) (HitableList,
 	world[3] = Sphere{
 		Center: vec3.New(-1.0, 0.0, -1.0),
 		Radius: 0.5,
-		Material: Dielectric{1.5},
+		Material: Dielectric{RefractiveIndex: 1.5},
 	}
 	world[4] = Sphere{
 		Center: vec3.New(-1.0, 0.0, -1.0),
 		Radius: -0.45,
-		Material: Dielectric{1.5},
+		Material: Dielectric{RefractiveIndex: 1.5},
 	}
 
 	return world, nil
@@ -48,6 +49,23 @@ func makeRectangle(p1, p2, p3 vec3.Vec3, m Material) (Triangle, Triangle) {
 	return t1, t2
 }
 
+// closed box out of 12 triangles, facing outwards
+func makeBox(lo, hi vec3.Vec3, m Material) HitableList {
+	var box HitableList
+	for _, face := range [][3]vec3.Vec3{
+		{vec3.New(lo.X, lo.Y, hi.Z), vec3.New(hi.X, lo.Y, hi.Z), vec3.New(hi.X, hi.Y, hi.Z)},
+		{vec3.New(hi.X, lo.Y, lo.Z), vec3.New(lo.X, lo.Y, lo.Z), vec3.New(lo.X, hi.Y, lo.Z)},
+		{vec3.New(lo.X, lo.Y, lo.Z), vec3.New(lo.X, lo.Y, hi.Z), vec3.New(lo.X, hi.Y, hi.Z)},
+		{vec3.New(hi.X, lo.Y, hi.Z), vec3.New(hi.X, lo.Y, lo.Z), vec3.New(hi.X, hi.Y, lo.Z)},
+		{vec3.New(lo.X, hi.Y, hi.Z), vec3.New(hi.X, hi.Y, hi.Z), vec3.New(hi.X, hi.Y, lo.Z)},
+		{vec3.New(lo.X, lo.Y, lo.Z), vec3.New(hi.X, lo.Y, lo.Z), vec3.New(hi.X, lo.Y, hi.Z)},
+	} {
+		t1, t2 := makeRectangle(face[0], face[1], face[2], m)
+		box = append(box, t1, t2)
+	}
+	return box
+}
+
 func createTriangleScene(lookFrom, lookAt *vec3.Vec3, fov *float64) (HitableList, []Light) {
 	*lookFrom = vec3.New(0, 4.5, 14.0)
 	*lookAt = vec3.New(0, 4.0, -1)
@@ -99,28 +117,28 @@ func createTriangleScene(lookFrom, lookAt *vec3.Vec3, fov *float64) (HitableList
 	world[12] = Sphere{
 		Center: vec3.New(0.0, 0.5, 2.5),
 		Radius: 0.5,
-		Material: Dielectric{1.5},
+		Material: Dielectric{RefractiveIndex: 1.5},
 	}
 	world[13] = Sphere{
 		Center: vec3.New(0.0, 0.5, 2.5),
 		Radius: -0.45,
-		Material: Dielectric{1.5},
+		Material: Dielectric{RefractiveIndex: 1.5},
 	}
 
 	var lights []Light
-	lights = append(lights, Light{
+	lights = append(lights, PointLight{
 		P: vec3.New(-3.0, 0.9, 1.0),
 		Intensity: vec3.New(1.0, 1.0, 1.0),
 		Color: vec3.New(1.0, 1.0, 1.0),
 	})
 
-	/*lights = append(lights, Light{
+	/*lights = append(lights, PointLight{
 		P: vec3.New(3.0, 3.5, -1.0),
 		Intensity: vec3.New(1.0, 1.0, 1.0),
 		Color: vec3.New(1.0, 1.0, 1.0),
 	})*/
 
-	lights = append(lights, Light{
+	lights = append(lights, PointLight{
 		P: vec3.New(0.0, 6.8, 3.0),
 		Intensity: vec3.New(1.0, 1.0, 1.0),
 		Color: vec3.New(1.0, 1.0, 1.0),
@@ -170,19 +188,19 @@ func createModelScene(lookFrom, lookAt *vec3.Vec3, fov *float64) (HitableList, [
 	)//*/
 
 	var lights []Light
-	lights = append(lights, Light{
+	lights = append(lights, PointLight{
 		P: vec3.New(-3.0, 0.9, 1.0),
 		Intensity: vec3.New(1.0, 1.0, 1.0),
 		Color: vec3.New(1.0, 1.0, 1.0),
 	})
 
-	lights = append(lights, Light{
+	lights = append(lights, PointLight{
 		P: vec3.New(0.0, 2.5, -3.0),
 		Intensity: vec3.New(1.0, 1.0, 1.0),
 		Color: vec3.New(1.0, 1.0, 1.0),
 	})
 
-	lights = append(lights, Light{
+	lights = append(lights, PointLight{
 		P: vec3.New(0.0, 3.8, 3.0),
 		Intensity: vec3.New(1.0, 1.0, 1.0),
 		Color: vec3.New(1.0, 1.0, 1.0),
@@ -196,6 +214,9 @@ func createAwesomeScene(lookFrom, lookAt *vec3.Vec3, fov *float64) (HitableList,
 	*lookAt = vec3.New(0, 0, -1)
 	*fov = 90.0
 
+	// always the same spheres, so renders can be resumed (see renderProgressive)
+	rng := rand.New(rand.NewSource(1))
+
 	n := 488
 	world := make([]Hitable, n)
 	world[0] = Sphere{
@@ -207,13 +228,13 @@ func createAwesomeScene(lookFrom, lookAt *vec3.Vec3, fov *float64) (HitableList,
 	i := 1
 	for a := -11.0; a < 11.0; a++ {
 		for b := -11.0; b < 11.0; b++ {
-			chooseMat := rand.Float64()
-			center := vec3.New(a + 0.9*rand.Float64(), 0.2, b + 0.9*rand.Float64())
+			chooseMat := rng.Float64()
+			center := vec3.New(a + 0.9*rng.Float64(), 0.2, b + 0.9*rng.Float64())
 			if vec3.Len(vec3.Sub(center, vec3.New(4, 0.2, 0))) > 0.9 {
 				if chooseMat < 0.8 { // diffuse
-					r := rand.Float64()*rand.Float64()
-					g := rand.Float64()*rand.Float64()
-					b := rand.Float64()*rand.Float64()
+					r := rng.Float64()*rng.Float64()
+					g := rng.Float64()*rng.Float64()
+					b := rng.Float64()*rng.Float64()
 					world[i] = Sphere{
 						Center: center,
 						Radius: 0.2,
@@ -221,10 +242,10 @@ func createAwesomeScene(lookFrom, lookAt *vec3.Vec3, fov *float64) (HitableList,
 					}
 					i += 1
 				} else if chooseMat < 0.95 { // metal
-					r := 0.5*(1 + rand.Float64())
-					g := 0.5*(1 + rand.Float64())
-					b := 0.5*(1 + rand.Float64())
-					fuzz := 0.5*rand.Float64()
+					r := 0.5*(1 + rng.Float64())
+					g := 0.5*(1 + rng.Float64())
+					b := 0.5*(1 + rng.Float64())
+					fuzz := 0.5*rng.Float64()
 					world[i] = Sphere{
 						Center: center,
 						Radius: 0.2,
@@ -235,7 +256,7 @@ func createAwesomeScene(lookFrom, lookAt *vec3.Vec3, fov *float64) (HitableList,
 					world[i] = Sphere{
 						Center: center,
 						Radius: 0.2,
-						Material: Dielectric{1.5},
+						Material: Dielectric{RefractiveIndex: 1.5},
 					}
 					i += 1
 				}
@@ -243,9 +264,203 @@ func createAwesomeScene(lookFrom, lookAt *vec3.Vec3, fov *float64) (HitableList,
 		}
 	}
 
-	world[i+0] = Sphere{vec3.New(0, 1, 0), 1.0, Dielectric{1.5}}
+	world[i+0] = Sphere{vec3.New(0, 1, 0), 1.0, Dielectric{RefractiveIndex: 1.5}}
 	world[i+1] = Sphere{vec3.New(-4, 1, 0), 1.0, Lambertian{vec3.New(0.4, 0.2, 0.1)}}
 	world[i+2] = Sphere{vec3.New(4, 1, 0), 1.0, Metal{vec3.New(0.7, 0.6, 0.5), 0.0}}
 
 	return world[:i+3], nil
 }
+
+func createTerrainScene(lookFrom, lookAt *vec3.Vec3, fov *float64) (HitableList, []Light) {
+	*lookFrom = vec3.New(0.0, 9.0, 16.0)
+	*lookAt = vec3.New(0, 0.5, 0)
+	*fov = 50.0
+
+	world := make(HitableList, 1)
+	world[0] = Plane{
+		Point: vec3.New(0, 0.3, 0),
+		Normal: vec3.New(0, 1, 0),
+		Material: Metal{vec3.New(0.3, 0.4, 0.6), 0.05},
+	}
+
+	var lights []Light
+	lights = append(lights, PointLight{
+		P: vec3.New(-20.0, 30.0, 10.0),
+		Intensity: vec3.New(25.0, 25.0, 25.0),
+		Color: vec3.New(1.0, 0.95, 0.85),
+	})
+
+	return world, lights
+}
+
+// objects move while the shutter is open (between time 0 and 1)
+func createMotionScene(lookFrom, lookAt *vec3.Vec3, fov *float64) (HitableList, []Light) {
+	*lookFrom = vec3.New(0, 1.5, 6.0)
+	*lookAt = vec3.New(0, 0.8, 0)
+	*fov = 45.0
+
+	world := make(HitableList, 0, 8)
+	world = append(world, Sphere{
+		Center: vec3.New(0, -1000, 0),
+		Radius: 1000,
+		Material: Lambertian{vec3.New(0.5, 0.5, 0.5)},
+	})
+	sphere, err := NewMovingSphere(vec3.New(-2.0, 0.5, 0), vec3.New(-2.0, 1.2, 0), 0.0, 1.0, 0.5, Lambertian{vec3.New(0.7, 0.2, 0.1)})
+	if err != nil {
+		panic(err)
+	}
+	world = append(world, sphere)
+	world = append(world, Sphere{
+		Center: vec3.New(0, 0.7, 0),
+		Radius: 0.7,
+		Material: Metal{vec3.New(0.7, 0.6, 0.5), 0.0},
+	})
+
+	// a box spinning and sliding to the right
+	box := makeBox(vec3.New(-0.5, -0.5, -0.5), vec3.New(0.5, 0.5, 0.5), Lambertian{vec3.New(0.1, 0.3, 0.7)})
+	moving, err := NewMovingInstance(box, []Keyframe{
+		{0.0, vec3.New(1.6, 0.5, 0), vec3.New(0, 0, 0), vec3.New(1, 1, 1)},
+		{1.0, vec3.New(2.2, 0.5, 0), vec3.New(0, 60, 0), vec3.New(1, 1, 1)},
+	})
+	if err != nil {
+		panic(err)
+	}
+	world = append(world, moving)
+
+	var lights []Light
+	lights = append(lights, PointLight{
+		P: vec3.New(0.0, 4.0, 4.0),
+		Intensity: vec3.New(3.0, 3.0, 3.0),
+		Color: vec3.New(1.0, 1.0, 1.0),
+	})
+
+	return world, lights
+}
+
+func createFogScene(lookFrom, lookAt *vec3.Vec3, fov *float64) (HitableList, []Light) {
+	*lookFrom = vec3.New(0, 2.0, 7.0)
+	*lookAt = vec3.New(0, 0.8, 0)
+	*fov = 45.0
+
+	world := make(HitableList, 0, 8)
+	world = append(world, Sphere{
+		Center: vec3.New(0, -1000, 0),
+		Radius: 1000,
+		Material: Lambertian{vec3.New(0.5, 0.5, 0.5)},
+	})
+	// smoke box
+	world = append(world, ConstantMedium{
+		Boundary: makeBox(vec3.New(-2.6, 0, -0.6), vec3.New(-1.4, 1.8, 0.6), nil),
+		Density: 1.5,
+		Phase: Isotropic{vec3.New(0.8, 0.8, 0.8)},
+	})
+	// fog sphere, scattering mostly forward
+	world = append(world, ConstantMedium{
+		Boundary: Sphere{vec3.New(2.0, 0.8, 0), 0.8, nil},
+		Density: 3.0,
+		Phase: HenyeyGreenstein{vec3.New(0.9, 0.6, 0.3), 0.6},
+	})
+	// colored glass
+	world = append(world, Sphere{
+		Center: vec3.New(0, 0.8, 0),
+		Radius: 0.8,
+		Material: Dielectric{1.5, vec3.New(0.1, 0.8, 1.2)},
+	})
+
+	var lights []Light
+	lights = append(lights, PointLight{
+		P: vec3.New(0.0, 4.0, 4.0),
+		Intensity: vec3.New(3.0, 3.0, 3.0),
+		Color: vec3.New(1.0, 1.0, 1.0),
+	})
+
+	return world, lights
+}
+
+// a model on a floor, seen slightly from above from far enough away to fit
+func createTurntableScene(model []Triangle, lookFrom, lookAt *vec3.Vec3, fov *float64) (HitableList, []Light) {
+	box := AABB{model[0].Vertex1, model[0].Vertex1}
+	for _, t := range model {
+		for _, v := range []vec3.Vec3{t.Vertex1, t.Vertex2, t.Vertex3} {
+			box = surroundingBox(box, AABB{v, v})
+		}
+	}
+	radius := 0.5 * vec3.Len(vec3.Sub(box.Max, box.Min))
+	*fov = 40.0
+	distance := 1.1 * radius / math.Sin(*fov/2*math.Pi/180)
+	elevation := 20 * math.Pi / 180
+	*lookAt = box.Center()
+	*lookFrom = vec3.Add(*lookAt, vec3.New(0, distance*math.Sin(elevation), distance*math.Cos(elevation)))
+
+	world := make(HitableList, 0, len(model)+1)
+	world = append(world, Plane{box.Min, vec3.New(0, 1, 0), Lambertian{vec3.New(0.5, 0.5, 0.5)}})
+	for _, t := range model {
+		world = append(world, t)
+	}
+
+	var lights []Light
+	lights = append(lights, DirectionalLight{
+		Direction: vec3.New(-1.0, -2.0, -1.0),
+		Intensity: vec3.New(1.5, 1.5, 1.5),
+		Color: vec3.New(1.0, 0.95, 0.9),
+	})
+
+	return world, lights
+}
+
+// floor and lights for a volume placed at the origin
+func createVolumeScene(lookFrom, lookAt *vec3.Vec3, fov *float64) (HitableList, []Light) {
+	*lookFrom = vec3.New(0, 2.0, 7.0)
+	*lookAt = vec3.New(0, 1.4, 0)
+	*fov = 45.0
+
+	world := make(HitableList, 1)
+	world[0] = Plane{
+		Point: vec3.New(0, 0, 0),
+		Normal: vec3.New(0, 1, 0),
+		Material: Lambertian{vec3.New(0.4, 0.4, 0.4)},
+	}
+
+	var lights []Light
+	lights = append(lights, PointLight{
+		P: vec3.New(3.0, 5.0, 3.0),
+		Intensity: vec3.New(4.0, 4.0, 4.0),
+		Color: vec3.New(1.0, 0.95, 0.9),
+	})
+	lights = append(lights, PointLight{
+		P: vec3.New(-4.0, 2.0, 1.0),
+		Intensity: vec3.New(1.5, 1.5, 1.5),
+		Color: vec3.New(0.6, 0.7, 1.0),
+	})
+
+	return world, lights
+}
+
+func createLightsScene(lookFrom, lookAt *vec3.Vec3, fov *float64) (HitableList, []Light) {
+	*lookFrom = vec3.New(0, 2.5, 6.0)
+	*lookAt = vec3.New(0, 1.0, -1.0)
+	*fov = 60.0
+
+	world := make(HitableList, 0, 8)
+	world = append(world, Plane{vec3.New(0, 0, 0), vec3.New(0, 1, 0), Lambertian{vec3.New(0.6, 0.6, 0.6)}})
+	world = append(world, Plane{vec3.New(0, 0, -4), vec3.New(0, 0, 1), Lambertian{vec3.New(0.6, 0.6, 0.6)}})
+	world = append(world, Sphere{vec3.New(-2.0, 0.6, -1.0), 0.6, Lambertian{vec3.New(0.7, 0.2, 0.1)}})
+	world = append(world, Sphere{vec3.New(2.0, 0.6, -1.0), 0.6, Metal{vec3.New(0.7, 0.6, 0.5), 0.1}})
+
+	var lights []Light
+	lights = append(lights, SpotLight{
+		P: vec3.New(-2.0, 4.0, 1.0),
+		Direction: vec3.New(0.0, -4.0, -2.0),
+		Angle: 25.0,
+		Falloff: 18.0,
+		Intensity: vec3.New(3.0, 3.0, 3.0),
+		Color: vec3.New(1.0, 0.9, 0.7),
+	})
+	lights = append(lights, DirectionalLight{
+		Direction: vec3.New(1.0, -1.0, -0.5),
+		Intensity: vec3.New(0.15, 0.15, 0.15),
+		Color: vec3.New(0.6, 0.7, 1.0),
+	})
+
+	return world, lights
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// render server: scene files (see SceneFile) are queued over HTTP and rendered one after another
+//
+//	POST   /jobs             queue the scene file in the body, answers {"id": ...} (503 if the queue is full)
+//	GET    /jobs             status of all jobs
+//	GET    /jobs/{id}        status and progress of a job
+//	GET    /jobs/{id}/image  the image so far as a PNG, final once the job is done
+//	DELETE /jobs/{id}        cancel a queued or running job
+//	GET    /jobs/{id}/events the status whenever it changes, as server-sent events
+//	GET    /                 web page previewing the jobs as they render
+type ServeSettings struct {
+	Address string
+	Queue   int    // jobs waiting at most
+	Keep    int    // finished jobs remembered
+	Root    string // directory the files of scene files (models, textures, ...) are taken from
+	Passes  int    // a job's samples are taken in this many passes, so its image fills in early
+
+	// the largest jobs taken, the film is allocated before anything could fail
+	MaxPixels  int
+	MaxSamples int
+}
+
+var SERVE = ServeSettings{Address: "localhost:8080", Queue: 16, Keep: 100, Root: ".", Passes: 8, MaxPixels: 4096 * 4096, MaxSamples: 16384}
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobDone      = "done"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// what the server tells about a job
+type JobStatus struct {
+	ID        string     `json:"id"`
+	Status    string     `json:"status"`
+	Progress  float64    `json:"progress"` // 0 to 1
+	Samples   int        `json:"samples"`  // per pixel, in the image so far
+	Total     int        `json:"total"`    // samples per pixel when done
+	Width     int        `json:"width"`
+	Height    int        `json:"height"`
+	Error     string     `json:"error,omitempty"`
+	Submitted time.Time  `json:"submitted"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	ETA       float64    `json:"eta,omitempty"` // seconds left, estimated from the progress so far
+}
+
+// a scene file to render
+type Job struct {
+	file   *SceneFile
+	scene  *Scene
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex     sync.Mutex
+	status    JobStatus
+	film      *Film
+	camera    Camera
+	tiles     int // rendered so far, over all passes
+	tileCount int // per pass
+	passes    int
+}
+
+func (j *Job) Status() JobStatus {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	status := j.status
+	if status.Status == JobRunning && status.Progress > 0 {
+		elapsed := time.Since(*status.Started).Seconds()
+		status.ETA = math.Round(elapsed * (1 - status.Progress) / status.Progress)
+	}
+	return status
+}
+
+// ends the job unless it already ended
+func (j *Job) finish(status string, err error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.status.Finished != nil {
+		return
+	}
+	now := time.Now()
+	j.status.Status, j.status.Finished = status, &now
+	if err != nil {
+		j.status.Error = err.Error()
+	}
+}
+
+type Server struct {
+	settings ServeSettings
+	queue    chan *Job
+
+	mutex  sync.Mutex
+	jobs   map[string]*Job
+	order  []string // job IDs, oldest first
+	nextID int
+}
+
+func NewServer(settings ServeSettings) *Server {
+	return &Server{
+		settings: settings,
+		queue:    make(chan *Job, settings.Queue),
+		jobs:     map[string]*Job{},
+	}
+}
+
+// `serve` command: runs the render server until it is killed
+func serveCommand(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	settings := SERVE
+	flags.StringVar(&settings.Address, "address", settings.Address, "address to listen on")
+	flags.IntVar(&settings.Queue, "queue", settings.Queue, "jobs waiting at most")
+	flags.IntVar(&settings.Keep, "keep", settings.Keep, "finished jobs remembered")
+	flags.StringVar(&settings.Root, "root", settings.Root, "directory the models, textures and other files of scene files are taken from")
+	flags.IntVar(&settings.Passes, "passes", settings.Passes, "passes a job's samples are split into")
+	flags.IntVar(&settings.MaxPixels, "max-pixels", settings.MaxPixels, "largest image of a job (width times height, both eyes of stereo images)")
+	flags.IntVar(&settings.MaxSamples, "max-samples", settings.MaxSamples, "most samples per pixel of a job")
+	flags.Parse(args)
+
+	s := NewServer(settings)
+	go s.work()
+	fmt.Printf("Serving on http://%s/\n", settings.Address)
+	return http.ListenAndServe(settings.Address, s.Handler())
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.preview)
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			s.submit(w, r)
+		case http.MethodGet:
+			s.list(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		// /jobs/{id} or /jobs/{id}/image
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+		job := s.job(parts[0])
+		switch {
+		case job == nil:
+			http.Error(w, "no such job", http.StatusNotFound)
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			writeJSON(w, job.Status())
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			s.cancel(w, job)
+		case len(parts) == 2 && parts[1] == "image" && r.Method == http.MethodGet:
+			s.image(w, job)
+		case len(parts) == 2 && parts[1] == "events" && r.Method == http.MethodGet:
+			s.events(w, r, job)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	})
+	return mux
+}
+
+func (s *Server) submit(w http.ResponseWriter, r *http.Request) {
+	contents, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 16<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f, err := parseSceneFile(contents)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.Animation != nil {
+		// jobs are single images, the first frame of animations
+		f = f.AtFrame(f.Animation.Frames[0])
+	}
+	if f.Width <= 0 || f.Height <= 0 || f.Samples <= 0 {
+		http.Error(w, "width, height and samples have to be set", http.StatusBadRequest)
+		return
+	}
+	if err := s.settings.check(f); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// built right away, so broken scenes are refused rather than failing later
+	scene, err := f.Build(insideOf(s.settings.Root))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.Camera.CameraSettings, err = f.Camera.CameraSettings.files(insideOf(s.settings.Root)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{file: f, scene: scene, ctx: ctx, cancel: cancel}
+	s.mutex.Lock()
+	s.nextID++
+	job.status = JobStatus{
+		ID:        strconv.Itoa(s.nextID),
+		Status:    JobQueued,
+		Width:     f.Width,
+		Height:    f.Height,
+		Submitted: time.Now(),
+	}
+	select {
+	case s.queue <- job:
+	default:
+		s.mutex.Unlock()
+		cancel()
+		http.Error(w, "the queue is full", http.StatusServiceUnavailable)
+		return
+	}
+	s.jobs[job.status.ID] = job
+	s.order = append(s.order, job.status.ID)
+	s.forget()
+	s.mutex.Unlock()
+
+	w.Header().Set("Location", "/jobs/"+job.status.ID)
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, map[string]string{"id": job.status.ID})
+}
+
+// drops the oldest finished jobs beyond the ones kept (called with the server locked)
+func (s *Server) forget() {
+	finished := 0
+	for _, id := range s.order {
+		if s.jobs[id].Status().Finished != nil {
+			finished++
+		}
+	}
+	var order []string
+	for _, id := range s.order {
+		if finished > s.settings.Keep && s.jobs[id].Status().Finished != nil {
+			delete(s.jobs, id)
+			finished--
+			continue
+		}
+		order = append(order, id)
+	}
+	s.order = order
+}
+
+// nil if there is no such job (any more)
+func (s *Server) job(id string) *Job {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.jobs[id]
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	statuses := []JobStatus{}
+	for _, id := range s.order {
+		statuses = append(statuses, s.jobs[id].Status())
+	}
+	s.mutex.Unlock()
+	writeJSON(w, statuses)
+}
+
+func (s *Server) image(w http.ResponseWriter, job *Job) {
+	job.mutex.Lock()
+	film, camera := job.film, job.camera
+	job.mutex.Unlock()
+	if film == nil {
+		http.Error(w, "not started yet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	png.Encode(w, finalImage(film.Buffer(), film.Width, film.Height, camera))
+}
+
+func (s *Server) cancel(w http.ResponseWriter, job *Job) {
+	job.cancel()
+	// queued jobs are skipped when their turn comes, running ones stop after their current tiles
+	job.finish(JobCancelled, nil)
+	writeJSON(w, job.Status())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+
+// renders the queued jobs one at a time, every one already uses all CPUs
+func (s *Server) work() {
+	for job := range s.queue {
+		if job.ctx.Err() != nil {
+			continue
+		}
+		err := s.run(job)
+		switch {
+		case job.ctx.Err() != nil:
+			job.finish(JobCancelled, nil)
+		case err != nil:
+			job.finish(JobFailed, err)
+		default:
+			job.finish(JobDone, nil)
+		}
+		job.cancel()
+		s.mutex.Lock()
+		s.forget()
+		s.mutex.Unlock()
+	}
+}
+
+// refuses jobs too large to render here
+func (settings ServeSettings) check(f *SceneFile) error {
+	width := filmWidth(f.Camera.CameraSettings, f.Width)
+	if f.Width > settings.MaxPixels || f.Height > settings.MaxPixels || width*f.Height > settings.MaxPixels {
+		return fmt.Errorf("%dx%d is more than %d pixels", width, f.Height, settings.MaxPixels)
+	}
+	if f.Samples > settings.MaxSamples {
+		return fmt.Errorf("%d samples per pixel are more than %d", f.Samples, settings.MaxSamples)
+	}
+	return nil
+}
+
+func (s *Server) run(job *Job) (err error) {
+	defer func() {
+		// a broken scene must not take the server down (the tiles' goroutines recover in renderTiles)
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	f := job.file
+	samplerKind, filterKind := f.Sampler, f.Filter
+	if samplerKind == "" {
+		samplerKind = SAMPLER
+	}
+	if filterKind == "" {
+		filterKind = FILTER
+	}
+	filter, err := newFilter(filterKind)
+	if err != nil {
+		return err
+	}
+
+	lookFrom, lookAt, vfov := f.View()
+	settings := f.viewSettings(f.Camera.CameraSettings, vfov)
+	width := filmWidth(settings, f.Width)
+	camera := prepareScene(job.scene, settings, lookFrom, lookAt, vfov, width, f.Height)
+	film := NewFilm(width, f.Height, filter)
+
+	// equal passes, rounding the samples up to a whole number of them
+	passes := maxInt(minInt(s.settings.Passes, f.Samples), 1)
+	perPass := (f.Samples + passes - 1) / passes
+	passes = (f.Samples + perPass - 1) / perPass
+
+	job.mutex.Lock()
+	if job.status.Finished != nil {
+		// cancelled while the scene was prepared, the final status stays
+		job.mutex.Unlock()
+		return job.ctx.Err()
+	}
+	now := time.Now()
+	job.status.Status, job.status.Started = JobRunning, &now
+	job.status.Total = passes * perPass
+	job.film, job.camera = film, camera
+	job.tileCount, job.passes = len(film.Tiles(tileSize)), passes
+	job.mutex.Unlock()
+
+	tileDone := func(Tile) {
+		job.mutex.Lock()
+		defer job.mutex.Unlock()
+		job.tiles++
+		job.status.Progress = float64(job.tiles) / float64(job.tileCount*job.passes)
+	}
+	for p := 0; p < passes; p++ {
+		if err := renderTiles(job.ctx, film, perPass, p*perPass, camera, job.scene, samplerKind, 0, tileDone); err != nil {
+			return err
+		}
+		job.mutex.Lock()
+		job.status.Samples = (p + 1) * perPass
+		job.mutex.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"math"
+
+	"./vec3"
+)
+
+// sun seen from the ground: a small disk of very bright light
+type SunDisk struct {
+	Direction     vec3.Vec3 // towards the sun, normalized
+	AngularRadius float64   // radians
+	Radiance      vec3.Vec3
+}
+
+func (s SunDisk) cosMax() float64 {
+	return math.Cos(s.AngularRadius)
+}
+
+func (s SunDisk) contains(direction vec3.Vec3) bool {
+	return vec3.Dot(vec3.Norm(direction), s.Direction) >= s.cosMax()
+}
+
+// uniform direction within the cone of the disk
+func (s SunDisk) sample(u, v float64) vec3.Vec3 {
+	cosTheta := 1 - u*(1-s.cosMax())
+	sinTheta := math.Sqrt(1 - cosTheta*cosTheta)
+	phi := 2 * math.Pi * v
+	a, b := orthonormalBasis(s.Direction)
+	d := vec3.Scale(s.Direction, cosTheta)
+	d = vec3.Add(d, vec3.Scale(a, sinTheta*math.Cos(phi)))
+	return vec3.Add(d, vec3.Scale(b, sinTheta*math.Sin(phi)))
+}
+
+func (s SunDisk) pdf() float64 {
+	return 1 / (2 * math.Pi * (1 - s.cosMax()))
+}
+
+
+// analytic daylight sky (Preetham, Shirley and Smits, "A Practical Analytic Model for Daylight")
+// including the sun, the ground below the horizon reflects the light of both
+type PhysicalSky struct {
+	SunDirection vec3.Vec3 // towards the sun
+	Turbidity    float64   // haziness, 2 (clear) to 10 (hazy)
+	GroundAlbedo vec3.Vec3
+	Intensity    float64 // the model is in kcd/m^2, this scales it to scene units
+
+	sun                            SunDisk
+	perezLuminance, perezX, perezY [5]float64
+	zenith                         vec3.Vec3 // xyY at the zenith
+	thetaSun                       float64
+	ground                         vec3.Vec3
+}
+
+func NewPhysicalSky(sunDirection vec3.Vec3, turbidity float64, groundAlbedo vec3.Vec3, intensity float64) *PhysicalSky {
+	s := &PhysicalSky{
+		SunDirection: vec3.Norm(sunDirection),
+		Turbidity:    turbidity,
+		GroundAlbedo: groundAlbedo,
+		Intensity:    intensity,
+	}
+	T := turbidity
+	s.thetaSun = math.Acos(math.Max(-1, math.Min(1, s.SunDirection.Y)))
+	theta := math.Min(s.thetaSun, math.Pi/2) // model is only valid for the sun above the horizon
+
+	s.perezLuminance = [5]float64{0.1787*T - 1.4630, -0.3554*T + 0.4275, -0.0227*T + 5.3251, 0.1206*T - 2.5771, -0.0670*T + 0.3703}
+	s.perezX = [5]float64{-0.0193*T - 0.2592, -0.0665*T + 0.0008, -0.0004*T + 0.2125, -0.0641*T - 0.8989, -0.0033*T + 0.0452}
+	s.perezY = [5]float64{-0.0167*T - 0.2608, -0.0950*T + 0.0092, -0.0079*T + 0.2102, -0.0441*T - 1.6537, -0.0109*T + 0.0529}
+
+	chi := (4.0/9.0 - T/120.0) * (math.Pi - 2*theta)
+	Yz := (4.0453*T-4.9710)*math.Tan(chi) - 0.2155*T + 2.4192
+	t2, t3 := theta*theta, theta*theta*theta
+	xz := T*T*(0.00166*t3-0.00375*t2+0.00209*theta) +
+		T*(-0.02903*t3+0.06377*t2-0.03202*theta+0.00394) +
+		(0.11693*t3 - 0.21196*t2 + 0.06052*theta + 0.25886)
+	yz := T*T*(0.00275*t3-0.00610*t2+0.00317*theta) +
+		T*(-0.04214*t3+0.08970*t2-0.04153*theta+0.00516) +
+		(0.15346*t3 - 0.26756*t2 + 0.06670*theta + 0.26688)
+	s.zenith = vec3.New(xz, yz, math.Max(Yz, 0))
+
+	s.sun = SunDisk{
+		Direction:     s.SunDirection,
+		AngularRadius: 0.00465,
+		Radiance:      vec3.Scale(sunTransmittance(s.thetaSun, T), 1.6e6),
+	}
+	if s.SunDirection.Y <= 0 {
+		s.sun.Radiance = vec3.New(0, 0, 0)
+	}
+
+	// ground lit by the sun and (roughly, as if uniform) by the sky at 45 degrees
+	sunIrradiance := vec3.Scale(s.sun.Radiance, 2*math.Pi*(1-s.sun.cosMax())*math.Max(s.SunDirection.Y, 0))
+	skyIrradiance := vec3.Scale(s.sky(vec3.Norm(vec3.New(1, 1, 0))), math.Pi)
+	s.ground = vec3.Scale(vec3.Mul(groundAlbedo, vec3.Add(sunIrradiance, skyIrradiance)), 1/math.Pi)
+	return s
+}
+
+// fraction of the sunlight reaching the ground for red, green and blue,
+// Rayleigh and aerosol (Angstrom) scattering along the optical path
+func sunTransmittance(thetaSun, turbidity float64) vec3.Vec3 {
+	degrees := thetaSun * 180 / math.Pi
+	if degrees >= 93.885 {
+		return vec3.New(0, 0, 0)
+	}
+	mass := 1 / (math.Cos(thetaSun) + 0.15*math.Pow(93.885-degrees, -1.253))
+	beta := 0.04608*turbidity - 0.04586
+	t := func(micrometers float64) float64 {
+		rayleigh := math.Exp(-0.008735 * math.Pow(micrometers, -4.08) * mass)
+		aerosol := math.Exp(-beta * math.Pow(micrometers, -1.3) * mass)
+		return rayleigh * aerosol
+	}
+	return vec3.New(t(0.610), t(0.550), t(0.465))
+}
+
+func perez(c [5]float64, theta, gamma float64) float64 {
+	return (1 + c[0]*math.Exp(c[1]/math.Cos(theta))) * (1 + c[2]*math.Exp(c[3]*gamma) + c[4]*math.Cos(gamma)*math.Cos(gamma))
+}
+
+// sky radiance without the sun (linear sRGB, kcd/m^2)
+func (s *PhysicalSky) sky(direction vec3.Vec3) vec3.Vec3 {
+	theta := math.Acos(math.Max(-1, math.Min(1, direction.Y)))
+	theta = math.Min(theta, math.Pi/2-0.001)
+	gamma := math.Acos(math.Max(-1, math.Min(1, vec3.Dot(direction, s.SunDirection))))
+	thetaSun := math.Min(s.thetaSun, math.Pi/2)
+
+	x := s.zenith.X * perez(s.perezX, theta, gamma) / perez(s.perezX, 0, thetaSun)
+	y := s.zenith.Y * perez(s.perezY, theta, gamma) / perez(s.perezY, 0, thetaSun)
+	Y := s.zenith.Z * perez(s.perezLuminance, theta, gamma) / perez(s.perezLuminance, 0, thetaSun)
+	if y <= 0 || Y <= 0 {
+		return vec3.New(0, 0, 0)
+	}
+	return xyYToRGB(x, y, Y)
+}
+
+// CIE xyY to linear sRGB
+func xyYToRGB(x, y, Y float64) vec3.Vec3 {
+	X := x / y * Y
+	Z := (1 - x - y) / y * Y
+	return vec3.New(
+		math.Max(0, 3.2406*X-1.5372*Y-0.4986*Z),
+		math.Max(0, -0.9689*X+1.8758*Y+0.0415*Z),
+		math.Max(0, 0.0557*X-0.2040*Y+1.0570*Z),
+	)
+}
+
+func (s *PhysicalSky) Radiance(direction vec3.Vec3) vec3.Vec3 {
+	d := vec3.Norm(direction)
+	if d.Y < 0 {
+		return vec3.Scale(s.ground, s.Intensity)
+	}
+	radiance := s.sky(d)
+	if s.sun.contains(d) {
+		radiance = vec3.Add(radiance, s.sun.Radiance)
+	}
+	return vec3.Scale(radiance, s.Intensity)
+}
+
+// chance of sampling the sun instead of the whole sphere
+func (s *PhysicalSky) sunProbability() float64 {
+	if s.SunDirection.Y <= 0 {
+		return 0
+	}
+	return 0.5
+}
+
+// either the sun disk or a uniform direction, combined density of both strategies
+// u first picks the strategy and is then stretched to [0, 1) again
+func (s *PhysicalSky) Sample(u, v float64) (vec3.Vec3, vec3.Vec3, float64) {
+	var direction vec3.Vec3
+	if p := s.sunProbability(); u < p {
+		direction = s.sun.sample(u/p, v)
+	} else {
+		direction = sampleSphere((u-p)/(1-p), v)
+	}
+	return direction, s.Radiance(direction), s.Pdf(direction)
+}
+
+func (s *PhysicalSky) Pdf(direction vec3.Vec3) float64 {
+	p := s.sunProbability()
+	pdf := (1 - p) / (4 * math.Pi)
+	if s.sun.contains(direction) {
+		pdf += p * s.sun.pdf()
+	}
+	return pdf
+}
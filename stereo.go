@@ -0,0 +1,116 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"./vec3"
+)
+
+// how the two views of a stereo camera share the image
+const (
+	SideBySide = "side-by-side" // left eye on the left
+	TopBottom  = "top-bottom"   // left eye on top
+	Anaglyph   = "anaglyph"     // rendered side by side, then combined to red (left) and cyan (right)
+)
+
+// two cameras rendered into one image, one per eye
+type StereoCamera struct {
+	Left, Right Camera
+	Layout      string
+}
+
+func (c StereoCamera) GetRay(u, v float64) Ray {
+	if c.Layout == TopBottom {
+		if v >= 0.5 {
+			return c.Left.GetRay(u, 2*v-1)
+		}
+		return c.Right.GetRay(u, 2*v)
+	}
+	if u < 0.5 {
+		return c.Left.GetRay(2*u, v)
+	}
+	return c.Right.GetRay(2*u-1, v)
+}
+
+// both eyes' cameras share the shutter
+func (c StereoCamera) Shutter() (float64, float64) {
+	if shutter, ok := c.Left.(ShutterCamera); ok {
+		return shutter.Shutter()
+	}
+	return 0, 0
+}
+
+// aspect ratio of each eye's view in an image of the given aspect ratio
+func eyeAspect(layout string, aspect float64) float64 {
+	switch layout {
+	case TopBottom:
+		return aspect * 2
+	case SideBySide, Anaglyph:
+		return aspect / 2
+	}
+	return aspect
+}
+
+// off-axis stereo pair: both eyes look through the same window at the convergence distance,
+// the eyes are shifted sideways but not rotated (toe-in would give vertical parallax)
+func NewStereoPinholeCameras(lookFrom, lookAt, vup vec3.Vec3, vfov, aspect, interaxial, convergence float64) (PinholeCamera, PinholeCamera) {
+	center := NewPinholeCamera(lookFrom, lookAt, vup, vfov, aspect)
+	// move the image plane out to the convergence distance, the frustum stays the same
+	llc := vec3.Add(lookFrom, vec3.Scale(vec3.Sub(center.LowerLeftCorner, lookFrom), convergence))
+	horizontal := vec3.Scale(center.Horizontal, convergence)
+	vertical := vec3.Scale(center.Vertical, convergence)
+	offset := vec3.Scale(vec3.Norm(center.Horizontal), interaxial/2)
+
+	left := PinholeCamera{LowerLeftCorner: llc, Horizontal: horizontal, Vertical: vertical, Origin: vec3.Sub(lookFrom, offset)}
+	right := PinholeCamera{LowerLeftCorner: llc, Horizontal: horizontal, Vertical: vertical, Origin: vec3.Add(lookFrom, offset)}
+	return left, right
+}
+
+
+// omni-directional stereo panorama for one eye: an equirectangular image where every ray
+// starts on a circle of diameter interaxial, offset sideways from the direction it looks in
+type ODSCamera struct {
+	Origin vec3.Vec3
+	U, V, W vec3.Vec3
+	Eye float64 // signed offset, negative for the left eye
+	ShutterOpen, ShutterClose float64
+}
+
+func NewODSCameras(lookFrom, lookAt, vup vec3.Vec3, interaxial float64) (ODSCamera, ODSCamera) {
+	w := vec3.Norm(vec3.Sub(lookFrom, lookAt))
+	u := vec3.Norm(vec3.Cross(vup, w))
+	v := vec3.Cross(w, u)
+	left := ODSCamera{Origin: lookFrom, U: u, V: v, W: w, Eye: -interaxial / 2}
+	right := ODSCamera{Origin: lookFrom, U: u, V: v, W: w, Eye: interaxial / 2}
+	return left, right
+}
+
+func (c ODSCamera) GetRay(u, v float64) Ray {
+	direction := panoramaDirection(c.U, c.V, c.W, u, v)
+	// only the azimuth moves the eye: looking straight up or down both eyes meet
+	phi := (u - 0.5) * 2 * math.Pi
+	right := vec3.Add(vec3.Scale(c.U, math.Cos(phi)), vec3.Scale(c.W, math.Sin(phi)))
+	origin := vec3.Add(c.Origin, vec3.Scale(right, c.Eye))
+	return Ray{origin, direction, c.ShutterOpen}
+}
+
+func (c ODSCamera) Shutter() (float64, float64) {
+	return c.ShutterOpen, c.ShutterClose
+}
+
+// combines a side by side stereo image into a red/cyan anaglyph of half the width
+func anaglyph(pair *image.RGBA) *image.RGBA {
+	bounds := pair.Bounds()
+	width := bounds.Dx() / 2
+	img := image.NewRGBA(image.Rect(0, 0, width, bounds.Dy()))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < width; x++ {
+			left := pair.RGBAAt(bounds.Min.X+x, bounds.Min.Y+y)
+			right := pair.RGBAAt(bounds.Min.X+width+x, bounds.Min.Y+y)
+			img.SetRGBA(x, y, color.RGBA{left.R, right.G, right.B, 255})
+		}
+	}
+	return img
+}
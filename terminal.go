@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+
+	"./vec3"
+)
+
+// terminal preview: a small progressive render drawn with half blocks (two pixels per
+// character, in 24 bit color), the view can be changed with the keyboard before the
+// full render
+type PreviewSettings struct {
+	Enabled bool
+	Samples int // per pixel, after which the preview stops refining
+}
+
+var PREVIEW = PreviewSettings{Samples: 64}
+
+const previewHelp = "arrows orbit, w/s dolly, enter renders, q quits"
+
+// lets the view be changed in the terminal, returns the chosen one or false if the user quit
+func terminalPreview(scene *Scene, lookFrom, lookAt vec3.Vec3, vfov float64, width, height int) (vec3.Vec3, vec3.Vec3, bool, error) {
+	restore, err := rawTerminal()
+	if err != nil {
+		return lookFrom, lookAt, false, fmt.Errorf("the preview needs a terminal: %v", err)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer func() {
+		fmt.Fprint(out, "\x1b[0m\x1b[?25h\r\n")
+		out.Flush()
+		restore()
+	}()
+	fmt.Fprint(out, "\x1b[2J\x1b[?25l")
+
+	// the largest image of the render's aspect that fits above the status line
+	columns, rows := terminalSize()
+	nx := columns
+	ny := int(float64(nx) * float64(height) / float64(width))
+	if ny > 2*(rows-1) {
+		ny = 2 * (rows - 1)
+		nx = int(float64(ny) * float64(width) / float64(height))
+	}
+	nx, ny = maxInt(nx, 1), maxInt(ny&^1, 2)
+	filter, err := newFilter(FILTER)
+	if err != nil {
+		return lookFrom, lookAt, false, err
+	}
+
+	done := make(chan struct{})
+	keys := readKeys(done)
+	defer func() {
+		// the reader is gone before the terminal is restored, it must not take later input
+		close(done)
+		for range keys {
+		}
+	}()
+	for {
+		camera := newCamera(CAMERA, lookFrom, lookAt, vfov, float64(width)/float64(height), 0.0, 1.0, scene.World)
+		film := NewFilm(nx, ny, filter)
+		ctx, cancel := context.WithCancel(context.Background())
+		finished := make(chan struct{})
+		go func() {
+			defer close(finished)
+			for s := 0; s < PREVIEW.Samples; s++ {
+				if renderTiles(ctx, film, 1, s, camera, scene, SAMPLER, 0, nil) != nil {
+					return
+				}
+				drawPreview(out, film, camera, fmt.Sprintf("%d samples — %s", s+1, previewHelp))
+			}
+		}()
+
+		key, ok := <-keys
+		cancel()
+		<-finished
+		if !ok {
+			return lookFrom, lookAt, false, nil
+		}
+		switch key {
+		case "enter":
+			return lookFrom, lookAt, true, nil
+		case "q":
+			return lookFrom, lookAt, false, nil
+		default:
+			lookFrom = moveCamera(key, lookFrom, lookAt)
+		}
+	}
+}
+
+// orbits around lookAt (10 degrees per key) or moves towards and away from it
+func moveCamera(key string, lookFrom, lookAt vec3.Vec3) vec3.Vec3 {
+	offset := vec3.Sub(lookFrom, lookAt)
+	r := vec3.Len(offset)
+	azimuth := math.Atan2(offset.X, offset.Z)
+	elevation := math.Asin(offset.Y / r)
+	step := 10 * math.Pi / 180
+	switch key {
+	case "left":
+		azimuth -= step
+	case "right":
+		azimuth += step
+	case "up":
+		elevation = math.Min(elevation+step, 85*math.Pi/180)
+	case "down":
+		elevation = math.Max(elevation-step, -85*math.Pi/180)
+	case "w":
+		r *= 0.8
+	case "s":
+		r *= 1.25
+	}
+	offset = vec3.New(
+		r*math.Cos(elevation)*math.Sin(azimuth),
+		r*math.Sin(elevation),
+		r*math.Cos(elevation)*math.Cos(azimuth),
+	)
+	return vec3.Add(lookAt, offset)
+}
+
+// every character shows two pixels: the upper half block in the foreground color
+// over the background color
+func drawPreview(out *bufio.Writer, film *Film, camera Camera, status string) {
+	img := finalImage(film.Buffer(), film.Width, film.Height, camera)
+	bounds := img.Bounds()
+	fmt.Fprint(out, "\x1b[H")
+	for y := bounds.Min.Y; y+1 < bounds.Max.Y; y += 2 {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			top, bottom := img.RGBAAt(x, y), img.RGBAAt(x, y+1)
+			fmt.Fprintf(out, "\x1b[38;2;%d;%d;%dm\x1b[48;2;%d;%d;%dm▀", top.R, top.G, top.B, bottom.R, bottom.G, bottom.B)
+		}
+		fmt.Fprint(out, "\x1b[0m\r\n")
+	}
+	fmt.Fprintf(out, "\x1b[2K%s", status)
+	out.Flush()
+}
+
+// switches the terminal to reading single keys without echoing them, reads give up after
+// a tenth of a second
+func rawTerminal() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("raw", "-echo", "min", "0", "time", "1"); err != nil {
+		return nil, err
+	}
+	return func() { stty(strings.TrimSpace(saved)) }, nil
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// columns and rows of the terminal, 80x24 if it does not tell
+func terminalSize() (int, int) {
+	var rows, columns int
+	if size, err := stty("size"); err == nil {
+		fmt.Sscan(size, &rows, &columns)
+	}
+	if rows <= 1 || columns <= 0 {
+		return 80, 24
+	}
+	return columns, rows
+}
+
+// keys pressed: the letters themselves, "enter", and the arrows as "up", "down", "left"
+// and "right" (closed when the input fails, or once done is closed)
+func readKeys(done <-chan struct{}) <-chan string {
+	keys := make(chan string)
+	go func() {
+		defer close(keys)
+		// the terminal returns from reads after a tenth of a second without input (see
+		// rawTerminal), so done is noticed and a lone escape told from an escape sequence
+		var b [1]byte
+		read := func(tries int) (byte, bool) {
+			for i := 0; i < tries; i++ {
+				n, err := os.Stdin.Read(b[:])
+				if n == 1 {
+					return b[0], true
+				}
+				if err != nil && err != io.EOF {
+					return 0, false
+				}
+			}
+			return 0, false
+		}
+		arrows := map[byte]string{'A': "up", 'B': "down", 'C': "right", 'D': "left"}
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			n, err := os.Stdin.Read(b[:])
+			if err != nil && err != io.EOF {
+				return
+			}
+			if n == 0 {
+				continue
+			}
+			var key string
+			switch c := b[0]; {
+			case c == '\r' || c == '\n':
+				key = "enter"
+			case c == 3:
+				key = "q"
+			case c == 27:
+				// the rest of an escape sequence may come a little later (over ssh),
+				// nothing for a few tenths of a second is a lone escape
+				next, ok := read(3)
+				if !ok {
+					key = "q"
+					break
+				}
+				if next != '[' && next != 'O' {
+					continue
+				}
+				arrow, _ := read(3)
+				if key = arrows[arrow]; key == "" {
+					continue
+				}
+			default:
+				key = strings.ToLower(string(c))
+			}
+			select {
+			case keys <- key:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return keys
+}
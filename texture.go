@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+
+	"./vec3"
+)
+
+type Texture interface {
+	Value(u, v float64, p vec3.Vec3) vec3.Vec3
+}
+
+// constant color
+type ConstantTexture struct {
+	Color vec3.Vec3
+}
+
+func (c ConstantTexture) Value(u, v float64, p vec3.Vec3) vec3.Vec3 {
+	return c.Color
+}
+
+// image texture (nearest pixel, repeating)
+type ImageTexture struct {
+	Width, Height int
+	Pixels        []vec3.Vec3
+}
+
+func loadImageTexture(filename string) (*ImageTexture, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Loaded texture `%s`\n", filename)
+
+	bounds := img.Bounds()
+	t := &ImageTexture{
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+		Pixels: make([]vec3.Vec3, bounds.Dx()*bounds.Dy()),
+	}
+	for y := 0; y < t.Height; y++ {
+		for x := 0; x < t.Width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			// stored gamma corrected (gamma 2, like the output images)
+			c := vec3.New(float64(r)/65535, float64(g)/65535, float64(b)/65535)
+			t.Pixels[y*t.Width+x] = vec3.Mul(c, c)
+		}
+	}
+	return t, nil
+}
+
+func (t *ImageTexture) Value(u, v float64, p vec3.Vec3) vec3.Vec3 {
+	u -= math.Floor(u)
+	v -= math.Floor(v)
+	x := minInt(int(u*float64(t.Width)), t.Width-1)
+	y := minInt(int(v*float64(t.Height)), t.Height-1)
+	return t.Pixels[y*t.Width+x]
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"./vec3"
+)
+
+// affine transformation, 3x4 matrix (the last row is always 0 0 0 1)
+type Matrix [3][4]float64
+
+func Identity() Matrix {
+	return Matrix{
+		{1, 0, 0, 0},
+		{0, 1, 0, 0},
+		{0, 0, 1, 0},
+	}
+}
+
+func Translation(v vec3.Vec3) Matrix {
+	return Matrix{
+		{1, 0, 0, v.X},
+		{0, 1, 0, v.Y},
+		{0, 0, 1, v.Z},
+	}
+}
+
+func Scaling(v vec3.Vec3) Matrix {
+	return Matrix{
+		{v.X, 0, 0, 0},
+		{0, v.Y, 0, 0},
+		{0, 0, v.Z, 0},
+	}
+}
+
+// rotation around the x, y and z axis (in that order), angles in degrees
+func Rotation(angles vec3.Vec3) Matrix {
+	sx, cx := math.Sincos(angles.X * math.Pi / 180)
+	sy, cy := math.Sincos(angles.Y * math.Pi / 180)
+	sz, cz := math.Sincos(angles.Z * math.Pi / 180)
+	rx := Matrix{{1, 0, 0, 0}, {0, cx, -sx, 0}, {0, sx, cx, 0}}
+	ry := Matrix{{cy, 0, sy, 0}, {0, 1, 0, 0}, {-sy, 0, cy, 0}}
+	rz := Matrix{{cz, -sz, 0, 0}, {sz, cz, 0, 0}, {0, 0, 1, 0}}
+	return rz.Mul(ry.Mul(rx))
+}
+
+// m * n, i.e. n is applied first
+func (m Matrix) Mul(n Matrix) Matrix {
+	var r Matrix
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 4; j++ {
+			r[i][j] = m[i][0]*n[0][j] + m[i][1]*n[1][j] + m[i][2]*n[2][j]
+		}
+		r[i][3] += m[i][3]
+	}
+	return r
+}
+
+func (m Matrix) Point(p vec3.Vec3) vec3.Vec3 {
+	return vec3.New(
+		m[0][0]*p.X+m[0][1]*p.Y+m[0][2]*p.Z+m[0][3],
+		m[1][0]*p.X+m[1][1]*p.Y+m[1][2]*p.Z+m[1][3],
+		m[2][0]*p.X+m[2][1]*p.Y+m[2][2]*p.Z+m[2][3],
+	)
+}
+
+func (m Matrix) Vector(v vec3.Vec3) vec3.Vec3 {
+	return vec3.New(
+		m[0][0]*v.X+m[0][1]*v.Y+m[0][2]*v.Z,
+		m[1][0]*v.X+m[1][1]*v.Y+m[1][2]*v.Z,
+		m[2][0]*v.X+m[2][1]*v.Y+m[2][2]*v.Z,
+	)
+}
+
+// transforms a normal with the transpose of m, so call it on the inverse
+func (m Matrix) Normal(n vec3.Vec3) vec3.Vec3 {
+	return vec3.New(
+		m[0][0]*n.X+m[1][0]*n.Y+m[2][0]*n.Z,
+		m[0][1]*n.X+m[1][1]*n.Y+m[2][1]*n.Z,
+		m[0][2]*n.X+m[1][2]*n.Y+m[2][2]*n.Z,
+	)
+}
+
+func (m Matrix) Inverse() Matrix {
+	a, b, c := m[0][0], m[0][1], m[0][2]
+	d, e, f := m[1][0], m[1][1], m[1][2]
+	g, h, i := m[2][0], m[2][1], m[2][2]
+	det := a*(e*i-f*h) - b*(d*i-f*g) + c*(d*h-e*g)
+	inv := 1.0 / det
+
+	var r Matrix
+	r[0][0] = (e*i - f*h) * inv
+	r[0][1] = (c*h - b*i) * inv
+	r[0][2] = (b*f - c*e) * inv
+	r[1][0] = (f*g - d*i) * inv
+	r[1][1] = (a*i - c*g) * inv
+	r[1][2] = (c*d - a*f) * inv
+	r[2][0] = (d*h - e*g) * inv
+	r[2][1] = (b*g - a*h) * inv
+	r[2][2] = (a*e - b*d) * inv
+	t := r.Vector(vec3.New(m[0][3], m[1][3], m[2][3]))
+	r[0][3], r[1][3], r[2][3] = -t.X, -t.Y, -t.Z
+	return r
+}
+
+// box enclosing the transformed corners of the given box
+func (m Matrix) Box(box AABB) AABB {
+	var result AABB
+	for i := 0; i < 8; i++ {
+		corner := box.Min
+		if i&1 != 0 {
+			corner.X = box.Max.X
+		}
+		if i&2 != 0 {
+			corner.Y = box.Max.Y
+		}
+		if i&4 != 0 {
+			corner.Z = box.Max.Z
+		}
+		p := m.Point(corner)
+		if i == 0 {
+			result = AABB{p, p}
+		} else {
+			result = surroundingBox(result, AABB{p, p})
+		}
+	}
+	return result
+}
+
+
+// object placed in the world with a transformation
+type Instance struct {
+	Object    Hitable
+	Transform Matrix
+	inverse   Matrix
+}
+
+func NewInstance(object Hitable, transform Matrix) *Instance {
+	return &Instance{object, transform, transform.Inverse()}
+}
+
+// intersects the object in its own space and transforms the result back
+func hitTransformed(object Hitable, transform, inverse Matrix, ray Ray, tMin, tMax float64, record *HitRecord) bool {
+	local := Ray{inverse.Point(ray.Origin()), inverse.Vector(ray.Direction()), ray.Time}
+	if !object.Hit(local, tMin, tMax, record) {
+		return false
+	}
+	record.P = transform.Point(record.P)
+	record.Normal = vec3.Norm(inverse.Normal(record.Normal))
+	return true
+}
+
+func (in *Instance) Hit(ray Ray, tMin, tMax float64, record *HitRecord) bool {
+	return hitTransformed(in.Object, in.Transform, in.inverse, ray, tMin, tMax, record)
+}
+
+func (in *Instance) BoundingBox(t0, t1 float64, box *AABB) bool {
+	var local AABB
+	if !in.Object.BoundingBox(t0, t1, &local) {
+		return false
+	}
+	*box = in.Transform.Box(local)
+	return true
+}
+
+
+// pose of an object at a given time
+type Keyframe struct {
+	Time        float64
+	Translation vec3.Vec3
+	Rotation    vec3.Vec3 // degrees, see Rotation
+	Scale       vec3.Vec3
+}
+
+func (k Keyframe) Matrix() Matrix {
+	return Translation(k.Translation).Mul(Rotation(k.Rotation).Mul(Scaling(k.Scale)))
+}
+
+func lerp(a, b vec3.Vec3, f float64) vec3.Vec3 {
+	return vec3.Add(a, vec3.Scale(vec3.Sub(b, a), f))
+}
+
+// object moving through a list of keyframes (interpolated linearly,
+// held constant before the first and after the last one)
+type MovingInstance struct {
+	Object    Hitable
+	Keyframes []Keyframe
+}
+
+func NewMovingInstance(object Hitable, keyframes []Keyframe) (*MovingInstance, error) {
+	if len(keyframes) == 0 {
+		return nil, fmt.Errorf("a moving object needs keyframes")
+	}
+	keys := append([]Keyframe(nil), keyframes...)
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Time < keys[j].Time })
+	return &MovingInstance{object, keys}, nil
+}
+
+func (in *MovingInstance) Pose(time float64) Keyframe {
+	keys := in.Keyframes
+	if time <= keys[0].Time {
+		return keys[0]
+	}
+	for i := 1; i < len(keys); i++ {
+		if time < keys[i].Time {
+			a, b := keys[i-1], keys[i]
+			f := (time - a.Time) / (b.Time - a.Time)
+			return Keyframe{
+				time,
+				lerp(a.Translation, b.Translation, f),
+				lerp(a.Rotation, b.Rotation, f),
+				lerp(a.Scale, b.Scale, f),
+			}
+		}
+	}
+	return keys[len(keys)-1]
+}
+
+func (in *MovingInstance) Hit(ray Ray, tMin, tMax float64, record *HitRecord) bool {
+	m := in.Pose(ray.Time).Matrix()
+	return hitTransformed(in.Object, m, m.Inverse(), ray, tMin, tMax, record)
+}
+
+func (in *MovingInstance) PositionAt(p vec3.Vec3, from, to float64) vec3.Vec3 {
+	return in.Pose(to).Matrix().Point(in.Pose(from).Matrix().Inverse().Point(p))
+}
+
+// rotations make the swept box bulge between keyframes, so the pose is
+// sampled at the keyframes inside the interval and at small steps in between
+func (in *MovingInstance) BoundingBox(t0, t1 float64, box *AABB) bool {
+	var local AABB
+	if !in.Object.BoundingBox(t0, t1, &local) {
+		return false
+	}
+	times := []float64{t0, t1}
+	for _, k := range in.Keyframes {
+		if t0 < k.Time && k.Time < t1 {
+			times = append(times, k.Time)
+		}
+	}
+	const steps = 32
+	for i := 1; i < steps; i++ {
+		times = append(times, t0+(t1-t0)*float64(i)/steps)
+	}
+	for i, t := range times {
+		b := in.Pose(t).Matrix().Box(local)
+		if i == 0 {
+			*box = b
+		} else {
+			*box = surroundingBox(*box, b)
+		}
+	}
+	return true
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+
+	"./vec3"
+)
+
+// media that are not part of the world hierarchy, but are tracked along every ray
+type Volume interface {
+	// samples a scattering event before the ray reaches tMax
+	Sample(ray Ray, tMin, tMax float64, record *HitRecord) bool
+	// fraction of light passing through the volume between two points
+	Transmittance(from, to vec3.Vec3) float64
+}
+
+
+// dense 3D grid of densities (and optionally temperatures, in Kelvin)
+type VoxelGrid struct {
+	Nx, Ny, Nz  int
+	Density     []float32
+	Temperature []float32 // nil if the grid has no temperature channel
+	MaxDensity  float64
+}
+
+// grid file format (little endian):
+//   4 bytes   magic "VXGR"
+//   uint32    nx, ny, nz
+//   uint32    number of channels (1 = density, 2 = density + temperature)
+//   float32   nx*ny*nz values per channel, x varies fastest, then y, then z
+func loadVoxelGrid(filename string) (*VoxelGrid, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) < 20 || string(contents[:4]) != "VXGR" {
+		return nil, fmt.Errorf("`%s` is not a voxel grid", filename)
+	}
+
+	r := bytes.NewReader(contents[4:])
+	var header [4]uint32
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("voxel grid `%s`: %v", filename, err)
+	}
+	nx, ny, nz, channels := int(header[0]), int(header[1]), int(header[2]), int(header[3])
+	// divided rather than multiplied, large sizes must not wrap around
+	size := len(contents) - 20
+	if nx < 1 || ny < 1 || nz < 1 || nx > size || ny > size || nz > size || channels < 1 || channels > 2 ||
+		ny > size/nx || nz > size/(nx*ny) || nx*ny*nz > size/(4*channels) {
+		return nil, fmt.Errorf("voxel grid `%s` is truncated or malformed", filename)
+	}
+	n := nx * ny * nz
+
+	grid := &VoxelGrid{Nx: nx, Ny: ny, Nz: nz}
+	grid.Density = make([]float32, n)
+	if err := binary.Read(r, binary.LittleEndian, grid.Density); err != nil {
+		return nil, fmt.Errorf("voxel grid `%s`: %v", filename, err)
+	}
+	if channels == 2 {
+		grid.Temperature = make([]float32, n)
+		if err := binary.Read(r, binary.LittleEndian, grid.Temperature); err != nil {
+			return nil, fmt.Errorf("voxel grid `%s`: %v", filename, err)
+		}
+	}
+	for _, d := range grid.Density {
+		grid.MaxDensity = math.Max(grid.MaxDensity, float64(d))
+	}
+	fmt.Printf("Loaded voxel grid `%s` (%dx%dx%d)\n", filename, nx, ny, nz)
+	return grid, nil
+}
+
+// trilinear interpolation between voxel centers, p in [0, 1]^3
+func (g *VoxelGrid) lookup(values []float32, p vec3.Vec3) float64 {
+	x := p.X*float64(g.Nx) - 0.5
+	y := p.Y*float64(g.Ny) - 0.5
+	z := p.Z*float64(g.Nz) - 0.5
+	i0, j0, k0 := int(math.Floor(x)), int(math.Floor(y)), int(math.Floor(z))
+	fx, fy, fz := x-float64(i0), y-float64(j0), z-float64(k0)
+
+	at := func(i, j, k int) float64 {
+		i = minInt(maxInt(i, 0), g.Nx-1)
+		j = minInt(maxInt(j, 0), g.Ny-1)
+		k = minInt(maxInt(k, 0), g.Nz-1)
+		return float64(values[(k*g.Ny+j)*g.Nx+i])
+	}
+	mix := func(a, b, f float64) float64 { return a + (b-a)*f }
+
+	c00 := mix(at(i0, j0, k0), at(i0+1, j0, k0), fx)
+	c10 := mix(at(i0, j0+1, k0), at(i0+1, j0+1, k0), fx)
+	c01 := mix(at(i0, j0, k0+1), at(i0+1, j0, k0+1), fx)
+	c11 := mix(at(i0, j0+1, k0+1), at(i0+1, j0+1, k0+1), fx)
+	return mix(mix(c00, c10, fy), mix(c01, c11, fy), fz)
+}
+
+
+// heterogeneous medium, a voxel grid stretched over an axis-aligned box
+// free paths are sampled with delta tracking, shadow rays use ratio tracking
+type GridVolume struct {
+	Grid          *VoxelGrid
+	Box           AABB
+	DensityScale  float64
+	Albedo        vec3.Vec3
+	G             float64 // Henyey-Greenstein asymmetry
+	EmissionScale float64 // brightness of the blackbody emission at 1500K, zero for no emission
+}
+
+func (v *GridVolume) local(p vec3.Vec3) vec3.Vec3 {
+	size := vec3.Sub(v.Box.Max, v.Box.Min)
+	d := vec3.Sub(p, v.Box.Min)
+	return vec3.New(d.X/size.X, d.Y/size.Y, d.Z/size.Z)
+}
+
+func (v *GridVolume) density(p vec3.Vec3) float64 {
+	return v.Grid.lookup(v.Grid.Density, v.local(p)) * v.DensityScale
+}
+
+func (v *GridVolume) Sample(ray Ray, tMin, tMax float64, record *HitRecord) bool {
+	majorant := v.Grid.MaxDensity * v.DensityScale
+	if majorant <= 0 {
+		return false
+	}
+	o, d := ray.Origin(), ray.Direction()
+	if !clipSlab(o.X, d.X, v.Box.Min.X, v.Box.Max.X, &tMin, &tMax) ||
+		!clipSlab(o.Y, d.Y, v.Box.Min.Y, v.Box.Max.Y, &tMin, &tMax) ||
+		!clipSlab(o.Z, d.Z, v.Box.Min.Z, v.Box.Max.Z, &tMin, &tMax) {
+		return false
+	}
+
+	length := vec3.Len(d)
+	random := newMediumRandom(ray, tMin)
+	t := tMin
+	for {
+		t += -math.Log(1-random.Float64()) / (majorant * length)
+		if t >= tMax {
+			return false
+		}
+		p := ray.PointAtParameter(t)
+		if random.Float64()*majorant < v.density(p) {
+			var emission vec3.Vec3
+			if v.EmissionScale > 0 && v.Grid.Temperature != nil {
+				kelvin := v.Grid.lookup(v.Grid.Temperature, v.local(p))
+				// emitted power grows with the fourth power of the temperature (Stefan-Boltzmann)
+				emission = vec3.Scale(blackbody(kelvin), v.EmissionScale*math.Pow(kelvin/1500, 4))
+			}
+			record.T = t
+			record.P = p
+			record.Normal = vec3.Scale(d, -1/length)
+			record.U, record.V = 0, 0
+			record.Material = EmissiveMedium{HenyeyGreenstein{v.Albedo, v.G}, emission}
+			return true
+		}
+	}
+}
+
+func (v *GridVolume) Transmittance(from, to vec3.Vec3) float64 {
+	majorant := v.Grid.MaxDensity * v.DensityScale
+	if majorant <= 0 {
+		return 1
+	}
+	ray := Ray{from, vec3.Sub(to, from), 0}
+	o, d := ray.Origin(), ray.Direction()
+	tMin, tMax := 0.0, 1.0
+	if !clipSlab(o.X, d.X, v.Box.Min.X, v.Box.Max.X, &tMin, &tMax) ||
+		!clipSlab(o.Y, d.Y, v.Box.Min.Y, v.Box.Max.Y, &tMin, &tMax) ||
+		!clipSlab(o.Z, d.Z, v.Box.Min.Z, v.Box.Max.Z, &tMin, &tMax) {
+		return 1
+	}
+
+	length := vec3.Len(d)
+	random := newMediumRandom(ray, tMin)
+	transmittance := 1.0
+	t := tMin
+	for {
+		t += -math.Log(1-random.Float64()) / (majorant * length)
+		if t >= tMax {
+			return transmittance
+		}
+		transmittance *= 1 - v.density(ray.PointAtParameter(t))/majorant
+		// russian roulette once little light gets through
+		if transmittance < 0.1 {
+			if random.Float64() > transmittance {
+				return 0
+			}
+			transmittance = 1
+		}
+	}
+}
+
+
+// color of a black body at the given temperature (Kelvin), normalized to a maximum of 1
+// Planck's law evaluated at representative wavelengths for red, green and blue
+func blackbody(kelvin float64) vec3.Vec3 {
+	if kelvin <= 0 {
+		return vec3.New(0, 0, 0)
+	}
+	planck := func(nm float64) float64 {
+		const c1 = 3.74183e-16 // 2*pi*h*c^2
+		const c2 = 1.4388e-2   // h*c/k
+		l := nm * 1e-9
+		return c1 / (math.Pow(l, 5) * (math.Exp(c2/(l*kelvin)) - 1))
+	}
+	c := vec3.New(planck(610), planck(550), planck(465))
+	m := math.Max(c.X, math.Max(c.Y, c.Z))
+	if m == 0 {
+		return vec3.New(0, 0, 0)
+	}
+	return vec3.Scale(c, 1/m)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func voxelGridFile(header [4]uint32, values []float32) []byte {
+	var b bytes.Buffer
+	b.WriteString("VXGR")
+	binary.Write(&b, binary.LittleEndian, header)
+	binary.Write(&b, binary.LittleEndian, values)
+	return b.Bytes()
+}
+
+func TestLoadVoxelGrid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxgr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "grid.vxgr")
+
+	// 2x1x1 densities followed by their temperatures
+	contents := voxelGridFile([4]uint32{2, 1, 1, 2}, []float32{0.5, 2, 1000, 1500})
+	if err := ioutil.WriteFile(filename, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	grid, err := loadVoxelGrid(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grid.Nx != 2 || grid.Ny != 1 || grid.Nz != 1 || grid.MaxDensity != 2 ||
+		len(grid.Density) != 2 || grid.Density[0] != 0.5 || len(grid.Temperature) != 2 || grid.Temperature[1] != 1500 {
+		t.Errorf("loaded %+v", grid)
+	}
+}
+
+func TestLoadVoxelGridRejectsBadInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxgr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "grid.vxgr")
+
+	bad := map[string][]byte{
+		"empty":         nil,
+		"not a grid":    []byte("P6\n1 1\n255\n\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"),
+		"short header":  []byte("VXGR\x01\x00\x00\x00"),
+		"empty grid":    voxelGridFile([4]uint32{0, 1, 1, 1}, nil),
+		"channels":      voxelGridFile([4]uint32{1, 1, 1, 3}, []float32{1, 2, 3}),
+		"truncated":     voxelGridFile([4]uint32{2, 2, 2, 1}, []float32{1, 2, 3}),
+		"temperature":   voxelGridFile([4]uint32{2, 1, 1, 2}, []float32{1, 2, 3}),
+		"wrapping size": voxelGridFile([4]uint32{1 << 20, 1 << 21, 1 << 21, 1}, nil),
+		"huge":          voxelGridFile([4]uint32{1 << 31, 1 << 31, 1 << 31, 2}, []float32{1}),
+	}
+	for name, contents := range bad {
+		if err := ioutil.WriteFile(filename, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadVoxelGrid(filename); err == nil {
+			t.Errorf("%s: loaded without an error", name)
+		}
+	}
+}